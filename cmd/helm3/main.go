@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -12,15 +13,21 @@ import (
 func main() {
 	cmd, err := buildRootCommand(os.Stdin)
 	if err != nil {
-		fmt.Printf("err: %s\n", err)
+		helm3.WriteError(os.Stderr, helm3.LogFormatText, err)
 		os.Exit(1)
 	}
-	if err := cmd.Execute(); err != nil {
-		fmt.Printf("err: %s\n", err)
+	if err := cmd.ExecuteContext(context.Background()); err != nil {
+		printError(cmd, err)
 		os.Exit(1)
 	}
 }
 
+// printError writes the error of the command to stderr, in the format of the logs
+func printError(cmd *cobra.Command, err error) {
+	format, _ := cmd.PersistentFlags().GetString("log-format")
+	helm3.WriteError(cmd.ErrOrStderr(), format, err)
+}
+
 func buildRootCommand(in io.Reader) (*cobra.Command, error) {
 	m := helm3.New()
 
@@ -28,15 +35,28 @@ func buildRootCommand(in io.Reader) (*cobra.Command, error) {
 	cmd := &cobra.Command{
 		Use:  "helm3",
 		Long: "A helm3 mixin to use to deploy your resources with porter 👩🏽‍✈️",
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			// Enable swapping out stdout/stderr for testing
 			m.Out = cmd.OutOrStdout()
 			m.Err = cmd.OutOrStderr()
+
+			if m.LogFormat != helm3.LogFormatText && m.LogFormat != helm3.LogFormatJSON {
+				return fmt.Errorf("invalid --log-format %q, must be %s or %s", m.LogFormat, helm3.LogFormatText, helm3.LogFormatJSON)
+			}
+
+			// Run the command in the trace of porter
+			cmd.SetContext(m.ConfigureTracing(cmd.Context()))
+			return nil
 		},
 		SilenceUsage: true,
+		// The error is written by main, in the format of the logs
+		SilenceErrors: true,
 	}
 
 	cmd.PersistentFlags().BoolVar(&m.DebugMode, "debug", false, "Enable debug logging")
+	cmd.PersistentFlags().StringVar(&m.LogFormat, "log-format", helm3.LogFormatText, "Format of the logs of the steps: text, or json to write each line as a JSON record")
+	cmd.PersistentFlags().IntVar(&m.MaxParallelSteps, "max-parallel-steps", 0, "Maximum number of steps from the payload to run at the same time, overrides the maxParallelSteps of the mixin configuration (default 1)")
+	cmd.PersistentFlags().DurationVar(&m.TerminationGracePeriod, "termination-grace-period", m.TerminationGracePeriod, "Time helm has to stop when the mixin is interrupted, before it is killed")
 
 	cmd.AddCommand(buildVersionCommand(m))
 	cmd.AddCommand(buildSchemaCommand(m))
@@ -45,6 +65,7 @@ func buildRootCommand(in io.Reader) (*cobra.Command, error) {
 	cmd.AddCommand(buildInvokeCommand(m))
 	cmd.AddCommand(buildUpgradeCommand(m))
 	cmd.AddCommand(buildUninstallCommand(m))
+	cmd.AddCommand(buildPostRenderCommand(m))
 
 	return cmd, nil
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRootCommand_Tracing(t *testing.T) {
+	// The tracer provider porter configures for the mixin, recorded in memory
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		provider.Shutdown(context.Background())
+	})
+	t.Setenv("TRACEPARENT", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	cmd, err := buildRootCommand(strings.NewReader("config: {}\n"))
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	cmd.SetOut(out)
+	cmd.SetErr(out)
+	cmd.SetArgs([]string{"build"})
+	require.NoError(t, cmd.Execute())
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "helm3.Build", spans[0].Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext.TraceID().String(), "the span is part of the trace of porter")
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent.SpanID().String(), "the span is a child of the span of porter")
+	assert.True(t, spans[0].Parent.IsRemote())
+}
+
+func TestRootCommand_WithoutTracing(t *testing.T) {
+	t.Setenv("TRACEPARENT", "")
+
+	cmd, err := buildRootCommand(strings.NewReader("config: {}\n"))
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	cmd.SetOut(out)
+	cmd.SetErr(out)
+	cmd.SetArgs([]string{"build"})
+	require.NoError(t, cmd.Execute())
+	assert.Contains(t, out.String(), "helm")
+}
+
+func TestRootCommand_Error(t *testing.T) {
+	testcases := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "text", args: []string{"build"}, wantErr: "err: could not unmarshal input"},
+		{name: "json", args: []string{"build", "--log-format", "json"}, wantErr: `"outcome":"failed","error":"could not unmarshal input`},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd, err := buildRootCommand(strings.NewReader("config: [\n"))
+			require.NoError(t, err)
+			out := &bytes.Buffer{}
+			errOut := &bytes.Buffer{}
+			cmd.SetOut(out)
+			cmd.SetErr(errOut)
+			cmd.SetArgs(tc.args)
+			err = cmd.Execute()
+			require.Error(t, err)
+
+			assert.Empty(t, errOut.String(), "cobra does not print the error")
+			printError(cmd, err)
+			assert.Contains(t, errOut.String(), tc.wantErr)
+			assert.NotContains(t, out.String(), "err:", "the error is written to stderr")
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/MChorfa/porter-helm3/pkg/helm3"
+	"github.com/spf13/cobra"
+)
+
+func buildPostRenderCommand(m *helm3.Mixin) *cobra.Command {
+	var configFile string
+
+	cmd := &cobra.Command{
+		Use:    helm3.PostRendererCommand,
+		Short:  "Transform the manifests rendered by helm",
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return m.PostRender(cmd.Context(), configFile)
+		},
+	}
+
+	cmd.Flags().StringVar(&configFile, "config", "", "Path to the post-renderer configuration")
+	cmd.MarkFlagRequired("config")
+
+	return cmd
+}
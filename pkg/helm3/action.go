@@ -64,10 +64,17 @@ type ExecuteSteps struct {
 }
 
 type ExecuteStep struct {
-	Step      `yaml:",inline"`
-	Namespace string        `yaml:"namespace,omitempty"`
-	Arguments []string      `yaml:"arguments,omitempty"`
-	Flags     builder.Flags `yaml:"flags,omitempty"`
+	Step           `yaml:",inline"`
+	KubeConnection `yaml:",inline"`
+	Identity       `yaml:",inline"`
+	Namespace      string        `yaml:"namespace,omitempty"`
+	Arguments      []string      `yaml:"arguments,omitempty"`
+	Flags          builder.Flags `yaml:"flags,omitempty"`
+
+	// Drift compares the objects of a release with their live state, instead of running helm
+	Drift *DriftCheck `yaml:"drift,omitempty"`
+	// Health evaluates the readiness of the objects of a release, instead of running helm
+	Health *HealthCheck `yaml:"health,omitempty"`
 }
 
 func (s ExecuteStep) GetWorkingDir() string {
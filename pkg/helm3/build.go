@@ -16,9 +16,19 @@ import (
 // Currently, this mixin only supports Helm clients versioned v3.x.x
 const clientVersionConstraint string = "^v3.x"
 
+// cascadeVersionConstraint is the semver constraint for the Helm client supporting the --cascade flag of helm uninstall
+const cascadeVersionConstraint string = ">=v3.12.0"
+
 // BuildInput represents stdin passed to the mixin for the build command.
 type BuildInput struct {
 	Config MixinConfig
+	// Actions are the steps of the bundle using the mixin, checked against the Helm client installed in the bundle
+	Actions BuildActions `yaml:"actions,omitempty"`
+}
+
+// BuildActions are the steps of the bundle actions that depend on the Helm client version
+type BuildActions struct {
+	Uninstall []UninstallStep `yaml:"uninstall,omitempty"`
 }
 
 // MixinConfig represents configuration that can be set on the helm3 mixin in porter.yaml
@@ -30,12 +40,20 @@ type BuildInput struct {
 //	  repositories:
 //	    stable:
 //		  url: "https://charts.helm.sh/stable"
+//	  kubeContext: staging
+//	  maxParallelSteps: 3
 
 type MixinConfig struct {
 	ClientVersion      string                `yaml:"clientVersion,omitempty"`
 	ClientPlatform     string                `yaml:"clientPlatform,omitempty"`
 	ClientArchitecture string                `yaml:"clientArchitecture,omitempty"`
 	Repositories       map[string]Repository `yaml:"repositories,omitempty"`
+
+	// KubeConnection is the default connection of the steps, set in the environment of the invocation image
+	KubeConnection `yaml:",inline"`
+
+	// MaxParallelSteps is the maximum number of steps of an action run at the same time, set in the environment of the invocation image
+	MaxParallelSteps int `yaml:"maxParallelSteps,omitempty"`
 }
 
 type Repository struct {
@@ -44,11 +62,13 @@ type Repository struct {
 
 // Build will generate the necessary Dockerfile lines
 // for an invocation image using this mixin
-func (m *Mixin) Build(ctx context.Context) error {
+func (m *Mixin) Build(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "helm3.Build")
+	defer func() { endSpan(span, err) }()
 
 	// Create new Builder.
 	var input BuildInput
-	err := builder.LoadAction(ctx, m.RuntimeConfig, "", func(contents []byte) (interface{}, error) {
+	err = builder.LoadAction(ctx, m.RuntimeConfig, "", func(contents []byte) (interface{}, error) {
 		err := yaml.Unmarshal(contents, &input)
 		return &input, err
 	})
@@ -76,6 +96,17 @@ func (m *Mixin) Build(ctx context.Context) error {
 	if input.Config.ClientArchitecture != "" {
 		m.HelmClientArchitecture = input.Config.ClientArchitecture
 	}
+
+	if err := validateClientFeatures(m.HelmClientVersion, input.Actions); err != nil {
+		return err
+	}
+
+	if err := input.Config.KubeConnection.validate(); err != nil {
+		return err
+	}
+	if input.Config.MaxParallelSteps < 0 {
+		return errors.Errorf("invalid maxParallelSteps %d, must be at least 1", input.Config.MaxParallelSteps)
+	}
 	// Install helm3
 	fmt.Fprint(m.Out, "ENV HELM_EXPERIMENTAL_OCI=1")
 	fmt.Fprintf(m.Out, "\nRUN apt-get update && apt-get install -y curl")
@@ -85,6 +116,12 @@ func (m *Mixin) Build(ctx context.Context) error {
 	fmt.Fprintf(m.Out, "\nRUN mv linux-amd64/helm /usr/local/bin/helm3")
 	fmt.Fprintf(m.Out, "\nRUN curl -o kubectl https://storage.googleapis.com/kubernetes-release/release/v1.22.1/bin/linux/amd64/kubectl &&\\")
 	fmt.Fprintf(m.Out, "\n    mv kubectl /usr/local/bin && chmod a+x /usr/local/bin/kubectl\n")
+	for _, env := range connectionEnv(input.Config.KubeConnection) {
+		fmt.Fprintf(m.Out, "ENV %s\n", env)
+	}
+	if input.Config.MaxParallelSteps > 0 {
+		fmt.Fprintf(m.Out, "ENV %s=%d\n", maxParallelStepsEnv, input.Config.MaxParallelSteps)
+	}
 	if len(input.Config.Repositories) > 0 {
 		// Switch to a non-root user so helm is configured for the user the container will execute as
 		fmt.Fprintln(m.Out, "USER ${BUNDLE_USER}")
@@ -117,6 +154,43 @@ func (m *Mixin) Build(ctx context.Context) error {
 	return nil
 }
 
+// validateClientFeatures checks that the Helm client installed in the bundle supports the settings of the steps,
+// so that the bundle fails to build instead of failing with an unknown flag when it runs
+func validateClientFeatures(clientVersion string, actions BuildActions) error {
+	for _, step := range actions.Uninstall {
+		if step.Cascade == "" {
+			continue
+		}
+		ok, err := validate(clientVersion, cascadeVersionConstraint)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.Errorf("step %q sets cascade, which requires a clientVersion meeting %q, but the clientVersion is %q",
+				step.Description, cascadeVersionConstraint, clientVersion)
+		}
+	}
+	return nil
+}
+
+// connectionEnv sets the connection of the mixin configuration in the environment of the invocation image
+func connectionEnv(conn KubeConnection) []string {
+	var env []string
+	if conn.Kubeconfig != "" {
+		env = append(env, "KUBECONFIG="+conn.Kubeconfig)
+	}
+	if conn.KubeContext != "" {
+		env = append(env, kubeContextEnv+"="+conn.KubeContext)
+	}
+	if conn.InCluster {
+		env = append(env, inClusterEnv+"=true")
+	}
+	if conn.TokenFile != "" {
+		env = append(env, tokenFileEnv+"="+conn.TokenFile)
+	}
+	return env
+}
+
 func getRepositoryCommand(name, url string) (repositoryCommand []string, err error) {
 
 	var commandBuilder []string
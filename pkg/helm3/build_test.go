@@ -128,4 +128,70 @@ USER root
 		err = m.Build(ctx)
 		require.EqualError(t, err, `supplied client version "v3.8.2.0" cannot be parsed as semver: Invalid Semantic Version`)
 	})
+
+	t.Run("build with a default connection", func(t *testing.T) {
+		b, err := ioutil.ReadFile("testdata/build-input-with-connection.yaml")
+		require.NoError(t, err)
+
+		m := NewTestMixin(t)
+		m.DebugMode = false
+		m.In = bytes.NewReader(b)
+		err = m.Build(ctx)
+		require.NoError(t, err, "build failed")
+		wantOutput := fmt.Sprintf(buildOutput, m.HelmClientVersion, m.HelmClientPlatform, m.HelmClientArchitecture) +
+			`ENV KUBECONFIG=/home/nonroot/.kube/config
+ENV HELM_KUBECONTEXT=staging
+ENV HELM3_MIXIN_TOKEN_FILE=/var/run/secrets/tokens/porter
+`
+		gotOutput := m.TestContext.GetOutput()
+		assert.Equal(t, wantOutput, gotOutput)
+	})
+
+	t.Run("build with parallel steps", func(t *testing.T) {
+		m := NewTestMixin(t)
+		m.In = bytes.NewBufferString("config:\n  maxParallelSteps: 3\n")
+		err := m.Build(ctx)
+		require.NoError(t, err, "build failed")
+		wantOutput := fmt.Sprintf(buildOutput, m.HelmClientVersion, m.HelmClientPlatform, m.HelmClientArchitecture) +
+			"ENV HELM3_MIXIN_MAX_PARALLEL_STEPS=3\n"
+		assert.Equal(t, wantOutput, m.TestContext.GetOutput())
+	})
+
+	t.Run("build with invalid parallel steps", func(t *testing.T) {
+		m := NewTestMixin(t)
+		m.In = bytes.NewBufferString("config:\n  maxParallelSteps: -1\n")
+		err := m.Build(ctx)
+		require.EqualError(t, err, "invalid maxParallelSteps -1, must be at least 1")
+	})
+
+	t.Run("build with cascade and the default client", func(t *testing.T) {
+		b, err := ioutil.ReadFile("testdata/bad-build-input.cascade-client-version.yaml")
+		require.NoError(t, err)
+
+		m := NewTestMixin(t)
+		m.In = bytes.NewReader(b)
+		err = m.Build(ctx)
+		require.EqualError(t, err, `step "Uninstall MySQL" sets cascade, which requires a clientVersion meeting ">=v3.12.0", but the clientVersion is "v3.8.2"`)
+	})
+
+	t.Run("build with cascade and a recent client", func(t *testing.T) {
+		b, err := ioutil.ReadFile("testdata/build-input-with-cascade.yaml")
+		require.NoError(t, err)
+
+		m := NewTestMixin(t)
+		m.In = bytes.NewReader(b)
+		err = m.Build(ctx)
+		require.NoError(t, err, "build failed")
+		assert.Contains(t, m.TestContext.GetOutput(), "https://get.helm.sh/helm-v3.12.3-linux-amd64.tar.gz")
+	})
+
+	t.Run("build with an in-cluster connection and a context", func(t *testing.T) {
+		b, err := ioutil.ReadFile("testdata/bad-build-input.in-cluster-with-context.yaml")
+		require.NoError(t, err)
+
+		m := NewTestMixin(t)
+		m.In = bytes.NewReader(b)
+		err = m.Build(ctx)
+		require.EqualError(t, err, "inCluster cannot be combined with kubeconfig or kubeContext")
+	})
 }
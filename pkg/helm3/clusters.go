@@ -0,0 +1,104 @@
+package helm3
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// ClusterTarget is one of the clusters an Install or Upgrade step deploys its release to
+type ClusterTarget struct {
+	// Name identifies the cluster in the logs, and suffixes the outputs read from it
+	Name           string `yaml:"name"`
+	KubeConnection `yaml:",inline"`
+	// Namespace overrides the namespace of the step on this cluster
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+// clusterNamePattern keeps the suffixed output names valid
+var clusterNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Outcome of the deployment of a release to a cluster, reported at the end of the step
+const (
+	clusterResultDeployed = "deployed"
+	clusterResultFailed   = "failed"
+)
+
+// connection is the connection of the cluster, or the one of the step when the cluster does not set any
+func (c ClusterTarget) connection(stepConnection KubeConnection) KubeConnection {
+	if c.KubeConnection == (KubeConnection{}) {
+		return stepConnection
+	}
+	return c.KubeConnection
+}
+
+// namespace is the namespace of the release on the cluster
+func (c ClusterTarget) namespace(stepNamespace string) string {
+	if c.Namespace == "" {
+		return stepNamespace
+	}
+	return c.Namespace
+}
+
+// outputs renames the outputs of a step with the name of the cluster they are read from
+func (c ClusterTarget) outputs(stepOutputs []HelmOutput) []HelmOutput {
+	outputs := make([]HelmOutput, len(stepOutputs))
+	for i, output := range stepOutputs {
+		output.Name = fmt.Sprintf("%s-%s", output.Name, c.Name)
+		outputs[i] = output
+	}
+	return outputs
+}
+
+func validateClusters(clusters []ClusterTarget) error {
+	names := make(map[string]bool)
+	for _, cluster := range clusters {
+		if !clusterNamePattern.MatchString(cluster.Name) {
+			return fmt.Errorf("invalid cluster name %q, must only contain letters, digits, - and _", cluster.Name)
+		}
+		if names[cluster.Name] {
+			return fmt.Errorf("cluster %s is declared twice", cluster.Name)
+		}
+		names[cluster.Name] = true
+		if err := cluster.KubeConnection.validate(); err != nil {
+			return errors.Wrapf(err, "invalid connection of cluster %s", cluster.Name)
+		}
+	}
+	return nil
+}
+
+// deployToClusters deploys a release to each cluster, with up to parallelism clusters at the same time.
+// A failure on one cluster does not stop the deployment to the others, the clusters where it failed are reported together.
+func deployToClusters(release string, clusters []ClusterTarget, parallelism int, out io.Writer, errOut io.Writer,
+	deploy func(cluster ClusterTarget, out io.Writer, errOut io.Writer) error) error {
+	if err := validateClusters(clusters); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(clusters))
+	runBuffered(len(clusters), parallelism, out, errOut, func(i int, out io.Writer, errOut io.Writer) {
+		fmt.Fprintf(out, "Deploying release %s to cluster %s\n", release, clusters[i].Name)
+		errs[i] = deploy(clusters[i], out, errOut)
+	})
+
+	var result error
+	var failed []string
+	fmt.Fprintln(out, "Cluster results:")
+	for i, cluster := range clusters {
+		if errs[i] != nil {
+			failed = append(failed, cluster.Name)
+			result = multierror.Append(result, errors.Wrapf(errs[i], "cluster %s", cluster.Name))
+			fmt.Fprintf(out, "  %s: %s\n", cluster.Name, clusterResultFailed)
+			continue
+		}
+		fmt.Fprintf(out, "  %s: %s\n", cluster.Name, clusterResultDeployed)
+	}
+	if result != nil {
+		return errors.Wrapf(result, "release %s failed on %d of %d clusters (%s)", release, len(failed), len(clusters), strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"get.porter.sh/porter/pkg/portercontext"
+	"get.porter.sh/porter/pkg/test"
+	"github.com/MChorfa/porter-helm3/pkg/kubernetes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMixin_UnmarshalClusters(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/install-input-clusters.yaml")
+	require.NoError(t, err)
+
+	var action InstallAction
+	err = yaml.Unmarshal(b, &action)
+	require.NoError(t, err)
+	require.Len(t, action.Steps, 1)
+
+	assert.Equal(t, []ClusterTarget{
+		{Name: "east", KubeConnection: KubeConnection{Kubeconfig: "/cnab/app/kubeconfig-east"}},
+		{Name: "west", KubeConnection: KubeConnection{Kubeconfig: "/cnab/app/kubeconfig-west", KubeContext: "prod"}, Namespace: "mydb-west"},
+	}, action.Steps[0].Clusters)
+	assert.Equal(t, 2, action.Steps[0].Parallelism)
+}
+
+func TestValidateClusters(t *testing.T) {
+	assert.NoError(t, validateClusters([]ClusterTarget{{Name: "east"}, {Name: "west_2"}}))
+	assert.EqualError(t, validateClusters([]ClusterTarget{{Name: "east.1"}}), `invalid cluster name "east.1", must only contain letters, digits, - and _`)
+	assert.EqualError(t, validateClusters([]ClusterTarget{{Name: "east"}, {Name: "east"}}), "cluster east is declared twice")
+	assert.EqualError(t, validateClusters([]ClusterTarget{{Name: "east", KubeConnection: KubeConnection{InCluster: true, KubeContext: "east"}}}),
+		"invalid connection of cluster east: inCluster cannot be combined with kubeconfig or kubeContext")
+}
+
+func TestMixin_InstallClusters(t *testing.T) {
+	ctx := context.Background()
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+
+	action := InstallAction{Steps: []InstallStep{
+		{
+			InstallArguments: InstallArguments{
+				Step: Step{
+					Description: "Install MySQL",
+					Outputs:     []HelmOutput{{Name: "mysql-password", Secret: "mysql", Key: "password"}},
+				},
+				Name:      "mysql",
+				Chart:     "bitnami/mysql",
+				Namespace: "mydb",
+				Clusters: []ClusterTarget{
+					{Name: "east", KubeConnection: KubeConnection{KubeContext: "east"}},
+					{Name: "west", KubeConnection: KubeConnection{KubeContext: "west"}, Namespace: "mydb-west"},
+				},
+			},
+		},
+	}}
+
+	eastCommand := "helm3 upgrade --install mysql bitnami/mysql --namespace mydb --kube-context east --atomic --create-namespace"
+	westCommand := "helm3 upgrade --install mysql bitnami/mysql --namespace mydb-west --kube-context west --atomic --create-namespace"
+
+	for _, parallelism := range []int{1, 2} {
+		action.Steps[0].Parallelism = parallelism
+		b, err := yaml.Marshal(action)
+		require.NoError(t, err)
+
+		t.Run("deployed to every cluster", func(t *testing.T) {
+			os.Setenv(test.ExpectedCommandEnv, strings.Join([]string{eastCommand, westCommand}, "\n"))
+
+			h := NewTestMixin(t)
+			h.In = bytes.NewReader(b)
+			factory := &testKubernetesFactory{client: h.KubeClient, dynamicClient: h.DynamicClient}
+			h.ClientFactory = factory
+			for _, namespace := range []string{"mydb", "mydb-west"} {
+				secret := &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "mysql", Namespace: namespace},
+					Data:       map[string][]byte{"password": []byte("secret-of-" + namespace)},
+				}
+				require.NoError(t, h.KubeClient.Tracker().Add(secret))
+			}
+
+			err := h.Install(ctx)
+			require.NoError(t, err)
+
+			output := h.TestContext.GetOutput()
+			assert.Less(t, strings.Index(output, "Deploying release mysql to cluster east\n"), strings.Index(output, "Deploying release mysql to cluster west\n"),
+				"the logs are written in the order of the clusters")
+			assert.Contains(t, output, "Cluster results:\n  east: deployed\n  west: deployed\n")
+			assert.ElementsMatch(t, []kubernetes.Connection{{Context: "east"}, {Context: "west"}}, factory.connections)
+
+			east, err := h.FileSystem.ReadFile(filepath.Join(portercontext.MixinOutputsDir, "mysql-password-east"))
+			require.NoError(t, err)
+			assert.Equal(t, "secret-of-mydb", string(east))
+			west, err := h.FileSystem.ReadFile(filepath.Join(portercontext.MixinOutputsDir, "mysql-password-west"))
+			require.NoError(t, err)
+			assert.Equal(t, "secret-of-mydb-west", string(west))
+		})
+
+		t.Run("failed on a cluster", func(t *testing.T) {
+			os.Setenv(test.ExpectedCommandEnv, eastCommand)
+
+			h := NewTestMixin(t)
+			h.In = bytes.NewReader(b)
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "mysql", Namespace: "mydb"},
+				Data:       map[string][]byte{"password": []byte("secret-of-mydb")},
+			}
+			require.NoError(t, h.KubeClient.Tracker().Add(secret))
+
+			err := h.Install(ctx)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "release mysql failed on 1 of 2 clusters (west)")
+			assert.Contains(t, err.Error(), "cluster west: ")
+			assert.Contains(t, h.TestContext.GetOutput(), "Cluster results:\n  east: deployed\n  west: failed\n")
+
+			_, err = h.FileSystem.ReadFile(filepath.Join(portercontext.MixinOutputsDir, "mysql-password-east"))
+			assert.NoError(t, err, "the outputs of the successful clusters are written")
+		})
+	}
+}
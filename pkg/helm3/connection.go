@@ -0,0 +1,255 @@
+package helm3
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MChorfa/porter-helm3/pkg/kubernetes"
+	"github.com/pkg/errors"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Environment variables holding the connection settings of the mixin configuration, set in the invocation image by Build.
+// KUBECONFIG is honored by helm, kubectl and client-go without help.
+const (
+	kubeContextEnv = "HELM_KUBECONTEXT"
+	inClusterEnv   = "HELM3_MIXIN_IN_CLUSTER"
+	tokenFileEnv   = "HELM3_MIXIN_TOKEN_FILE"
+	// helmNamespaceEnv is the namespace of helm when a step sets none
+	helmNamespaceEnv = "HELM_NAMESPACE"
+)
+
+// KubeConnection selects the cluster targeted by a step, and the credentials used by helm, kubectl and the outputs to reach it
+type KubeConnection struct {
+	// Kubeconfig is the path of the kubeconfig file, instead of the KUBECONFIG environment variable or ~/.kube/config
+	Kubeconfig string `yaml:"kubeconfig,omitempty"`
+	// KubeContext is the kubeconfig context, instead of the current context
+	KubeContext string `yaml:"kubeContext,omitempty"`
+	// InCluster uses the service account of the pod running the bundle
+	InCluster bool `yaml:"inCluster,omitempty"`
+	// TokenFile is a file holding the bearer token used to authenticate, such as a projected service account token
+	TokenFile string `yaml:"tokenFile,omitempty"`
+}
+
+func (c KubeConnection) validate() error {
+	if c.InCluster && (c.Kubeconfig != "" || c.KubeContext != "") {
+		return errors.New("inCluster cannot be combined with kubeconfig or kubeContext")
+	}
+	return nil
+}
+
+// Identity is the identity used by a step, instead of the user of its connection, to deploy with least privilege
+type Identity struct {
+	// Impersonate acts as another user, with the permissions granted to it
+	Impersonate *Impersonation `yaml:"impersonate,omitempty"`
+	// ServiceAccount is the namespace/name of a service account, whose token is requested with the TokenRequest API
+	ServiceAccount string `yaml:"serviceAccount,omitempty"`
+}
+
+// Impersonation is the user, and the groups, impersonated by a step
+type Impersonation struct {
+	User   string   `yaml:"user,omitempty"`
+	Groups []string `yaml:"groups,omitempty"`
+}
+
+func (i Identity) validate(settings KubeConnection) error {
+	if i.Impersonate != nil && i.Impersonate.User == "" {
+		return errors.New("impersonate requires a user")
+	}
+	if i.ServiceAccount != "" {
+		if _, _, err := splitServiceAccount(i.ServiceAccount); err != nil {
+			return err
+		}
+		if settings.TokenFile != "" {
+			return errors.New("serviceAccount cannot be combined with tokenFile")
+		}
+	}
+	return nil
+}
+
+// splitServiceAccount returns the namespace and the name of a service account written namespace/name
+func splitServiceAccount(serviceAccount string) (string, string, error) {
+	parts := strings.Split(serviceAccount, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid serviceAccount %q, must be namespace/name", serviceAccount)
+	}
+	return parts[0], parts[1], nil
+}
+
+// clusterConnection is the connection of a step, once the defaults of the mixin configuration are applied
+type clusterConnection struct {
+	kubernetes.Connection
+
+	// generatedKubeconfig is passed to helm and kubectl when the credentials are not in a kubeconfig file
+	generatedKubeconfig string
+}
+
+// bounded returns the connection with a timeout of its requests ending at the deadline of ctx,
+// and fails once the deadline is over
+func (c clusterConnection) bounded(ctx context.Context) (kubernetes.Connection, error) {
+	conn := c.Connection
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.Timeout = time.Until(deadline)
+		if conn.Timeout <= 0 {
+			return conn, context.DeadlineExceeded
+		}
+	}
+	return conn, nil
+}
+
+// helmNamespace is the namespace helm uses when a step sets none: the HELM_NAMESPACE environment variable,
+// or else the namespace of the kubeconfig context helm runs with, and default without any
+func (m *Mixin) helmNamespace(conn clusterConnection) string {
+	if namespace := m.Getenv(helmNamespaceEnv); namespace != "" {
+		return namespace
+	}
+
+	rules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: conn.Kubeconfig, Precedence: []string{clientcmd.RecommendedHomeFile}}
+	if kubeconfig := m.Getenv(clientcmd.RecommendedConfigPathEnvVar); kubeconfig != "" {
+		rules.Precedence = filepath.SplitList(kubeconfig)
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: conn.Context}
+	if conn.generatedKubeconfig != "" {
+		rules.ExplicitPath = conn.generatedKubeconfig
+		overrides = &clientcmd.ConfigOverrides{}
+	}
+	namespace, _, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).Namespace()
+	if err != nil || namespace == "" {
+		return "default"
+	}
+	return namespace
+}
+
+// connect resolves the connection of a step, requests the token of its service account,
+// and generates the kubeconfig used by helm and kubectl when needed.
+// The returned function removes the generated files.
+func (m *Mixin) connect(ctx context.Context, settings KubeConnection, identity Identity) (clusterConnection, func(), error) {
+	conn := clusterConnection{Connection: kubernetes.Connection{
+		Kubeconfig: settings.Kubeconfig,
+		Context:    settings.KubeContext,
+		InCluster:  settings.InCluster,
+		TokenFile:  settings.TokenFile,
+	}}
+	// The connection of the mixin configuration is only a default, a step setting its own connection ignores it
+	if settings == (KubeConnection{}) {
+		conn.Context = m.Getenv(kubeContextEnv)
+		conn.InCluster, _ = strconv.ParseBool(m.Getenv(inClusterEnv))
+		conn.TokenFile = m.Getenv(tokenFileEnv)
+	}
+
+	cleanup := func() {}
+	if err := settings.validate(); err != nil {
+		return conn, cleanup, err
+	}
+	if err := identity.validate(settings); err != nil {
+		return conn, cleanup, err
+	}
+	if identity.Impersonate != nil {
+		conn.ImpersonateUser = identity.Impersonate.User
+		conn.ImpersonateGroups = identity.Impersonate.Groups
+	}
+	if !conn.InCluster && conn.TokenFile == "" && identity.ServiceAccount == "" {
+		return conn, cleanup, nil
+	}
+
+	dir, err := makeTempDir("", "helm3-kubeconfig-")
+	if err != nil {
+		return conn, cleanup, errors.Wrap(err, "couldn't create a directory for the kubeconfig")
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	if identity.ServiceAccount != "" {
+		// The token is requested with the credentials of the connection, then replaces them
+		token, err := m.requestServiceAccountToken(ctx, conn, identity.ServiceAccount)
+		if err != nil {
+			cleanup()
+			return conn, func() {}, err
+		}
+		conn.TokenFile = filepath.Join(dir, "token")
+		if err := ioutil.WriteFile(conn.TokenFile, []byte(token), 0600); err != nil {
+			cleanup()
+			return conn, func() {}, errors.Wrap(err, "couldn't write the service account token")
+		}
+	}
+
+	// helm and kubectl only take a token on the command line, where it would be logged, so give them a kubeconfig instead
+	kubeconfig, err := conn.GenerateKubeconfig()
+	if err != nil {
+		cleanup()
+		return conn, func() {}, err
+	}
+	conn.generatedKubeconfig = filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(conn.generatedKubeconfig, kubeconfig, 0600); err != nil {
+		cleanup()
+		return conn, func() {}, errors.Wrap(err, "couldn't write the kubeconfig")
+	}
+	return conn, cleanup, nil
+}
+
+// requestServiceAccountToken requests a token of a service account with the TokenRequest API,
+// valid for the default duration of the API server
+func (m *Mixin) requestServiceAccountToken(ctx context.Context, conn clusterConnection, serviceAccount string) (string, error) {
+	namespace, name, err := splitServiceAccount(serviceAccount)
+	if err != nil {
+		return "", err
+	}
+	kubeClient, err := m.getKubernetesClient(ctx, conn)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't get kubernetes client")
+	}
+	request, err := kubeClient.CoreV1().ServiceAccounts(namespace).CreateToken(ctx, name, &authenticationv1.TokenRequest{}, metav1.CreateOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "could not request a token for service account %s", serviceAccount)
+	}
+	return request.Status.Token, nil
+}
+
+// helmArgs are the flags selecting the cluster of helm
+func (c clusterConnection) helmArgs() []string {
+	if c.generatedKubeconfig != "" {
+		return []string{"--kubeconfig", c.generatedKubeconfig}
+	}
+	var args []string
+	if c.Kubeconfig != "" {
+		args = append(args, "--kubeconfig", c.Kubeconfig)
+	}
+	if c.Context != "" {
+		args = append(args, "--kube-context", c.Context)
+	}
+	if c.ImpersonateUser != "" {
+		args = append(args, "--kube-as-user", c.ImpersonateUser)
+	}
+	for _, group := range c.ImpersonateGroups {
+		args = append(args, "--kube-as-group", group)
+	}
+	return args
+}
+
+// kubectlArgs are the flags selecting the cluster of kubectl
+func (c clusterConnection) kubectlArgs() []string {
+	if c.generatedKubeconfig != "" {
+		return []string{"--kubeconfig=" + c.generatedKubeconfig}
+	}
+	var args []string
+	if c.Kubeconfig != "" {
+		args = append(args, "--kubeconfig="+c.Kubeconfig)
+	}
+	if c.Context != "" {
+		args = append(args, "--context="+c.Context)
+	}
+	if c.ImpersonateUser != "" {
+		args = append(args, "--as="+c.ImpersonateUser)
+	}
+	for _, group := range c.ImpersonateGroups {
+		args = append(args, "--as-group="+group)
+	}
+	return args
+}
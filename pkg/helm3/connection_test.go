@@ -0,0 +1,258 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"get.porter.sh/porter/pkg/test"
+	"github.com/MChorfa/porter-helm3/pkg/kubernetes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: staging
+  cluster:
+    server: https://staging.example.com:6443
+    insecure-skip-tls-verify: true
+users:
+- name: admin
+  user:
+    token: admin-token
+contexts:
+- name: staging
+  context:
+    cluster: staging
+    user: admin
+current-context: staging
+`
+
+func TestMixin_UnmarshalConnection(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/install-input-connection.yaml")
+	require.NoError(t, err)
+
+	var action InstallAction
+	err = yaml.Unmarshal(b, &action)
+	require.NoError(t, err)
+	require.Len(t, action.Steps, 2)
+
+	assert.Equal(t, KubeConnection{Kubeconfig: "/root/.kube/staging.yaml", KubeContext: "staging"}, action.Steps[0].KubeConnection)
+	assert.Equal(t, KubeConnection{InCluster: true, TokenFile: "/var/run/secrets/tokens/porter"}, action.Steps[1].KubeConnection)
+}
+
+func TestMixin_UnmarshalIdentity(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/install-input-identity.yaml")
+	require.NoError(t, err)
+
+	var action InstallAction
+	err = yaml.Unmarshal(b, &action)
+	require.NoError(t, err)
+	require.Len(t, action.Steps, 2)
+
+	assert.Equal(t, Identity{ServiceAccount: "tenant/deployer"}, action.Steps[0].Identity)
+	assert.Equal(t, Identity{Impersonate: &Impersonation{User: "jane", Groups: []string{"developers"}}}, action.Steps[1].Identity)
+}
+
+func TestMixin_Connect(t *testing.T) {
+	testcases := []struct {
+		name            string
+		env             map[string]string
+		settings        KubeConnection
+		identity        Identity
+		wantConnection  kubernetes.Connection
+		wantHelmArgs    []string
+		wantKubectlArgs []string
+		wantError       string
+	}{
+		{
+			name: "default",
+		},
+		{
+			name:            "kubeconfig and context",
+			settings:        KubeConnection{Kubeconfig: "/root/.kube/staging.yaml", KubeContext: "staging"},
+			wantConnection:  kubernetes.Connection{Kubeconfig: "/root/.kube/staging.yaml", Context: "staging"},
+			wantHelmArgs:    []string{"--kubeconfig", "/root/.kube/staging.yaml", "--kube-context", "staging"},
+			wantKubectlArgs: []string{"--kubeconfig=/root/.kube/staging.yaml", "--context=staging"},
+		},
+		{
+			name:            "context of the mixin configuration",
+			env:             map[string]string{kubeContextEnv: "staging"},
+			wantConnection:  kubernetes.Connection{Context: "staging"},
+			wantHelmArgs:    []string{"--kube-context", "staging"},
+			wantKubectlArgs: []string{"--context=staging"},
+		},
+		{
+			name:            "step overriding the mixin configuration",
+			env:             map[string]string{kubeContextEnv: "staging"},
+			settings:        KubeConnection{KubeContext: "production"},
+			wantConnection:  kubernetes.Connection{Context: "production"},
+			wantHelmArgs:    []string{"--kube-context", "production"},
+			wantKubectlArgs: []string{"--context=production"},
+		},
+		{
+			name: "impersonation",
+			identity: Identity{
+				Impersonate: &Impersonation{User: "system:serviceaccount:tenant:deployer", Groups: []string{"tenants", "developers"}},
+			},
+			wantConnection: kubernetes.Connection{
+				ImpersonateUser:   "system:serviceaccount:tenant:deployer",
+				ImpersonateGroups: []string{"tenants", "developers"},
+			},
+			wantHelmArgs: []string{"--kube-as-user", "system:serviceaccount:tenant:deployer",
+				"--kube-as-group", "tenants", "--kube-as-group", "developers"},
+			wantKubectlArgs: []string{"--as=system:serviceaccount:tenant:deployer", "--as-group=tenants", "--as-group=developers"},
+		},
+		{
+			name:      "impersonation without user",
+			identity:  Identity{Impersonate: &Impersonation{Groups: []string{"tenants"}}},
+			wantError: "impersonate requires a user",
+		},
+		{
+			name:      "invalid service account",
+			identity:  Identity{ServiceAccount: "deployer"},
+			wantError: `invalid serviceAccount "deployer", must be namespace/name`,
+		},
+		{
+			name:      "service account with a token file",
+			settings:  KubeConnection{TokenFile: "/var/run/secrets/tokens/porter"},
+			identity:  Identity{ServiceAccount: "tenant/deployer"},
+			wantError: "serviceAccount cannot be combined with tokenFile",
+		},
+		{
+			name:      "in-cluster with a context",
+			settings:  KubeConnection{InCluster: true, KubeContext: "staging"},
+			wantError: "inCluster cannot be combined with kubeconfig or kubeContext",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewTestMixin(t)
+			for key, value := range tc.env {
+				m.Setenv(key, value)
+			}
+
+			conn, cleanup, err := m.connect(context.Background(), tc.settings, tc.identity)
+			defer cleanup()
+			if tc.wantError != "" {
+				require.EqualError(t, err, tc.wantError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantConnection, conn.Connection)
+			assert.Equal(t, tc.wantHelmArgs, conn.helmArgs())
+			assert.Equal(t, tc.wantKubectlArgs, conn.kubectlArgs())
+		})
+	}
+}
+
+func TestMixin_ConnectTokenFile(t *testing.T) {
+	dir := t.TempDir()
+	kubeconfig := filepath.Join(dir, "config")
+	require.NoError(t, ioutil.WriteFile(kubeconfig, []byte(testKubeconfig), 0600))
+
+	// The kubeconfig of the mixin configuration is set in the environment of helm, kubectl and client-go
+	t.Setenv("KUBECONFIG", kubeconfig)
+	m := NewTestMixin(t)
+	m.Setenv(tokenFileEnv, "/var/run/secrets/tokens/porter")
+
+	conn, cleanup, err := m.connect(context.Background(), KubeConnection{}, Identity{})
+	require.NoError(t, err)
+	assert.Equal(t, "/var/run/secrets/tokens/porter", conn.TokenFile)
+	assert.NotEmpty(t, conn.generatedKubeconfig)
+	cleanup()
+
+	// helm and kubectl get a kubeconfig authenticating with the token file instead of the credentials of the user
+	conn, cleanup, err = m.connect(context.Background(), KubeConnection{Kubeconfig: kubeconfig, TokenFile: "/var/run/secrets/tokens/porter"}, Identity{})
+	require.NoError(t, err)
+	require.NotEmpty(t, conn.generatedKubeconfig)
+	assert.Equal(t, []string{"--kubeconfig", conn.generatedKubeconfig}, conn.helmArgs())
+	assert.Equal(t, []string{"--kubeconfig=" + conn.generatedKubeconfig}, conn.kubectlArgs())
+
+	generated, err := ioutil.ReadFile(conn.generatedKubeconfig)
+	require.NoError(t, err)
+	assert.Contains(t, string(generated), "server: https://staging.example.com:6443")
+	assert.Contains(t, string(generated), "tokenFile: /var/run/secrets/tokens/porter")
+	assert.NotContains(t, string(generated), "admin-token")
+
+	cleanup()
+	_, err = os.Stat(conn.generatedKubeconfig)
+	assert.True(t, os.IsNotExist(err), "the generated kubeconfig is removed")
+}
+
+func TestMixin_ConnectServiceAccount(t *testing.T) {
+	dir := t.TempDir()
+	kubeconfig := filepath.Join(dir, "config")
+	require.NoError(t, ioutil.WriteFile(kubeconfig, []byte(testKubeconfig), 0600))
+
+	m := NewTestMixin(t)
+	m.KubeClient.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		create := action.(k8stesting.CreateAction)
+		if create.GetSubresource() != "token" || create.GetNamespace() != "tenant" || create.(k8stesting.CreateActionImpl).Name != "deployer" {
+			return true, nil, fmt.Errorf("unexpected token request %v", action)
+		}
+		return true, &authenticationv1.TokenRequest{Status: authenticationv1.TokenRequestStatus{Token: "deployer-token"}}, nil
+	})
+
+	identity := Identity{
+		ServiceAccount: "tenant/deployer",
+		Impersonate:    &Impersonation{User: "jane"},
+	}
+	conn, cleanup, err := m.connect(context.Background(), KubeConnection{Kubeconfig: kubeconfig}, identity)
+	require.NoError(t, err)
+	defer cleanup()
+
+	token, err := ioutil.ReadFile(conn.TokenFile)
+	require.NoError(t, err)
+	assert.Equal(t, "deployer-token", string(token))
+
+	require.NotEmpty(t, conn.generatedKubeconfig)
+	assert.Equal(t, []string{"--kubeconfig", conn.generatedKubeconfig}, conn.helmArgs())
+	generated, err := ioutil.ReadFile(conn.generatedKubeconfig)
+	require.NoError(t, err)
+	assert.Contains(t, string(generated), "tokenFile: "+conn.TokenFile)
+	assert.Contains(t, string(generated), "as: jane")
+	assert.NotContains(t, string(generated), "admin-token")
+}
+
+func TestMixin_InstallConnection(t *testing.T) {
+	ctx := context.Background()
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, "helm3 upgrade --install mysql bitnami/mysql --namespace mydb --kubeconfig /root/.kube/staging.yaml --kube-context staging --atomic --create-namespace")
+
+	action := InstallAction{Steps: []InstallStep{
+		{
+			InstallArguments: InstallArguments{
+				Step:           Step{Description: "Install MySQL"},
+				KubeConnection: KubeConnection{Kubeconfig: "/root/.kube/staging.yaml", KubeContext: "staging"},
+				Name:           "mysql",
+				Chart:          "bitnami/mysql",
+				Namespace:      "mydb",
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+	factory := &testKubernetesFactory{client: h.KubeClient, dynamicClient: h.DynamicClient}
+	h.ClientFactory = factory
+
+	err = h.Install(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []kubernetes.Connection{{Kubeconfig: "/root/.kube/staging.yaml", Context: "staging"}}, factory.connections,
+		"the outputs are read from the cluster of the step")
+}
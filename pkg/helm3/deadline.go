@@ -0,0 +1,70 @@
+package helm3
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// deadline parses the deadline of the step, zero when the step has none
+func (s Step) deadline() (time.Duration, error) {
+	if s.Deadline == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s.Deadline)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid deadline %q, must be a positive duration such as 15m", s.Deadline)
+	}
+	return d, nil
+}
+
+// deadlineExceededError is the error of a step that did not complete before its deadline
+type deadlineExceededError struct {
+	Deadline string
+	Err      error
+}
+
+func (e *deadlineExceededError) Error() string {
+	return fmt.Sprintf("deadline of %s exceeded: %s", e.Deadline, e.Err)
+}
+
+func (e *deadlineExceededError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches context.DeadlineExceeded, even when the step failed with another error once its context was done
+func (e *deadlineExceededError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+// runWithDeadline calls run with a context done at the deadline of the step, which stops the helm commands,
+// the kubectl commands and the requests to the API server of the step. It fails with a deadlineExceededError
+// when the step fails after its deadline.
+func runWithDeadline(ctx context.Context, step Step, run func(ctx context.Context) error) error {
+	deadline, err := step.deadline()
+	if err != nil {
+		return err
+	}
+	if deadline == 0 {
+		return run(ctx)
+	}
+
+	stepCtx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	err = run(stepCtx)
+	// Report the deadline of the step only when it is the one that expired, and not the one of the whole action
+	if err != nil && stepCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return &deadlineExceededError{Deadline: step.Deadline, Err: err}
+	}
+	return err
+}
+
+// validateStepDeadlines checks the deadline of every step before any of them runs
+func validateStepDeadlines(steps []actionStep) error {
+	for i, step := range steps {
+		if _, err := step.deadline(); err != nil {
+			return fmt.Errorf("step %d (%s): %s", i+1, step.Description, err)
+		}
+	}
+	return nil
+}
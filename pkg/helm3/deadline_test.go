@@ -0,0 +1,198 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestStep_Deadline(t *testing.T) {
+	testcases := []struct {
+		deadline  string
+		want      time.Duration
+		wantError string
+	}{
+		{deadline: "", want: 0},
+		{deadline: "15m", want: 15 * time.Minute},
+		{deadline: "1h30m", want: 90 * time.Minute},
+		{deadline: "soon", wantError: `invalid deadline "soon", must be a positive duration such as 15m`},
+		{deadline: "0s", wantError: `invalid deadline "0s"`},
+		{deadline: "-1m", wantError: `invalid deadline "-1m"`},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.deadline, func(t *testing.T) {
+			d, err := Step{Deadline: tc.deadline}.deadline()
+			if tc.wantError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.wantError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, d)
+		})
+	}
+}
+
+func TestRunWithDeadline(t *testing.T) {
+	waitDone := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	t.Run("no deadline", func(t *testing.T) {
+		err := runWithDeadline(context.Background(), Step{}, func(ctx context.Context) error {
+			_, ok := ctx.Deadline()
+			assert.False(t, ok)
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("completes in time", func(t *testing.T) {
+		err := runWithDeadline(context.Background(), Step{Deadline: "1m"}, func(ctx context.Context) error {
+			_, ok := ctx.Deadline()
+			assert.True(t, ok)
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("expires", func(t *testing.T) {
+		err := runWithDeadline(context.Background(), Step{Deadline: "50ms"}, waitDone)
+
+		var exceeded *deadlineExceededError
+		require.True(t, errors.As(err, &exceeded), "unexpected error %v", err)
+		assert.EqualError(t, err, "deadline of 50ms exceeded: context deadline exceeded")
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := runWithDeadline(ctx, Step{Deadline: "1m"}, waitDone)
+
+		var exceeded *deadlineExceededError
+		assert.False(t, errors.As(err, &exceeded), "the step did not reach its deadline")
+		assert.Equal(t, context.Canceled, err)
+	})
+}
+
+func TestMixin_UpgradeDeadline(t *testing.T) {
+	helm, _ := fakeHelm(t, `echo "Release mysql has been cancelled" >&2; exit 1`)
+
+	action := UpgradeAction{Steps: []UpgradeStep{
+		{
+			UpgradeArguments: UpgradeArguments{
+				Step:      Step{Description: "Upgrade MySQL", Deadline: "200ms"},
+				Name:      "mysql",
+				Chart:     "bitnami/mysql",
+				Namespace: "mydb",
+				Timeout:   "5m",
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+	h.NewCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, helm, args...)
+	}
+	addRelease(t, h.KubeClient, "mydb", "mysql", 1, "deployed")
+
+	err = h.Upgrade(context.Background())
+	require.Error(t, err)
+	var exceeded *deadlineExceededError
+	require.True(t, errors.As(err, &exceeded), "unexpected error %v", err)
+	var interrupted *interruptedError
+	require.True(t, errors.As(err, &interrupted), "helm is stopped at the deadline")
+	assert.Contains(t, err.Error(), "deadline of 200ms exceeded")
+
+	stderr := h.TestContext.GetError()
+	assert.Contains(t, stderr, "Release mysql has been cancelled\n", "helm is asked to stop instead of being killed")
+	assert.Contains(t, stderr, "The operation on release mydb/mysql was interrupted, the release is now: revision 1, deployed\n")
+}
+
+func TestMixin_InstallInvalidDeadline(t *testing.T) {
+	action := InstallAction{Steps: []InstallStep{
+		{
+			InstallArguments: InstallArguments{
+				Step:  Step{Description: "Install MySQL", Deadline: "soon"},
+				Name:  "mysql",
+				Chart: "bitnami/mysql",
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+
+	err = h.Install(context.Background())
+	require.Error(t, err)
+	assert.EqualError(t, err, `step 1 (Install MySQL): invalid deadline "soon", must be a positive duration such as 15m`)
+}
+
+func TestMixin_InstallDeadlineExpired(t *testing.T) {
+	step := InstallStep{
+		InstallArguments: InstallArguments{
+			Step:      Step{Description: "Install MySQL", Deadline: "1m"},
+			Name:      "mysql",
+			Chart:     "bitnami/mysql",
+			Namespace: "mydb",
+		},
+	}
+
+	h := NewTestMixin(t)
+	started := false
+	h.NewCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		started = true
+		return exec.CommandContext(ctx, "sh", "-c", "exit 0")
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	err := h.install(ctx, step, h.Out, h.Err)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error %v", err)
+	assert.EqualError(t, err, "helm3 upgrade was not started: context deadline exceeded")
+	assert.False(t, started, "helm is not started once the deadline is over")
+	assert.Empty(t, h.ClientFactory.(*testKubernetesFactory).connections, "the cluster is not reached once the deadline is over")
+}
+
+func TestMixin_KubernetesClientDeadline(t *testing.T) {
+	h := NewTestMixin(t)
+	factory := h.ClientFactory.(*testKubernetesFactory)
+
+	t.Run("no deadline", func(t *testing.T) {
+		_, err := h.getKubernetesClient(context.Background(), clusterConnection{})
+		require.NoError(t, err)
+		assert.Zero(t, factory.connections[len(factory.connections)-1].Timeout)
+	})
+
+	t.Run("bounded by the deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		_, err := h.getKubernetesClient(ctx, clusterConnection{})
+		require.NoError(t, err)
+		timeout := factory.connections[len(factory.connections)-1].Timeout
+		assert.Greater(t, timeout, time.Duration(0))
+		assert.LessOrEqual(t, timeout, time.Minute, "the discovery requests end by the deadline")
+	})
+
+	t.Run("deadline over", func(t *testing.T) {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+		_, err := h.getDynamicClient(ctx, clusterConnection{})
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+}
@@ -0,0 +1,116 @@
+package helm3
+
+import (
+	"fmt"
+	"strings"
+)
+
+// actionStep describes a step of an action payload and the releases it manages
+type actionStep struct {
+	Step
+	// Releases managed by the step, referenced by the DependsOn of other steps
+	Releases []string
+	// DependsOn lists the releases that must be deployed before the releases of this step
+	DependsOn []string
+}
+
+// label identifies the step in error messages
+func (s actionStep) label() string {
+	if len(s.Releases) > 0 {
+		return strings.Join(s.Releases, ",")
+	}
+	return s.Description
+}
+
+// resolveDependencies sorts the steps so that every release is deployed after the releases it depends on.
+// When reverse is set, as for uninstall, a release is removed before the releases it depends on.
+// Steps without a dependency between them keep the order in which they were declared.
+// Dependencies on releases that are not part of the payload are ignored, they are managed by other steps of the bundle.
+//
+// It returns the order in which to run the steps and, for each step, the steps it has to wait for.
+func resolveDependencies(steps []actionStep, reverse bool) ([]int, [][]int, error) {
+	owners := make(map[string][]int)
+	for i, step := range steps {
+		for _, release := range step.Releases {
+			owners[release] = append(owners[release], i)
+		}
+	}
+
+	waitFor := make([][]int, len(steps))
+	for i, step := range steps {
+		for _, dependency := range step.DependsOn {
+			for _, j := range owners[dependency] {
+				if j == i {
+					return nil, nil, fmt.Errorf("dependency cycle detected: %s depends on itself", step.label())
+				}
+				if reverse {
+					waitFor[j] = append(waitFor[j], i)
+				} else {
+					waitFor[i] = append(waitFor[i], j)
+				}
+			}
+		}
+	}
+
+	order := make([]int, 0, len(steps))
+	sorted := make([]bool, len(steps))
+	for len(order) < len(steps) {
+		next := -1
+		for i := range steps {
+			if !sorted[i] && allSorted(waitFor[i], sorted) {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			return nil, nil, fmt.Errorf("dependency cycle detected: %s", describeCycle(steps, waitFor, sorted))
+		}
+		sorted[next] = true
+		order = append(order, next)
+	}
+
+	return order, waitFor, nil
+}
+
+func allSorted(indices []int, sorted []bool) bool {
+	for _, i := range indices {
+		if !sorted[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// describeCycle follows the unsorted steps until one is visited twice and prints the loop
+func describeCycle(steps []actionStep, waitFor [][]int, sorted []bool) string {
+	current := -1
+	for i := range steps {
+		if !sorted[i] {
+			current = i
+			break
+		}
+	}
+
+	visited := make(map[int]int)
+	var path []int
+	for {
+		if start, ok := visited[current]; ok {
+			path = append(path[start:], current)
+			break
+		}
+		visited[current] = len(path)
+		path = append(path, current)
+		for _, j := range waitFor[current] {
+			if !sorted[j] {
+				current = j
+				break
+			}
+		}
+	}
+
+	labels := make([]string, len(path))
+	for i, step := range path {
+		labels[i] = steps[step].label()
+	}
+	return strings.Join(labels, " -> ")
+}
@@ -0,0 +1,173 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func releaseStep(name string, dependsOn ...string) actionStep {
+	return actionStep{
+		Step:      Step{Description: "Deploy " + name},
+		Releases:  []string{name},
+		DependsOn: dependsOn,
+	}
+}
+
+func TestResolveDependencies(t *testing.T) {
+	t.Run("keeps the declared order without dependencies", func(t *testing.T) {
+		steps := []actionStep{releaseStep("a"), releaseStep("b"), releaseStep("c")}
+
+		order, _, err := resolveDependencies(steps, false)
+		require.NoError(t, err)
+		assert.Equal(t, []int{0, 1, 2}, order)
+
+		order, _, err = resolveDependencies(steps, true)
+		require.NoError(t, err)
+		assert.Equal(t, []int{0, 1, 2}, order)
+	})
+
+	t.Run("installs dependencies first", func(t *testing.T) {
+		steps := []actionStep{
+			releaseStep("app", "operator"),
+			releaseStep("operator", "crds"),
+			releaseStep("crds"),
+			releaseStep("monitoring"),
+		}
+
+		order, waitFor, err := resolveDependencies(steps, false)
+		require.NoError(t, err)
+		assert.Equal(t, []int{2, 1, 0, 3}, order)
+		assert.Equal(t, [][]int{{1}, {2}, nil, nil}, waitFor)
+	})
+
+	t.Run("uninstalls dependencies last", func(t *testing.T) {
+		steps := []actionStep{
+			releaseStep("crds"),
+			releaseStep("operator", "crds"),
+			releaseStep("app", "operator"),
+			releaseStep("monitoring"),
+		}
+
+		order, waitFor, err := resolveDependencies(steps, true)
+		require.NoError(t, err)
+		assert.Equal(t, []int{2, 1, 0, 3}, order)
+		assert.Equal(t, [][]int{{1}, {2}, nil, nil}, waitFor)
+	})
+
+	t.Run("ignores releases outside of the payload", func(t *testing.T) {
+		steps := []actionStep{releaseStep("app", "database")}
+
+		order, _, err := resolveDependencies(steps, false)
+		require.NoError(t, err)
+		assert.Equal(t, []int{0}, order)
+	})
+
+	t.Run("steps with several releases", func(t *testing.T) {
+		steps := []actionStep{
+			{Step: Step{Description: "Uninstall apps"}, Releases: []string{"app1", "app2"}, DependsOn: []string{"operator"}},
+			releaseStep("operator"),
+		}
+
+		order, _, err := resolveDependencies(steps, true)
+		require.NoError(t, err)
+		assert.Equal(t, []int{0, 1}, order)
+	})
+
+	t.Run("rejects cycles", func(t *testing.T) {
+		steps := []actionStep{
+			releaseStep("crds"),
+			releaseStep("a", "c"),
+			releaseStep("b", "a"),
+			releaseStep("c", "b"),
+		}
+
+		_, _, err := resolveDependencies(steps, false)
+		require.EqualError(t, err, "dependency cycle detected: a -> c -> b -> a")
+
+		_, _, err = resolveDependencies(steps, true)
+		require.EqualError(t, err, "dependency cycle detected: a -> b -> c -> a")
+	})
+
+	t.Run("rejects a release depending on itself", func(t *testing.T) {
+		steps := []actionStep{releaseStep("a", "a")}
+
+		_, _, err := resolveDependencies(steps, false)
+		require.EqualError(t, err, "dependency cycle detected: a depends on itself")
+	})
+}
+
+func TestMixin_RunStepsWithDependencies(t *testing.T) {
+	ctx := context.Background()
+	steps := []actionStep{
+		releaseStep("app", "operator"),
+		releaseStep("operator", "crds"),
+		releaseStep("crds"),
+	}
+
+	for _, parallel := range []int{1, 3} {
+		m := NewTestMixin(t)
+		m.MaxParallelSteps = parallel
+
+		var mu sync.Mutex
+		var ran []string
+		err := m.runSteps(ctx, "install", steps, false, func(ctx context.Context, i int, out io.Writer, errOut io.Writer) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, steps[i].Releases[0])
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"crds", "operator", "app"}, ran, "parallel steps: %d", parallel)
+	}
+
+	t.Run("cycles fail before any step runs", func(t *testing.T) {
+		m := NewTestMixin(t)
+
+		cycle := []actionStep{releaseStep("a", "b"), releaseStep("b", "a")}
+		err := m.runSteps(ctx, "install", cycle, false, func(ctx context.Context, i int, out io.Writer, errOut io.Writer) error {
+			t.Fatal("no step should run")
+			return nil
+		})
+		require.EqualError(t, err, "dependency cycle detected: a -> b -> a")
+	})
+}
+
+func TestMixin_UnmarshalDependsOn(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/install-input-depends-on.yaml")
+	require.NoError(t, err)
+
+	var action InstallAction
+	err = yaml.Unmarshal(b, &action)
+	require.NoError(t, err)
+	require.Len(t, action.Steps, 3)
+
+	assert.Empty(t, action.Steps[0].DependsOn)
+	assert.Equal(t, []string{"crds"}, action.Steps[1].DependsOn)
+	assert.Equal(t, []string{"operator"}, action.Steps[2].DependsOn)
+}
+
+func TestMixin_InstallDependencyCycle(t *testing.T) {
+	ctx := context.Background()
+
+	action := InstallAction{Steps: []InstallStep{
+		{InstallArguments: InstallArguments{Step: Step{Description: "Install a"}, Name: "a", Chart: "a", DependsOn: []string{"b"}}},
+		{InstallArguments: InstallArguments{Step: Step{Description: "Install b"}, Name: "b", Chart: "b", DependsOn: []string{"a"}}},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+
+	err = h.Install(ctx)
+	require.EqualError(t, err, "dependency cycle detected: a -> b -> a")
+	assert.Empty(t, h.TestContext.GetOutput(), "no helm command should have been run")
+}
@@ -0,0 +1,197 @@
+package helm3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// deployment holds the arguments shared by the install and upgrade steps, both deploy their release with helm upgrade --install
+type deployment struct {
+	Step
+	KubeConnection
+	Identity
+
+	Namespace       string
+	Name            string
+	Chart           string
+	Version         string
+	Set             map[string]string
+	Timeout         string
+	Debug           bool
+	Atomic          *bool
+	CreateNamespace *bool
+	PostRenderer    *PostRenderer
+	Preflight       *Preflight
+	KubeVersion     string
+	Diagnostics     *Diagnostics
+	Retry           *Retry
+	RecoverPending  string
+
+	CommonLabels      map[string]string
+	CommonAnnotations map[string]string
+
+	Clusters    []ClusterTarget
+	Parallelism int
+}
+
+// deploy runs helm upgrade --install for the release, with the flags of the step placed after its version
+func (m *Mixin) deploy(ctx context.Context, release deployment, flags []string, out io.Writer, errOut io.Writer) error {
+	if len(release.Clusters) > 0 {
+		return deployToClusters(release.Name, release.Clusters, release.Parallelism, out, errOut, func(cluster ClusterTarget, out io.Writer, errOut io.Writer) error {
+			clusterRelease := release
+			clusterRelease.Clusters = nil
+			clusterRelease.KubeConnection = cluster.connection(release.KubeConnection)
+			clusterRelease.Namespace = cluster.namespace(release.Namespace)
+			clusterRelease.Outputs = cluster.outputs(release.Outputs)
+			return m.deploy(ctx, clusterRelease, flags, out, errOut)
+		})
+	}
+
+	// Neither connect to the cluster nor run helm once the step is interrupted or its deadline is over
+	if err := commandNotStarted(ctx, "helm3 upgrade"); err != nil {
+		return err
+	}
+
+	retry, err := release.Retry.policy()
+	if err != nil {
+		return err
+	}
+	if err := validateRecoverPending(release.RecoverPending); err != nil {
+		return err
+	}
+
+	conn, disconnect, err := m.connect(ctx, release.KubeConnection, release.Identity)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+
+	kubeClient, err := m.getKubernetesClient(ctx, conn)
+	if err != nil {
+		return errors.Wrap(err, "couldn't get kubernetes client")
+	}
+
+	if err := checkKubeVersion(kubeClient, release.Name, release.KubeVersion); err != nil {
+		return err
+	}
+
+	if err := m.runPreflight(ctx, conn, kubeClient, release.Namespace, release.Preflight, out); err != nil {
+		return err
+	}
+
+	cmd := m.NewCommand(withoutCancel(ctx), "helm3", "upgrade", "--install", release.Name, release.Chart)
+
+	if release.Namespace != "" {
+		cmd.Args = append(cmd.Args, "--namespace", release.Namespace)
+	}
+
+	cmd.Args = append(cmd.Args, conn.helmArgs()...)
+
+	if release.Version != "" {
+		cmd.Args = append(cmd.Args, "--version", release.Version)
+	}
+
+	cmd.Args = append(cmd.Args, flags...)
+
+	postRendererArgs, cleanup, err := m.postRendererArgs(release.PostRenderer, release.CommonLabels, release.CommonAnnotations)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cmd.Args = append(cmd.Args, postRendererArgs...)
+
+	if release.Timeout != "" {
+		cmd.Args = append(cmd.Args, "--timeout", release.Timeout)
+	}
+
+	if release.Debug {
+		cmd.Args = append(cmd.Args, "--debug")
+	}
+
+	if release.Atomic == nil || *release.Atomic {
+		// This will ensure a failed install is deleted, and a failed upgrade rolls back its changes.
+		cmd.Args = append(cmd.Args, "--atomic")
+	}
+
+	if release.CreateNamespace == nil || *release.CreateNamespace {
+		// This will ensure the creation of the release namespace if not present.
+		cmd.Args = append(cmd.Args, "--create-namespace")
+	}
+
+	// Set values
+	cmd.Args = append(cmd.Args, setArgs(release.Set)...)
+
+	// Read the release before recovering it, so that the summary reports its pending revision
+	before := m.readReleaseState(ctx, kubeClient, release.Namespace, release.Name)
+	if err := m.recoverPending(ctx, conn, kubeClient, release.RecoverPending, release.Name, release.Namespace, out, errOut); err != nil {
+		return err
+	}
+
+	cmd.Stdout = processOutput(out, "helm3")
+	cmd.Stderr = processOutput(errOut, "helm3")
+
+	// format the command with all arguments
+	prettyCmd := fmt.Sprintf("%s %s", cmd.Path, strings.Join(redactArgs(cmd.Args), " "))
+	fmt.Fprintln(out, prettyCmd)
+
+	summary := stepSummaryFrom(ctx)
+	summary.addCommand(cmd.Args)
+
+	// Here where really the command get executed
+	started := time.Now()
+	// With watch, collect the logs of the failing pods while helm waits for them, as atomic deletes them once helm fails
+	watcher := newFailureWatcher(kubeClient, release.Name, release.Namespace, release.Diagnostics)
+	watcher.start(ctx, cmd.Args)
+	err = m.runCommand(ctx, cmd, retry, errOut, func(cmd *exec.Cmd) error {
+		if err := commandNotStarted(ctx, "helm3 upgrade"); err != nil {
+			return err
+		}
+		span := startProcessSpan(ctx, "helm3 upgrade", releaseAttributes(release.Name, release.Chart, release.Version, release.Namespace)...)
+		err := cmd.Start()
+		// Exit on error
+		if err != nil {
+			endProcessSpan(span, err)
+			return fmt.Errorf("could not execute command, %s: %s", prettyCmd, err)
+		}
+		err = m.waitProcess(ctx, cmd)
+		endProcessSpan(span, err)
+		return err
+	})
+	watcher.stop(errOut)
+	// Read the release even once ctx is done, to report its state after an interruption
+	after := m.readReleaseState(withoutCancel(ctx), kubeClient, release.Namespace, release.Name)
+	summary.addRelease(release.Name, release.Namespace, before, after)
+	// Exit on error
+	var interrupted *interruptedError
+	if errors.As(err, &interrupted) {
+		reportInterruption(release.Name, release.Namespace, after, errOut)
+		return err
+	}
+	if err != nil {
+		m.diagnoseFailure(ctx, watcher, started, errOut)
+		return err
+	}
+	return m.handleOutputs(ctx, conn, kubeClient, release.Namespace, release.Outputs, errOut)
+}
+
+// setArgs sets the values of the chart, sorted by key
+func setArgs(set map[string]string) []string {
+	setKeys := make([]string, 0, len(set))
+	for k := range set {
+		setKeys = append(setKeys, k)
+	}
+	sort.Strings(setKeys)
+
+	args := make([]string, 0, 2*len(setKeys))
+	for _, k := range setKeys {
+		args = append(args, "--set", fmt.Sprintf("%s=%s", k, set[k]))
+	}
+	return args
+}
@@ -0,0 +1,305 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// defaultDiagnosticsLogLines is the number of log lines collected from each container of a failing pod
+const defaultDiagnosticsLogLines = 50
+
+// Diagnostics configures what is collected from the namespace of a release when an install or upgrade fails
+type Diagnostics struct {
+	// Enabled collects the diagnostics of a failed step, defaults to true
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// LogLines is the number of log lines collected from each container of a failing pod
+	LogLines int `yaml:"logLines,omitempty"`
+	// Output is the name of the output the diagnostics are also written to
+	Output string `yaml:"output,omitempty"`
+	// Watch collects the logs of the failing pods while helm waits for the release, so that they are reported
+	// even once atomic deleted the pods. It requires the permission to list the pods and read their logs while helm runs.
+	Watch bool `yaml:"watch,omitempty"`
+}
+
+// podStartupReasons are the reasons of waiting containers that are still starting normally
+var podStartupReasons = map[string]bool{
+	"":                  true,
+	"ContainerCreating": true,
+	"PodInitializing":   true,
+}
+
+// diagnosticsPollInterval is the time between two collections of the logs of the failing pods of a release while helm waits for it
+var diagnosticsPollInterval = 5 * time.Second
+
+// failureWatcher collects the last log lines of the failing containers of a release once helm failed, and with watch,
+// while helm waits for the release, because with atomic, helm deletes the pods of a failed release before it exits.
+// The pods of the release are those labeled with app.kubernetes.io/instance set to its name.
+type failureWatcher struct {
+	kubeClient  k8s.Interface
+	release     string
+	namespace   string
+	logLines    int
+	output      string
+	watch       bool
+	interrupted chan struct{}
+	done        chan struct{}
+
+	mu         sync.Mutex
+	containers map[string]failingContainer
+	listErr    error
+}
+
+// failingContainer is a failing container of a release and its last log lines
+type failingContainer struct {
+	pod       string
+	container string
+	reason    string
+	logs      []string
+	logsErr   error
+}
+
+// newFailureWatcher returns the watcher of the failing pods of a release, nil when the diagnostics are disabled
+func newFailureWatcher(kubeClient k8s.Interface, release string, namespace string, diagnostics *Diagnostics) *failureWatcher {
+	if diagnostics == nil {
+		diagnostics = &Diagnostics{}
+	}
+	if diagnostics.Enabled != nil && !*diagnostics.Enabled {
+		return nil
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	logLines := diagnostics.LogLines
+	if logLines <= 0 {
+		logLines = defaultDiagnosticsLogLines
+	}
+	return &failureWatcher{
+		kubeClient: kubeClient,
+		release:    release,
+		namespace:  namespace,
+		logLines:   logLines,
+		output:     diagnostics.Output,
+		watch:      diagnostics.Watch,
+		containers: make(map[string]failingContainer),
+	}
+}
+
+// start collects the logs of the failing pods of the release until stop is called or ctx is done, when the watch is enabled
+// and the helm command run with helmArgs waits for the release. The watch ends at the first error listing the pods.
+func (w *failureWatcher) start(ctx context.Context, helmArgs []string) {
+	if w == nil || !w.watch || !(containsString(helmArgs, "--wait") || containsString(helmArgs, "--atomic")) {
+		return
+	}
+	w.interrupted = make(chan struct{})
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(diagnosticsPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.collect(ctx)
+				w.mu.Lock()
+				err := w.listErr
+				w.mu.Unlock()
+				if err != nil {
+					return
+				}
+			case <-w.interrupted:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stop waits for the collection started by start to end, and reports to errOut why it ended early, such as missing permissions
+func (w *failureWatcher) stop(errOut io.Writer) {
+	if w == nil || w.done == nil {
+		return
+	}
+	close(w.interrupted)
+	<-w.done
+	w.done = nil
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.listErr != nil {
+		fmt.Fprintf(errOut, "Stopped watching the pods of release %s, could not list the pods: %s\n", w.release, w.listErr)
+	}
+}
+
+// collect records the last log lines of the failing containers of the release.
+// The logs of a container are kept when they can no longer be read, such as once its pod is deleted.
+func (w *failureWatcher) collect(ctx context.Context) {
+	pods, err := w.kubeClient.CoreV1().Pods(w.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{instanceLabel: w.release}.String(),
+	})
+	w.mu.Lock()
+	w.listErr = err
+	w.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	for _, pod := range pods.Items {
+		for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+			reason, failing := containerFailure(pod, status)
+			if !failing {
+				continue
+			}
+			logs, err := containerLogs(ctx, w.kubeClient, pod, status, w.logLines)
+
+			key := pod.Name + "/" + status.Name
+			w.mu.Lock()
+			previous, seen := w.containers[key]
+			if err != nil && seen && previous.logsErr == nil {
+				logs, err = previous.logs, nil
+			}
+			w.containers[key] = failingContainer{pod: pod.Name, container: status.Name, reason: reason, logs: logs, logsErr: err}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// diagnoseFailure prints the events of the namespace of a release since the step started, and the last
+// log lines of its failing pods, such as pods in CrashLoopBackOff or ImagePullBackOff, collected by the watcher
+// while helm was running and once more after it failed.
+// The diagnostics are best effort, and never replace the error of helm.
+func (m *Mixin) diagnoseFailure(ctx context.Context, w *failureWatcher, since time.Time, errOut io.Writer) {
+	if w == nil {
+		return
+	}
+	w.stop(errOut)
+	w.collect(ctx)
+
+	report := &bytes.Buffer{}
+	fmt.Fprintf(report, "Diagnostics of release %s in namespace %s:\n", w.release, w.namespace)
+
+	fmt.Fprintln(report, "Events:")
+	events, err := recentEvents(ctx, w.kubeClient, w.namespace, since)
+	if err != nil {
+		fmt.Fprintf(report, "  could not list the events: %s\n", err)
+	} else if len(events) == 0 {
+		fmt.Fprintln(report, "  none")
+	}
+	for _, event := range events {
+		fmt.Fprintf(report, "  %s %s %s %s/%s: %s\n", eventTime(event).UTC().Format(time.RFC3339), event.Type, event.Reason,
+			strings.ToLower(event.InvolvedObject.Kind), event.InvolvedObject.Name, strings.TrimSpace(event.Message))
+	}
+
+	w.mu.Lock()
+	if w.listErr != nil {
+		fmt.Fprintf(report, "  could not list the pods: %s\n", w.listErr)
+	}
+	keys := make([]string, 0, len(w.containers))
+	for key := range w.containers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		container := w.containers[key]
+		fmt.Fprintf(report, "Pod %s, container %s (%s), last %d log lines:\n", container.pod, container.container, container.reason, w.logLines)
+		if container.logsErr != nil {
+			fmt.Fprintf(report, "  could not read the logs: %s\n", container.logsErr)
+			continue
+		}
+		for _, line := range container.logs {
+			fmt.Fprintf(report, "  %s\n", line)
+		}
+	}
+	w.mu.Unlock()
+
+	fmt.Fprint(errOut, report.String())
+	if w.output != "" {
+		if err := m.writeOutput(ctx, w.output, report.Bytes()); err != nil {
+			fmt.Fprintf(errOut, "unable to write output '%s': %s\n", w.output, err)
+		}
+	}
+}
+
+// recentEvents lists the events of a namespace that occurred since a time, oldest first
+func recentEvents(ctx context.Context, kubeClient k8s.Interface, namespace string, since time.Time) ([]corev1.Event, error) {
+	events, err := kubeClient.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// The timestamps of events only have a precision of a second
+	since = since.Truncate(time.Second)
+	var recent []corev1.Event
+	for _, event := range events.Items {
+		if !eventTime(event).Before(since) {
+			recent = append(recent, event)
+		}
+	}
+	sort.SliceStable(recent, func(i, j int) bool {
+		return eventTime(recent[i]).Before(eventTime(recent[j]))
+	})
+	return recent, nil
+}
+
+// eventTime is the last time an event occurred, recorded in different fields by the events and core APIs
+func eventTime(event corev1.Event) time.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
+
+// containerFailure returns why a container of a pod is failing
+func containerFailure(pod corev1.Pod, status corev1.ContainerStatus) (string, bool) {
+	if waiting := status.State.Waiting; waiting != nil && !podStartupReasons[waiting.Reason] {
+		return waiting.Reason, true
+	}
+	if terminated := status.State.Terminated; terminated != nil && terminated.ExitCode != 0 {
+		return fmt.Sprintf("exit code %d", terminated.ExitCode), true
+	}
+	if pod.Status.Phase == corev1.PodFailed {
+		return string(corev1.PodFailed), true
+	}
+	return "", false
+}
+
+// containerLogs returns the last log lines of a container, or of its previous instance when it is waiting to restart
+func containerLogs(ctx context.Context, kubeClient k8s.Interface, pod corev1.Pod, status corev1.ContainerStatus, lines int) ([]string, error) {
+	tailLines := int64(lines)
+	opts := &corev1.PodLogOptions{
+		Container: status.Name,
+		TailLines: &tailLines,
+		Previous:  status.State.Waiting != nil && status.RestartCount > 0,
+	}
+	stream, err := kubeClient.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, opts).Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	b, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read the logs of container %s of pod %s", status.Name, pod.Name)
+	}
+	logs := strings.TrimRight(string(b), "\n")
+	if logs == "" {
+		return nil, nil
+	}
+	return strings.Split(logs, "\n"), nil
+}
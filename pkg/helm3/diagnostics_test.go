@@ -0,0 +1,277 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"get.porter.sh/porter/pkg/portercontext"
+	"get.porter.sh/porter/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// setupFailingPods adds to namespace mydb a pod of release mysql in CrashLoopBackOff, a pod of the release that cannot pull
+// its image, a running pod of the release, a failing pod of another release, and their events
+func setupFailingPods(t *testing.T, m *TestMixin, now time.Time) {
+	release := map[string]string{"app.kubernetes.io/instance": "mysql"}
+	objects := []runtime.Object{
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "mysql-0", Namespace: "mydb", Labels: release},
+			Status: corev1.PodStatus{
+				Phase: corev1.PodRunning,
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:         "mysql",
+					RestartCount: 3,
+					State:        corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+				}},
+			},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "exporter-6b9c", Namespace: "mydb", Labels: release},
+			Status: corev1.PodStatus{
+				Phase: corev1.PodPending,
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "exporter", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}}},
+					{Name: "proxy", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}}},
+				},
+			},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "backup-7f8d", Namespace: "mydb", Labels: release},
+			Status: corev1.PodStatus{
+				Phase:             corev1.PodRunning,
+				ContainerStatuses: []corev1.ContainerStatus{{Name: "backup", Ready: true, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}},
+			},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "redis-0", Namespace: "mydb", Labels: map[string]string{"app.kubernetes.io/instance": "redis"}},
+			Status: corev1.PodStatus{
+				Phase: corev1.PodRunning,
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:  "redis",
+					State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+				}},
+			},
+		},
+		&corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "mysql-0.2", Namespace: "mydb"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "mysql-0"},
+			Type:           corev1.EventTypeWarning,
+			Reason:         "BackOff",
+			Message:        "Back-off restarting failed container\n",
+			LastTimestamp:  metav1.NewTime(now.Add(2 * time.Second)),
+		},
+		&corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "exporter-6b9c.1", Namespace: "mydb"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "exporter-6b9c"},
+			Type:           corev1.EventTypeWarning,
+			Reason:         "Failed",
+			Message:        `Failed to pull image "exporter:v9": not found`,
+			EventTime:      metav1.NewMicroTime(now.Add(time.Second)),
+		},
+		&corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "mysql-0.1", Namespace: "mydb"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "mysql-0"},
+			Type:           corev1.EventTypeNormal,
+			Reason:         "Scheduled",
+			Message:        "Successfully assigned mydb/mysql-0 to node-1",
+			LastTimestamp:  metav1.NewTime(now.Add(-time.Hour)),
+		},
+	}
+	for _, object := range objects {
+		require.NoError(t, m.KubeClient.Tracker().Add(object))
+	}
+}
+
+func TestMixin_DiagnoseFailure(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	t.Run("events and logs of failing pods", func(t *testing.T) {
+		m := NewTestMixin(t)
+		setupFailingPods(t, m, now)
+
+		errOut := &bytes.Buffer{}
+		w := newFailureWatcher(m.KubeClient, "mysql", "mydb", &Diagnostics{LogLines: 20, Output: "diagnostics"})
+		m.diagnoseFailure(ctx, w, now.Add(500*time.Millisecond), errOut)
+
+		// The fake client returns "fake logs" for any container
+		want := `Diagnostics of release mysql in namespace mydb:
+Events:
+  2023-03-01T10:00:01Z Warning Failed pod/exporter-6b9c: Failed to pull image "exporter:v9": not found
+  2023-03-01T10:00:02Z Warning BackOff pod/mysql-0: Back-off restarting failed container
+Pod exporter-6b9c, container exporter (ImagePullBackOff), last 20 log lines:
+  fake logs
+Pod mysql-0, container mysql (CrashLoopBackOff), last 20 log lines:
+  fake logs
+`
+		assert.Equal(t, want, errOut.String())
+
+		b, err := m.FileSystem.ReadFile(filepath.Join(portercontext.MixinOutputsDir, "diagnostics"))
+		require.NoError(t, err)
+		assert.Equal(t, want, string(b))
+	})
+
+	t.Run("nothing to report", func(t *testing.T) {
+		m := NewTestMixin(t)
+
+		errOut := &bytes.Buffer{}
+		m.diagnoseFailure(ctx, newFailureWatcher(m.KubeClient, "mysql", "mydb", nil), now, errOut)
+		assert.Equal(t, "Diagnostics of release mysql in namespace mydb:\nEvents:\n  none\n", errOut.String())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		m := NewTestMixin(t)
+		setupFailingPods(t, m, now)
+
+		disabled := false
+		w := newFailureWatcher(m.KubeClient, "mysql", "mydb", &Diagnostics{Enabled: &disabled})
+		assert.Nil(t, w)
+		w.start(ctx, []string{"--atomic"})
+		w.stop(&bytes.Buffer{})
+
+		errOut := &bytes.Buffer{}
+		m.diagnoseFailure(ctx, w, now, errOut)
+		assert.Empty(t, errOut.String())
+	})
+
+	t.Run("logs of pods deleted once helm failed", func(t *testing.T) {
+		previous := diagnosticsPollInterval
+		diagnosticsPollInterval = 10 * time.Millisecond
+		defer func() { diagnosticsPollInterval = previous }()
+
+		m := NewTestMixin(t)
+		setupFailingPods(t, m, now)
+
+		w := newFailureWatcher(m.KubeClient, "mysql", "mydb", &Diagnostics{Watch: true})
+		w.start(ctx, []string{"upgrade", "--install", "mysql", "bitnami/mysql", "--atomic"})
+		require.Eventually(t, func() bool {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			return len(w.containers) == 2
+		}, 5*time.Second, 10*time.Millisecond, "the failing containers are collected while helm runs")
+
+		// Helm deletes the pods of the release when an atomic install fails
+		for _, pod := range []string{"mysql-0", "exporter-6b9c", "backup-7f8d"} {
+			require.NoError(t, m.KubeClient.CoreV1().Pods("mydb").Delete(ctx, pod, metav1.DeleteOptions{}))
+		}
+
+		errOut := &bytes.Buffer{}
+		m.diagnoseFailure(ctx, w, now.Add(500*time.Millisecond), errOut)
+		assert.Contains(t, errOut.String(), "Pod exporter-6b9c, container exporter (ImagePullBackOff), last 50 log lines:\n  fake logs\n")
+		assert.Contains(t, errOut.String(), "Pod mysql-0, container mysql (CrashLoopBackOff), last 50 log lines:\n  fake logs\n")
+	})
+}
+
+func TestFailureWatcher_Watch(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	previous := diagnosticsPollInterval
+	diagnosticsPollInterval = 10 * time.Millisecond
+	defer func() { diagnosticsPollInterval = previous }()
+
+	testcases := []struct {
+		name        string
+		diagnostics *Diagnostics
+		helmArgs    []string
+		wantWatch   bool
+	}{
+		{name: "not watched by default", helmArgs: []string{"--atomic"}},
+		{name: "helm does not wait", diagnostics: &Diagnostics{Watch: true}, helmArgs: []string{"upgrade", "--install"}},
+		{name: "helm waits", diagnostics: &Diagnostics{Watch: true}, helmArgs: []string{"--wait"}, wantWatch: true},
+		{name: "atomic", diagnostics: &Diagnostics{Watch: true}, helmArgs: []string{"--atomic"}, wantWatch: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewTestMixin(t)
+			setupFailingPods(t, m, now)
+			var lists int32
+			m.KubeClient.PrependReactor("list", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+				atomic.AddInt32(&lists, 1)
+				return false, nil, nil
+			})
+
+			w := newFailureWatcher(m.KubeClient, "mysql", "mydb", tc.diagnostics)
+			w.start(ctx, tc.helmArgs)
+			time.Sleep(100 * time.Millisecond)
+			w.stop(&bytes.Buffer{})
+			assert.Equal(t, tc.wantWatch, atomic.LoadInt32(&lists) > 0, "the pods are only listed while helm runs with watch and helm waiting")
+		})
+	}
+
+	t.Run("stopped by an error", func(t *testing.T) {
+		m := NewTestMixin(t)
+		var lists int32
+		m.KubeClient.PrependReactor("list", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+			atomic.AddInt32(&lists, 1)
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "", errors.New("access denied"))
+		})
+
+		w := newFailureWatcher(m.KubeClient, "mysql", "mydb", &Diagnostics{Watch: true})
+		w.start(ctx, []string{"--wait"})
+		time.Sleep(100 * time.Millisecond)
+		errOut := &bytes.Buffer{}
+		w.stop(errOut)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&lists), "the watch ends at the first error")
+		assert.Contains(t, errOut.String(), "Stopped watching the pods of release mysql, could not list the pods: pods is forbidden")
+	})
+}
+
+func TestContainerFailure(t *testing.T) {
+	running := corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodRunning}}
+	failed := corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodFailed}}
+
+	reason, failing := containerFailure(running, corev1.ContainerStatus{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 137}}})
+	assert.True(t, failing)
+	assert.Equal(t, "exit code 137", reason)
+
+	_, failing = containerFailure(running, corev1.ContainerStatus{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}}})
+	assert.False(t, failing, "a completed init container is not failing")
+
+	reason, failing = containerFailure(failed, corev1.ContainerStatus{})
+	assert.True(t, failing)
+	assert.Equal(t, "Failed", reason)
+}
+
+func TestMixin_InstallDiagnostics(t *testing.T) {
+	ctx := context.Background()
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	defer os.Unsetenv(test.ExpectedCommandErrorEnv)
+	os.Setenv(test.ExpectedCommandEnv, "helm3 upgrade --install mysql bitnami/mysql --namespace mydb --wait --atomic --create-namespace")
+	os.Setenv(test.ExpectedCommandErrorEnv, "Error: timed out waiting for the condition")
+
+	b, err := ioutil.ReadFile("testdata/install-input-diagnostics.yaml")
+	require.NoError(t, err)
+
+	var action InstallAction
+	require.NoError(t, yaml.Unmarshal(b, &action))
+	require.Len(t, action.Steps, 1)
+	assert.Equal(t, &Diagnostics{LogLines: 100, Output: "mysql-diagnostics"}, action.Steps[0].Diagnostics)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+	setupFailingPods(t, h, time.Now())
+
+	err = h.Install(ctx)
+	require.Error(t, err)
+	assert.Contains(t, h.TestContext.GetError(), "Diagnostics of release mysql in namespace mydb:\n")
+	assert.Contains(t, h.TestContext.GetError(), "Pod mysql-0, container mysql (CrashLoopBackOff), last 100 log lines:\n  fake logs\n")
+	_, err = h.FileSystem.ReadFile(filepath.Join(portercontext.MixinOutputsDir, "mysql-diagnostics"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,338 @@
+package helm3
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+)
+
+// DriftCheck compares the objects of a release with their live state, an invoke step with a drift check does not run helm
+type DriftCheck struct {
+	// Release is the name of the release, installed in the namespace of the step
+	Release string `yaml:"release"`
+	// Ignore lists the fields that are not compared, in addition to defaultDriftIgnoreRules,
+	// such as the fields changed by other controllers or webhooks
+	Ignore []DriftIgnoreRule `yaml:"ignore,omitempty"`
+	// Output is the name of the output holding the JSON report
+	Output string `yaml:"output,omitempty"`
+	// FailOnDrift fails the step when an object has drifted
+	FailOnDrift bool `yaml:"failOnDrift,omitempty"`
+}
+
+// DriftIgnoreRule ignores fields of the objects of a kind, or of a single object
+type DriftIgnoreRule struct {
+	// Kind restricts the rule to the objects of this kind
+	Kind string `yaml:"kind,omitempty"`
+	// Name restricts the rule to the objects with this name
+	Name string `yaml:"name,omitempty"`
+	// Paths are JSON pointers to the ignored fields, * matches any key or list index
+	Paths []string `yaml:"paths"`
+}
+
+// defaultDriftIgnoreRules ignore the fields that kubernetes sets on the objects of a release,
+// the fields owned by any other controller are only ignored through the Ignore rules of the check
+var defaultDriftIgnoreRules = []DriftIgnoreRule{
+	{Paths: []string{"/status"}},
+	{Kind: "Service", Paths: []string{"/spec/clusterIP", "/spec/clusterIPs", "/spec/healthCheckNodePort", "/spec/ports/*/nodePort"}},
+	{Kind: "ServiceAccount", Paths: []string{"/secrets"}},
+	{Kind: "PersistentVolumeClaim", Paths: []string{"/spec/volumeName", "/spec/storageClassName"}},
+}
+
+// driftReport is the JSON report of a drift check
+type driftReport struct {
+	Release   string        `json:"release"`
+	Namespace string        `json:"namespace"`
+	Revision  int           `json:"revision"`
+	Drifted   bool          `json:"drifted"`
+	Objects   []objectDrift `json:"objects"`
+}
+
+// objectDrift describes an object of the release that has drifted
+type objectDrift struct {
+	APIVersion string       `json:"apiVersion"`
+	Kind       string       `json:"kind"`
+	Namespace  string       `json:"namespace,omitempty"`
+	Name       string       `json:"name"`
+	Missing    bool         `json:"missing,omitempty"`
+	Fields     []fieldDrift `json:"fields,omitempty"`
+}
+
+// fieldDrift is a field whose live value differs from the value in the manifest
+type fieldDrift struct {
+	Path    string      `json:"path"`
+	Desired interface{} `json:"desired"`
+	Live    interface{} `json:"live"`
+}
+
+// redactedValue replaces the values of the data of a secret in the report
+const redactedValue = "(redacted)"
+
+func (o objectDrift) String() string {
+	if o.Namespace != "" {
+		return fmt.Sprintf("%s %s/%s", o.Kind, o.Namespace, o.Name)
+	}
+	return fmt.Sprintf("%s %s", o.Kind, o.Name)
+}
+
+// checkDrift compares each object of the manifest of the deployed revision of a release with its live state.
+// Only the fields set in the manifest are compared, so the fields defaulted by the API server are not reported.
+func (m *Mixin) checkDrift(ctx context.Context, conn clusterConnection, kubeClient k8s.Interface, namespace string, check DriftCheck, out io.Writer) error {
+	if check.Release == "" {
+		return errors.New("drift requires a release")
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	history, err := m.getReleaseHistory(ctx, kubeClient, namespace, check.Release)
+	if err != nil {
+		return errors.Wrapf(err, "could not read the history of release %s", check.Release)
+	}
+	deployed := deployedRevision(history)
+	if deployed == nil {
+		return fmt.Errorf("release %s has no deployed revision in namespace %s", check.Release, namespace)
+	}
+	release, err := m.getRelease(ctx, kubeClient, *deployed)
+	if err != nil {
+		return err
+	}
+
+	groupResources, err := restmapper.GetAPIGroupResources(kubeClient.Discovery())
+	if err != nil {
+		return errors.Wrap(err, "could not list the resources served by the cluster")
+	}
+	mapper := restmapper.NewDiscoveryRESTMapper(groupResources)
+
+	dynamicClient, err := m.getDynamicClient(ctx, conn)
+	if err != nil {
+		return errors.Wrap(err, "couldn't get kubernetes dynamic client")
+	}
+
+	docs, err := splitManifest([]byte(release.Manifest))
+	if err != nil {
+		return errors.Wrapf(err, "could not read the manifest of release %s", check.Release)
+	}
+
+	rules := append(append([]DriftIgnoreRule{}, defaultDriftIgnoreRules...), check.Ignore...)
+	report := driftReport{Release: check.Release, Namespace: namespace, Revision: deployed.Version, Objects: []objectDrift{}}
+	for _, doc := range docs {
+		var desired map[string]interface{}
+		if err := json.Unmarshal(doc, &desired); err != nil {
+			return errors.Wrapf(err, "could not read the manifest of release %s", check.Release)
+		}
+		var object resourceMeta
+		if err := json.Unmarshal(doc, &object); err != nil {
+			return errors.Wrapf(err, "could not read the manifest of release %s", check.Release)
+		}
+
+		drift := objectDrift{APIVersion: object.APIVersion, Kind: object.Kind, Name: object.Metadata.Name}
+		gvk := object.gvk()
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			if !meta.IsNoMatchError(err) {
+				return errors.Wrapf(err, "could not find the resource of %s", drift)
+			}
+			// The API of the object is not served anymore
+			drift.Missing = true
+			report.Objects = append(report.Objects, drift)
+			continue
+		}
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			drift.Namespace = object.Metadata.Namespace
+			if drift.Namespace == "" {
+				drift.Namespace = namespace
+			}
+		}
+
+		live, err := dynamicClient.Resource(mapping.Resource).Namespace(drift.Namespace).Get(ctx, drift.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			drift.Missing = true
+			report.Objects = append(report.Objects, drift)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "could not get %s", drift)
+		}
+
+		if object.Kind == "Secret" {
+			normalizeSecret(desired)
+		}
+		ignored := func(path string) bool {
+			return driftIgnored(rules, object.Kind, object.Metadata.Name, path)
+		}
+		diffValues("", desired, live.Object, ignored, &drift.Fields)
+		if object.Kind == "Secret" {
+			for i := range drift.Fields {
+				if strings.HasPrefix(drift.Fields[i].Path, "/data") {
+					drift.Fields[i].Desired, drift.Fields[i].Live = redactedValue, redactedValue
+				}
+			}
+		}
+		if len(drift.Fields) > 0 {
+			report.Objects = append(report.Objects, drift)
+		}
+	}
+	report.Drifted = len(report.Objects) > 0
+
+	if report.Drifted {
+		fmt.Fprintf(out, "Release %s has drifted from revision %d:\n", check.Release, deployed.Version)
+		for _, drift := range report.Objects {
+			if drift.Missing {
+				fmt.Fprintf(out, "  %s: missing\n", drift)
+				continue
+			}
+			paths := make([]string, len(drift.Fields))
+			for i, field := range drift.Fields {
+				paths[i] = field.Path
+			}
+			fmt.Fprintf(out, "  %s: %s\n", drift, strings.Join(paths, ", "))
+		}
+	} else {
+		fmt.Fprintf(out, "Release %s has not drifted from revision %d\n", check.Release, deployed.Version)
+	}
+
+	if check.Output != "" {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "could not write the drift report")
+		}
+		if err := m.writeOutput(ctx, check.Output, b); err != nil {
+			return errors.Wrapf(err, "unable to write output '%s'", check.Output)
+		}
+	}
+
+	if report.Drifted && check.FailOnDrift {
+		return fmt.Errorf("release %s has drifted: %d objects differ from their manifest", check.Release, len(report.Objects))
+	}
+	return nil
+}
+
+// diffValues appends to fields the values of desired that differ from live.
+// Null and empty values of desired match missing values, because the API server drops them.
+func diffValues(path string, desired interface{}, live interface{}, ignored func(string) bool, fields *[]fieldDrift) {
+	if path != "" && ignored(path) {
+		return
+	}
+
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			if len(d) > 0 || live != nil {
+				*fields = append(*fields, fieldDrift{Path: path, Desired: desired, Live: live})
+			}
+			return
+		}
+		keys := make([]string, 0, len(d))
+		for key := range d {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			diffValues(path+"/"+escapePointer(key), d[key], l[key], ignored, fields)
+		}
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			if len(d) > 0 || live != nil {
+				*fields = append(*fields, fieldDrift{Path: path, Desired: desired, Live: live})
+			}
+			return
+		}
+		for i := range d {
+			diffValues(path+"/"+strconv.Itoa(i), d[i], l[i], ignored, fields)
+		}
+	case nil:
+		return
+	default:
+		if !equalScalars(desired, live) {
+			*fields = append(*fields, fieldDrift{Path: path, Desired: desired, Live: live})
+		}
+	}
+}
+
+// equalScalars compares values decoded from JSON, where numbers may have different types,
+// and quantities such as 0.5 and 500m are written differently by the API server
+func equalScalars(desired interface{}, live interface{}) bool {
+	d, _ := json.Marshal(desired)
+	l, _ := json.Marshal(live)
+	if string(d) == string(l) {
+		return true
+	}
+	if live == nil {
+		return false
+	}
+	dq, err := resource.ParseQuantity(fmt.Sprint(desired))
+	if err != nil {
+		return false
+	}
+	lq, err := resource.ParseQuantity(fmt.Sprint(live))
+	if err != nil {
+		return false
+	}
+	return dq.Cmp(lq) == 0
+}
+
+// normalizeSecret moves the stringData of a secret to its data, the way the API server stores it
+func normalizeSecret(secret map[string]interface{}) {
+	stringData, ok := secret["stringData"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	data, ok := secret["data"].(map[string]interface{})
+	if !ok {
+		data = make(map[string]interface{})
+	}
+	for key, value := range stringData {
+		data[key] = base64.StdEncoding.EncodeToString([]byte(fmt.Sprint(value)))
+	}
+	secret["data"] = data
+	delete(secret, "stringData")
+}
+
+// driftIgnored reports whether a rule ignores the field at path, or one of its parents
+func driftIgnored(rules []DriftIgnoreRule, kind string, name string, path string) bool {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for _, rule := range rules {
+		if (rule.Kind != "" && rule.Kind != kind) || (rule.Name != "" && rule.Name != name) {
+			continue
+		}
+		for _, pattern := range rule.Paths {
+			if matchPointer(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), segments) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchPointer reports whether the segments of a pointer pattern match the first segments of a field pointer
+func matchPointer(pattern []string, segments []string) bool {
+	if len(pattern) > len(segments) {
+		return false
+	}
+	for i, segment := range pattern {
+		if segment != "*" && segment != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// escapePointer escapes a key in a JSON pointer, such as the keys of annotations holding a /
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
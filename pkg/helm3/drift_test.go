@@ -0,0 +1,301 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"get.porter.sh/porter/pkg/portercontext"
+	"get.porter.sh/porter/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+const driftManifest = `---
+# Source: mysql/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: mysql
+  annotations:
+    example.com/owner: data
+spec:
+  replicas: 1
+  template:
+    spec:
+      containers:
+      - name: mysql
+        image: mysql:8.0.31
+        resources:
+          requests:
+            cpu: 0.5
+            memory: 512Mi
+---
+# Source: mysql/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: mysql
+spec:
+  type: NodePort
+  ports:
+  - port: 3306
+---
+# Source: mysql/templates/secret.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: mysql
+stringData:
+  password: s3cr3t
+---
+# Source: mysql/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: mysql-config
+data:
+  my.cnf: ""
+`
+
+func unstructuredObject(t *testing.T, manifest string) *unstructured.Unstructured {
+	docs, err := splitManifest([]byte(manifest))
+	require.NoError(t, err)
+	require.Len(t, docs, 1)
+	obj := &unstructured.Unstructured{}
+	require.NoError(t, obj.UnmarshalJSON(docs[0]))
+	return obj
+}
+
+// setupDriftCluster stores the mysql release, whose deployment was scaled and had its image changed,
+// and whose config map was deleted
+func setupDriftCluster(t *testing.T, m *TestMixin, image string, replicas int) {
+	addReleaseRecord(t, m.KubeClient, "mydb", "mysql", 1, "superseded", "", nil)
+	addReleaseRecord(t, m.KubeClient, "mydb", "mysql", 2, "deployed", driftManifest, nil)
+
+	fakeDiscovery := m.KubeClient.Discovery().(*fakediscovery.FakeDiscovery)
+	fakeDiscovery.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "services", Kind: "Service", Namespaced: true},
+				{Name: "secrets", Kind: "Secret", Namespaced: true},
+				{Name: "configmaps", Kind: "ConfigMap", Namespaced: true},
+			},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment", Namespaced: true}},
+		},
+	}
+
+	deployment := unstructuredObject(t, `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: mysql
+  namespace: mydb
+  annotations:
+    example.com/owner: data
+    deployment.kubernetes.io/revision: "2"
+spec:
+  replicas: `+strconv.Itoa(replicas)+`
+  progressDeadlineSeconds: 600
+  template:
+    spec:
+      containers:
+      - name: mysql
+        image: `+image+`
+        imagePullPolicy: IfNotPresent
+        resources:
+          requests:
+            cpu: 500m
+            memory: 512Mi
+status:
+  replicas: 1
+`)
+	service := unstructuredObject(t, `---
+apiVersion: v1
+kind: Service
+metadata:
+  name: mysql
+  namespace: mydb
+spec:
+  type: NodePort
+  clusterIP: 10.96.0.12
+  ports:
+  - port: 3306
+    protocol: TCP
+    nodePort: 31306
+`)
+	secret := unstructuredObject(t, `---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: mysql
+  namespace: mydb
+type: Opaque
+data:
+  password: czNjcjN0
+`)
+	m.DynamicClient = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), deployment, service, secret)
+	m.ClientFactory = &testKubernetesFactory{client: m.KubeClient, dynamicClient: m.DynamicClient}
+}
+
+func TestMixin_CheckDrift(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("drifted objects", func(t *testing.T) {
+		m := NewTestMixin(t)
+		setupDriftCluster(t, m, "mysql:8.0.32", 3)
+
+		check := DriftCheck{Release: "mysql", Output: "drift"}
+		out := &bytes.Buffer{}
+		err := m.checkDrift(ctx, clusterConnection{}, m.KubeClient, "mydb", check, out)
+		require.NoError(t, err)
+		assert.Equal(t, `Release mysql has drifted from revision 2:
+  Deployment mydb/mysql: /spec/replicas, /spec/template/spec/containers/0/image
+  ConfigMap mydb/mysql-config: missing
+`, out.String())
+
+		b, err := m.FileSystem.ReadFile(filepath.Join(portercontext.MixinOutputsDir, "drift"))
+		require.NoError(t, err)
+		var report driftReport
+		require.NoError(t, json.Unmarshal(b, &report))
+		assert.True(t, report.Drifted)
+		assert.Equal(t, 2, report.Revision)
+		require.Len(t, report.Objects, 2)
+		assert.Equal(t, []fieldDrift{
+			{Path: "/spec/replicas", Desired: float64(1), Live: float64(3)},
+			{Path: "/spec/template/spec/containers/0/image", Desired: "mysql:8.0.31", Live: "mysql:8.0.32"},
+		}, report.Objects[0].Fields)
+		assert.Equal(t, objectDrift{APIVersion: "v1", Kind: "ConfigMap", Namespace: "mydb", Name: "mysql-config", Missing: true}, report.Objects[1])
+	})
+
+	t.Run("ignore rules", func(t *testing.T) {
+		m := NewTestMixin(t)
+		setupDriftCluster(t, m, "mysql:8.0.31", 3)
+
+		check := DriftCheck{
+			Release: "mysql",
+			Ignore: []DriftIgnoreRule{
+				{Kind: "Deployment", Paths: []string{"/spec/replicas"}},
+				{Kind: "ConfigMap", Name: "mysql-config", Paths: []string{"/data"}},
+			},
+		}
+		out := &bytes.Buffer{}
+		err := m.checkDrift(ctx, clusterConnection{}, m.KubeClient, "mydb", check, out)
+		require.NoError(t, err)
+		assert.Equal(t, "Release mysql has drifted from revision 2:\n  ConfigMap mydb/mysql-config: missing\n", out.String(),
+			"a missing object is reported even when all its fields are ignored")
+	})
+
+	t.Run("fail on drift", func(t *testing.T) {
+		m := NewTestMixin(t)
+		setupDriftCluster(t, m, "mysql:8.0.31", 1)
+
+		err := m.checkDrift(ctx, clusterConnection{}, m.KubeClient, "mydb", DriftCheck{Release: "mysql", FailOnDrift: true}, &bytes.Buffer{})
+		require.EqualError(t, err, "release mysql has drifted: 1 objects differ from their manifest")
+	})
+
+	t.Run("release without deployed revision", func(t *testing.T) {
+		m := NewTestMixin(t)
+		addRelease(t, m.KubeClient, "mydb", "mysql", 1, "failed")
+
+		err := m.checkDrift(ctx, clusterConnection{}, m.KubeClient, "mydb", DriftCheck{Release: "mysql"}, &bytes.Buffer{})
+		require.EqualError(t, err, "release mysql has no deployed revision in namespace mydb")
+	})
+}
+
+func TestDiffValues(t *testing.T) {
+	noRules := func(string) bool { return false }
+
+	testcases := []struct {
+		name    string
+		desired string
+		live    string
+		want    []string
+	}{
+		{name: "same values", desired: `{"a":1,"b":"x"}`, live: `{"a":1,"b":"x","c":true}`},
+		{name: "changed value", desired: `{"a":1}`, live: `{"a":2}`, want: []string{"/a"}},
+		{name: "quantities", desired: `{"cpu":0.5,"memory":"1Gi"}`, live: `{"cpu":"500m","memory":"1024Mi"}`},
+		{name: "empty values", desired: `{"labels":null,"resources":{},"args":[]}`, live: `{}`},
+		{name: "list length", desired: `{"args":["a"]}`, live: `{"args":["a","b"]}`, want: []string{"/args"}},
+		{name: "escaped keys", desired: `{"annotations":{"example.com/owner":"a"}}`, live: `{"annotations":{}}`, want: []string{"/annotations/example.com~1owner"}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var desired, live map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(tc.desired), &desired))
+			require.NoError(t, json.Unmarshal([]byte(tc.live), &live))
+
+			var fields []fieldDrift
+			diffValues("", desired, live, noRules, &fields)
+			var paths []string
+			for _, field := range fields {
+				paths = append(paths, field.Path)
+			}
+			assert.Equal(t, tc.want, paths)
+		})
+	}
+}
+
+func TestDriftIgnored(t *testing.T) {
+	rules := append(defaultDriftIgnoreRules, DriftIgnoreRule{Kind: "Deployment", Name: "mysql", Paths: []string{"/spec/template/spec/containers/*/image"}})
+
+	assert.True(t, driftIgnored(rules, "Deployment", "mysql", "/status/replicas"))
+	assert.True(t, driftIgnored(rules, "Service", "mysql", "/spec/ports/0/nodePort"))
+	assert.False(t, driftIgnored(rules, "Service", "mysql", "/spec/ports/0/port"))
+	assert.True(t, driftIgnored(rules, "Deployment", "mysql", "/spec/template/spec/containers/1/image"))
+	assert.False(t, driftIgnored(rules, "Deployment", "redis", "/spec/template/spec/containers/1/image"))
+}
+
+func TestMixin_ExecuteDrift(t *testing.T) {
+	ctx := context.Background()
+
+	// helm does not run for a drift check
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, "")
+
+	b, err := ioutil.ReadFile("testdata/execute-input-drift.yaml")
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+	setupDriftCluster(t, h, "mysql:8.0.32", 1)
+
+	err = h.Execute(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "release mysql has drifted")
+	assert.Contains(t, h.TestContext.GetOutput(), "Deployment mydb/mysql: /spec/template/spec/containers/0/image\n")
+	_, err = h.FileSystem.ReadFile(filepath.Join(portercontext.MixinOutputsDir, "mysql-drift"))
+	assert.NoError(t, err, "the report is written before the step fails")
+}
+
+func TestMixin_UnmarshalDriftStep(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/execute-input-drift.yaml")
+	require.NoError(t, err)
+
+	var action Action
+	err = yaml.Unmarshal(b, &action)
+	require.NoError(t, err)
+	require.Len(t, action.Steps, 1)
+
+	assert.Equal(t, &DriftCheck{
+		Release:     "mysql",
+		Ignore:      []DriftIgnoreRule{{Kind: "ConfigMap", Name: "mysql-config", Paths: []string{"/data"}}},
+		Output:      "mysql-drift",
+		FailOnDrift: true,
+	}, action.Steps[0].Drift)
+}
@@ -2,6 +2,8 @@ package helm3
 
 import (
 	"context"
+	"io"
+	"strings"
 
 	"get.porter.sh/porter/pkg/exec/builder"
 	"github.com/pkg/errors"
@@ -17,7 +19,10 @@ func (m *Mixin) loadAction(ctx context.Context) (*Action, error) {
 	return &action, err
 }
 
-func (m *Mixin) Execute(ctx context.Context) error {
+func (m *Mixin) Execute(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "helm3.Execute")
+	defer func() { endSpan(span, err) }()
+
 	action, err := m.loadAction(ctx)
 	if err != nil {
 		return err
@@ -27,16 +32,79 @@ func (m *Mixin) Execute(ctx context.Context) error {
 	}
 	step := action.Steps[0]
 
-	_, err = builder.ExecuteSingleStepAction(ctx, m.RuntimeConfig, action)
+	// Once the mixin is interrupted, the running command is stopped
+	ctx, stop := notifyInterruption(ctx)
+	defer stop()
+
+	out, errOut := m.stepLogWriters(action.Name, actionStep{Step: step.Step}, m.Out, m.Err)
+	started := logClock()
+	logStepStarted(out)
+	err = m.summarizeStep(ctx, action.Name, step.Step, errOut, func(ctx context.Context) error {
+		return runWithDeadline(ctx, step.Step, func(ctx context.Context) error {
+			return m.execute(ctx, action, out, errOut)
+		})
+	})
+	logStepResult(out, errOut, started, err)
+	return err
+}
+
+// execute runs the single step of an action, writing its logs to out and errOut
+func (m *Mixin) execute(ctx context.Context, action *Action, out io.Writer, errOut io.Writer) error {
+	step := action.Steps[0]
+
+	conn, disconnect, err := m.connect(ctx, step.KubeConnection, step.Identity)
 	if err != nil {
-		return errors.Wrapf(err, "invocation of action %s failed", action)
+		return err
 	}
+	defer disconnect()
 
-	kubeClient, err := m.getKubernetesClient()
+	kubeClient, err := m.getKubernetesClient(ctx, conn)
 	if err != nil {
 		return errors.Wrap(err, "couldn't get kubernetes client")
 	}
 
-	err = m.handleOutputs(ctx, kubeClient, step.Namespace, step.Outputs)
+	// A step with a drift or health check only reads the cluster
+	if step.Drift == nil && step.Health == nil {
+		// Target the cluster of the step with the flags of helm
+		action.Steps[0].Flags = append(action.Steps[0].Flags, splitFlags(conn.helmArgs())...)
+
+		cfg := m.processConfig(processOutput(out, "helm3"), processOutput(errOut, "helm3"))
+		command := "helm3"
+		if len(step.Arguments) > 0 {
+			command += " " + step.Arguments[0]
+		}
+		stepSummaryFrom(ctx).addCommand(append(append([]string{"helm3"}, step.Arguments...), action.Steps[0].Flags.ToSlice(builder.DefaultFlagDashes)...))
+		if err := commandNotStarted(ctx, command); err != nil {
+			return err
+		}
+		span := startProcessSpan(ctx, command, releaseAttributes("", "", "", step.Namespace)...)
+		_, err = builder.ExecuteSingleStepAction(ctx, cfg, action)
+		endProcessSpan(span, err)
+		flushLogs(cfg.Out, cfg.Err)
+		if err != nil {
+			return errors.Wrapf(err, "invocation of action %s failed", action.Name)
+		}
+	}
+	if step.Drift != nil {
+		if err := m.checkDrift(ctx, conn, kubeClient, step.Namespace, *step.Drift, out); err != nil {
+			return err
+		}
+	}
+	if step.Health != nil {
+		if err := m.checkHealth(ctx, kubeClient, step.Namespace, *step.Health, out); err != nil {
+			return err
+		}
+	}
+
+	err = m.handleOutputs(ctx, conn, kubeClient, step.Namespace, step.Outputs, errOut)
 	return err
 }
+
+// splitFlags converts a list of flags followed by their value to builder flags
+func splitFlags(args []string) builder.Flags {
+	var flags builder.Flags
+	for i := 0; i+1 < len(args); i += 2 {
+		flags = append(flags, builder.NewFlag(strings.TrimPrefix(args[i], "--"), args[i+1]))
+	}
+	return flags
+}
@@ -0,0 +1,301 @@
+package helm3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// HealthCheck evaluates the readiness of the objects of a release, an invoke step with a health check does not run helm
+type HealthCheck struct {
+	// Release is the name of the release, installed in the namespace of the step
+	Release string `yaml:"release"`
+	// Output is the name of the output holding the JSON report
+	Output string `yaml:"output,omitempty"`
+	// FailOnUnhealthy fails the step when an object is not ready
+	FailOnUnhealthy bool `yaml:"failOnUnhealthy,omitempty"`
+}
+
+// Status of an object of a release in a health report
+const (
+	healthReady       = "ready"
+	healthProgressing = "progressing"
+	healthFailed      = "failed"
+	healthMissing     = "missing"
+)
+
+// healthReport is the JSON report of a health check
+type healthReport struct {
+	Release   string         `json:"release"`
+	Namespace string         `json:"namespace"`
+	Revision  int            `json:"revision"`
+	Healthy   bool           `json:"healthy"`
+	Objects   []objectHealth `json:"objects"`
+}
+
+// objectHealth is the readiness of an object of the release
+type objectHealth struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason"`
+}
+
+func (o objectHealth) String() string {
+	return fmt.Sprintf("%s %s/%s", o.Kind, o.Namespace, o.Name)
+}
+
+// checkHealth evaluates the readiness of the workloads, persistent volume claims and load balancers
+// of the latest revision of a release. The other objects of the release are ready once they exist.
+func (m *Mixin) checkHealth(ctx context.Context, kubeClient k8s.Interface, namespace string, check HealthCheck, out io.Writer) error {
+	if check.Release == "" {
+		return errors.New("health requires a release")
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	history, err := m.getReleaseHistory(ctx, kubeClient, namespace, check.Release)
+	if err != nil {
+		return errors.Wrapf(err, "could not read the history of release %s", check.Release)
+	}
+	if !releaseInstalled(history) {
+		return fmt.Errorf("release %s is not installed in namespace %s", check.Release, namespace)
+	}
+	latest := history[len(history)-1]
+	release, err := m.getRelease(ctx, kubeClient, latest)
+	if err != nil {
+		return err
+	}
+
+	docs, err := splitManifest([]byte(release.Manifest))
+	if err != nil {
+		return errors.Wrapf(err, "could not read the manifest of release %s", check.Release)
+	}
+
+	report := healthReport{Release: check.Release, Namespace: namespace, Revision: latest.Version, Healthy: true, Objects: []objectHealth{}}
+	for _, doc := range docs {
+		var object resourceMeta
+		if err := json.Unmarshal(doc, &object); err != nil {
+			return errors.Wrapf(err, "could not read the manifest of release %s", check.Release)
+		}
+		health := objectHealth{Kind: object.Kind, Namespace: object.Metadata.Namespace, Name: object.Metadata.Name}
+		if health.Namespace == "" {
+			health.Namespace = namespace
+		}
+
+		health.Status, health.Reason, err = evaluateHealth(ctx, kubeClient, object.gvk().GroupKind().String(), health.Namespace, health.Name)
+		if apierrors.IsNotFound(err) {
+			health.Status, health.Reason = healthMissing, "the object does not exist"
+		} else if err != nil {
+			return errors.Wrapf(err, "could not get %s", health)
+		}
+		if health.Status == "" {
+			continue
+		}
+		report.Healthy = report.Healthy && health.Status == healthReady
+		report.Objects = append(report.Objects, health)
+	}
+
+	if report.Healthy {
+		fmt.Fprintf(out, "Release %s revision %d is healthy:\n", check.Release, latest.Version)
+	} else {
+		fmt.Fprintf(out, "Release %s revision %d is not healthy:\n", check.Release, latest.Version)
+	}
+	for _, health := range report.Objects {
+		fmt.Fprintf(out, "  %s: %s, %s\n", health, health.Status, health.Reason)
+	}
+
+	if check.Output != "" {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "could not write the health report")
+		}
+		if err := m.writeOutput(ctx, check.Output, b); err != nil {
+			return errors.Wrapf(err, "unable to write output '%s'", check.Output)
+		}
+	}
+
+	if !report.Healthy && check.FailOnUnhealthy {
+		var unhealthy int
+		for _, health := range report.Objects {
+			if health.Status != healthReady {
+				unhealthy++
+			}
+		}
+		return fmt.Errorf("release %s is not healthy: %d objects are not ready", check.Release, unhealthy)
+	}
+	return nil
+}
+
+// evaluateHealth gets an object and returns its status with the reason of this status,
+// or an empty status when the object has no readiness to evaluate
+func evaluateHealth(ctx context.Context, client k8s.Interface, groupKind string, namespace string, name string) (string, string, error) {
+	var status, reason string
+	switch groupKind {
+	case "Deployment.apps":
+		deployment, err := client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", "", err
+		}
+		status, reason = deploymentHealth(deployment)
+	case "StatefulSet.apps":
+		statefulSet, err := client.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", "", err
+		}
+		status, reason = statefulSetHealth(statefulSet)
+	case "DaemonSet.apps":
+		daemonSet, err := client.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", "", err
+		}
+		status, reason = daemonSetHealth(daemonSet)
+	case "Job.batch":
+		job, err := client.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", "", err
+		}
+		status, reason = jobHealth(job)
+	case "PersistentVolumeClaim":
+		claim, err := client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", "", err
+		}
+		status, reason = claimHealth(claim)
+	case "Service":
+		service, err := client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", "", err
+		}
+		status, reason = serviceHealth(service)
+	}
+	return status, reason, nil
+}
+
+// deploymentHealth follows the rules of kubectl rollout status
+func deploymentHealth(deployment *appsv1.Deployment) (string, string) {
+	if deployment.Generation > deployment.Status.ObservedGeneration {
+		return healthProgressing, "waiting for the controller to observe the last update"
+	}
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+			return healthFailed, condition.Message
+		}
+	}
+	if deployment.Spec.Paused {
+		return healthProgressing, "the rollout is paused"
+	}
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	switch {
+	case status.UpdatedReplicas < replicas:
+		return healthProgressing, fmt.Sprintf("%d of %d replicas updated", status.UpdatedReplicas, replicas)
+	case status.Replicas > status.UpdatedReplicas:
+		return healthProgressing, fmt.Sprintf("%d old replicas pending termination", status.Replicas-status.UpdatedReplicas)
+	case status.AvailableReplicas < status.UpdatedReplicas:
+		return healthProgressing, fmt.Sprintf("%d of %d updated replicas available", status.AvailableReplicas, status.UpdatedReplicas)
+	}
+	return healthReady, fmt.Sprintf("%d of %d replicas available", status.AvailableReplicas, replicas)
+}
+
+func statefulSetHealth(statefulSet *appsv1.StatefulSet) (string, string) {
+	if statefulSet.Generation > statefulSet.Status.ObservedGeneration {
+		return healthProgressing, "waiting for the controller to observe the last update"
+	}
+
+	replicas := int32(1)
+	if statefulSet.Spec.Replicas != nil {
+		replicas = *statefulSet.Spec.Replicas
+	}
+	status := statefulSet.Status
+	if status.ReadyReplicas < replicas {
+		return healthProgressing, fmt.Sprintf("%d of %d replicas ready", status.ReadyReplicas, replicas)
+	}
+	if statefulSet.Spec.UpdateStrategy.Type == appsv1.RollingUpdateStatefulSetStrategyType {
+		// Only the replicas above the partition are updated
+		partitioned := replicas
+		if rollingUpdate := statefulSet.Spec.UpdateStrategy.RollingUpdate; rollingUpdate != nil && rollingUpdate.Partition != nil {
+			partitioned = replicas - *rollingUpdate.Partition
+		}
+		if status.UpdatedReplicas < partitioned {
+			return healthProgressing, fmt.Sprintf("%d of %d replicas updated", status.UpdatedReplicas, partitioned)
+		}
+	}
+	return healthReady, fmt.Sprintf("%d of %d replicas ready", status.ReadyReplicas, replicas)
+}
+
+func daemonSetHealth(daemonSet *appsv1.DaemonSet) (string, string) {
+	if daemonSet.Generation > daemonSet.Status.ObservedGeneration {
+		return healthProgressing, "waiting for the controller to observe the last update"
+	}
+
+	status := daemonSet.Status
+	if daemonSet.Spec.UpdateStrategy.Type == appsv1.RollingUpdateDaemonSetStrategyType && status.UpdatedNumberScheduled < status.DesiredNumberScheduled {
+		return healthProgressing, fmt.Sprintf("%d of %d pods updated", status.UpdatedNumberScheduled, status.DesiredNumberScheduled)
+	}
+	if status.NumberAvailable < status.DesiredNumberScheduled {
+		return healthProgressing, fmt.Sprintf("%d of %d pods available", status.NumberAvailable, status.DesiredNumberScheduled)
+	}
+	return healthReady, fmt.Sprintf("%d of %d pods available", status.NumberAvailable, status.DesiredNumberScheduled)
+}
+
+func jobHealth(job *batchv1.Job) (string, string) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobFailed:
+			return healthFailed, condition.Message
+		case batchv1.JobComplete:
+			return healthReady, fmt.Sprintf("%d pods succeeded", job.Status.Succeeded)
+		}
+	}
+
+	completions := int32(1)
+	if job.Spec.Completions != nil {
+		completions = *job.Spec.Completions
+	}
+	return healthProgressing, fmt.Sprintf("%d of %d completions, %d pods active", job.Status.Succeeded, completions, job.Status.Active)
+}
+
+func claimHealth(claim *corev1.PersistentVolumeClaim) (string, string) {
+	switch claim.Status.Phase {
+	case corev1.ClaimBound:
+		return healthReady, fmt.Sprintf("bound to volume %s", claim.Spec.VolumeName)
+	case corev1.ClaimLost:
+		return healthFailed, fmt.Sprintf("volume %s was lost", claim.Spec.VolumeName)
+	}
+	return healthProgressing, "waiting for a volume"
+}
+
+// serviceHealth only evaluates load balancers, the other services are ready as soon as they are created
+func serviceHealth(service *corev1.Service) (string, string) {
+	if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return "", ""
+	}
+	ingress := service.Status.LoadBalancer.Ingress
+	if len(ingress) == 0 {
+		return healthProgressing, "waiting for the address of the load balancer"
+	}
+	address := ingress[0].IP
+	if address == "" {
+		address = ingress[0].Hostname
+	}
+	return healthReady, fmt.Sprintf("load balancer address %s", address)
+}
@@ -0,0 +1,309 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"get.porter.sh/porter/pkg/portercontext"
+	"get.porter.sh/porter/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const healthManifest = `---
+# Source: shop/templates/web.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+---
+# Source: shop/templates/worker.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: worker
+---
+# Source: shop/templates/db.yaml
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+---
+# Source: shop/templates/agent.yaml
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: agent
+---
+# Source: shop/templates/migrate.yaml
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+---
+# Source: shop/templates/uploads.yaml
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: uploads
+---
+# Source: shop/templates/web-svc.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  type: ClusterIP
+---
+# Source: shop/templates/lb.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: lb
+spec:
+  type: LoadBalancer
+---
+# Source: shop/templates/config.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+// setupHealthCluster stores the shop release, whose worker deployment was deleted,
+// whose database has a replica that is not ready and whose migration failed
+func setupHealthCluster(t *testing.T, m *TestMixin) {
+	addReleaseRecord(t, m.KubeClient, "shop", "shop", 1, "deployed", healthManifest, nil)
+
+	objects := []runtime.Object{
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "shop", Generation: 2},
+			Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(2)},
+			Status:     appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "shop"},
+			Spec:       appsv1.StatefulSetSpec{Replicas: int32Ptr(3)},
+			Status:     appsv1.StatefulSetStatus{ReadyReplicas: 2},
+		},
+		&appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "shop"},
+			Status:     appsv1.DaemonSetStatus{DesiredNumberScheduled: 3, UpdatedNumberScheduled: 3, NumberAvailable: 3},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "migrate", Namespace: "shop"},
+			Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+				{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Message: "Job has reached the specified backoff limit"},
+			}},
+		},
+		&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "uploads", Namespace: "shop"},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-1"},
+			Status:     corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimBound},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "shop"},
+			Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeClusterIP},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "lb", Namespace: "shop"},
+			Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		},
+	}
+	for _, object := range objects {
+		require.NoError(t, m.KubeClient.Tracker().Add(object))
+	}
+}
+
+func TestMixin_CheckHealth(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("report", func(t *testing.T) {
+		m := NewTestMixin(t)
+		setupHealthCluster(t, m)
+
+		out := &bytes.Buffer{}
+		err := m.checkHealth(ctx, m.KubeClient, "shop", HealthCheck{Release: "shop", Output: "health"}, out)
+		require.NoError(t, err)
+		assert.Equal(t, `Release shop revision 1 is not healthy:
+  Deployment shop/web: ready, 2 of 2 replicas available
+  Deployment shop/worker: missing, the object does not exist
+  StatefulSet shop/db: progressing, 2 of 3 replicas ready
+  DaemonSet shop/agent: ready, 3 of 3 pods available
+  Job shop/migrate: failed, Job has reached the specified backoff limit
+  PersistentVolumeClaim shop/uploads: ready, bound to volume pv-1
+  Service shop/lb: progressing, waiting for the address of the load balancer
+`, out.String())
+
+		b, err := m.FileSystem.ReadFile(filepath.Join(portercontext.MixinOutputsDir, "health"))
+		require.NoError(t, err)
+		var report healthReport
+		require.NoError(t, json.Unmarshal(b, &report))
+		assert.False(t, report.Healthy)
+		assert.Equal(t, 1, report.Revision)
+		require.Len(t, report.Objects, 7)
+		assert.Equal(t, objectHealth{Kind: "StatefulSet", Namespace: "shop", Name: "db", Status: healthProgressing, Reason: "2 of 3 replicas ready"}, report.Objects[2])
+	})
+
+	t.Run("fail when unhealthy", func(t *testing.T) {
+		m := NewTestMixin(t)
+		setupHealthCluster(t, m)
+
+		err := m.checkHealth(ctx, m.KubeClient, "shop", HealthCheck{Release: "shop", FailOnUnhealthy: true}, &bytes.Buffer{})
+		require.EqualError(t, err, "release shop is not healthy: 4 objects are not ready")
+	})
+
+	t.Run("release not installed", func(t *testing.T) {
+		m := NewTestMixin(t)
+		addRelease(t, m.KubeClient, "shop", "shop", 1, releaseStatusUninstalled)
+
+		err := m.checkHealth(ctx, m.KubeClient, "shop", HealthCheck{Release: "shop"}, &bytes.Buffer{})
+		require.EqualError(t, err, "release shop is not installed in namespace shop")
+	})
+}
+
+func TestDeploymentHealth(t *testing.T) {
+	testcases := []struct {
+		name       string
+		deployment appsv1.Deployment
+		wantStatus string
+		wantReason string
+	}{
+		{
+			name:       "generation not observed",
+			deployment: appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Generation: 3}, Status: appsv1.DeploymentStatus{ObservedGeneration: 2}},
+			wantStatus: healthProgressing, wantReason: "waiting for the controller to observe the last update",
+		},
+		{
+			name: "deadline exceeded",
+			deployment: appsv1.Deployment{Status: appsv1.DeploymentStatus{Conditions: []appsv1.DeploymentCondition{
+				{Type: appsv1.DeploymentProgressing, Reason: "ProgressDeadlineExceeded", Message: `ReplicaSet "web-7d4b9" has timed out progressing.`},
+			}}},
+			wantStatus: healthFailed, wantReason: `ReplicaSet "web-7d4b9" has timed out progressing.`,
+		},
+		{
+			name: "rolling out",
+			deployment: appsv1.Deployment{
+				Spec:   appsv1.DeploymentSpec{Replicas: int32Ptr(3)},
+				Status: appsv1.DeploymentStatus{Replicas: 4, UpdatedReplicas: 1, AvailableReplicas: 3},
+			},
+			wantStatus: healthProgressing, wantReason: "1 of 3 replicas updated",
+		},
+		{
+			name: "old replicas terminating",
+			deployment: appsv1.Deployment{
+				Spec:   appsv1.DeploymentSpec{Replicas: int32Ptr(3)},
+				Status: appsv1.DeploymentStatus{Replicas: 4, UpdatedReplicas: 3, AvailableReplicas: 3},
+			},
+			wantStatus: healthProgressing, wantReason: "1 old replicas pending termination",
+		},
+		{
+			name:       "default replicas",
+			deployment: appsv1.Deployment{Status: appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}},
+			wantStatus: healthReady, wantReason: "1 of 1 replicas available",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			status, reason := deploymentHealth(&tc.deployment)
+			assert.Equal(t, tc.wantStatus, status)
+			assert.Equal(t, tc.wantReason, reason)
+		})
+	}
+}
+
+func TestStatefulSetHealth(t *testing.T) {
+	statefulSet := &appsv1.StatefulSet{
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: int32Ptr(3),
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: int32Ptr(1)},
+			},
+		},
+		Status: appsv1.StatefulSetStatus{ReadyReplicas: 3, UpdatedReplicas: 1},
+	}
+	status, reason := statefulSetHealth(statefulSet)
+	assert.Equal(t, healthProgressing, status)
+	assert.Equal(t, "1 of 2 replicas updated", reason)
+
+	statefulSet.Status.UpdatedReplicas = 2
+	status, _ = statefulSetHealth(statefulSet)
+	assert.Equal(t, healthReady, status, "the replicas below the partition are not updated")
+}
+
+func TestJobHealth(t *testing.T) {
+	status, reason := jobHealth(&batchv1.Job{
+		Spec:   batchv1.JobSpec{Completions: int32Ptr(3)},
+		Status: batchv1.JobStatus{Succeeded: 1, Active: 2},
+	})
+	assert.Equal(t, healthProgressing, status)
+	assert.Equal(t, "1 of 3 completions, 2 pods active", reason)
+
+	status, reason = jobHealth(&batchv1.Job{Status: batchv1.JobStatus{
+		Succeeded:  1,
+		Conditions: []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}},
+	}})
+	assert.Equal(t, healthReady, status)
+	assert.Equal(t, "1 pods succeeded", reason)
+}
+
+func TestServiceHealth(t *testing.T) {
+	service := &corev1.Service{Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer}}
+	service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{Hostname: "shop.elb.example.com"}}
+	status, reason := serviceHealth(service)
+	assert.Equal(t, healthReady, status)
+	assert.Equal(t, "load balancer address shop.elb.example.com", reason)
+
+	status, _ = serviceHealth(&corev1.Service{Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeNodePort}})
+	assert.Empty(t, status, "only load balancers are evaluated")
+}
+
+func TestMixin_ExecuteHealth(t *testing.T) {
+	ctx := context.Background()
+
+	// helm does not run for a health check
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, "")
+
+	b, err := ioutil.ReadFile("testdata/execute-input-health.yaml")
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+	setupHealthCluster(t, h)
+
+	err = h.Execute(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, h.TestContext.GetOutput(), "Release shop revision 1 is not healthy:\n")
+	report, err := h.FileSystem.ReadFile(filepath.Join(portercontext.MixinOutputsDir, "shop-health"))
+	require.NoError(t, err)
+	assert.Contains(t, string(report), `"healthy": false`)
+}
+
+func TestMixin_UnmarshalHealthStep(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/execute-input-health.yaml")
+	require.NoError(t, err)
+
+	var action Action
+	err = yaml.Unmarshal(b, &action)
+	require.NoError(t, err)
+	require.Len(t, action.Steps, 1)
+
+	assert.Equal(t, &HealthCheck{Release: "shop", Output: "shop-health"}, action.Steps[0].Health)
+}
@@ -2,14 +2,17 @@ package helm3
 
 import (
 	"bufio"
+	"context"
 	"io/ioutil"
 	"strings"
+	"time"
 
 	"get.porter.sh/porter/pkg/runtime"
 	"github.com/MChorfa/porter-helm3/pkg/kubernetes"
 	"github.com/ghodss/yaml" // We are not using go-yaml because of serialization problems with jsonschema, don't use this library elsewhere
 	"github.com/pkg/errors"
 	"github.com/xeipuuv/gojsonschema"
+	"k8s.io/client-go/dynamic"
 	k8s "k8s.io/client-go/kubernetes"
 )
 
@@ -24,6 +27,12 @@ type Mixin struct {
 	HelmClientVersion      string
 	HelmClientPlatform     string
 	HelmClientArchitecture string
+	// MaxParallelSteps overrides the maxParallelSteps of the mixin configuration when set
+	MaxParallelSteps int
+	// LogFormat is the format of the logs of the steps, text or json
+	LogFormat string
+	// TerminationGracePeriod is the time helm has to stop when the mixin is interrupted, before it is killed
+	TerminationGracePeriod time.Duration
 }
 
 // New helm mixin client, initialized with useful defaults.
@@ -34,6 +43,8 @@ func New() *Mixin {
 		HelmClientVersion:      defaultClientVersion,
 		HelmClientPlatform:     defaultClientPlatform,
 		HelmClientArchitecture: defaultClientArchitecture,
+		LogFormat:              LogFormatText,
+		TerminationGracePeriod: defaultTerminationGracePeriod,
 	}
 }
 
@@ -80,6 +91,20 @@ func (m *Mixin) ValidatePayload(b []byte) error {
 	return nil
 }
 
-func (m *Mixin) getKubernetesClient() (k8s.Interface, error) {
-	return m.ClientFactory.GetClient()
+// getKubernetesClient returns a client whose requests end by the deadline of ctx,
+// as some of them, such as the discovery of the server version and of its APIs, cannot be cancelled with a context
+func (m *Mixin) getKubernetesClient(ctx context.Context, conn clusterConnection) (k8s.Interface, error) {
+	bounded, err := conn.bounded(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.ClientFactory.GetClient(bounded)
+}
+
+func (m *Mixin) getDynamicClient(ctx context.Context, conn clusterConnection) (dynamic.Interface, error) {
+	bounded, err := conn.bounded(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.ClientFactory.GetDynamicClient(bounded)
 }
@@ -1,9 +1,14 @@
 package helm3
 
 import (
+	"sync"
 	"testing"
 
 	"get.porter.sh/porter/pkg/portercontext"
+	k8sconn "github.com/MChorfa/porter-helm3/pkg/kubernetes"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes"
 	testclient "k8s.io/client-go/kubernetes/fake"
 )
@@ -12,26 +17,44 @@ const MockHelmClientVersion string = "v3.8.2"
 
 type TestMixin struct {
 	*Mixin
-	TestContext *portercontext.TestContext
+	TestContext   *portercontext.TestContext
+	KubeClient    *testclient.Clientset
+	DynamicClient *dynamicfake.FakeDynamicClient
 }
 
 type testKubernetesFactory struct {
+	client        *testclient.Clientset
+	dynamicClient *dynamicfake.FakeDynamicClient
+
+	mu          sync.Mutex
+	connections []k8sconn.Connection
+}
+
+func (t *testKubernetesFactory) GetClient(conn k8sconn.Connection) (kubernetes.Interface, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.connections = append(t.connections, conn)
+	return t.client, nil
 }
 
-func (t *testKubernetesFactory) GetClient() (kubernetes.Interface, error) {
-	return testclient.NewSimpleClientset(), nil
+func (t *testKubernetesFactory) GetDynamicClient(conn k8sconn.Connection) (dynamic.Interface, error) {
+	return t.dynamicClient, nil
 }
 
-// NewTestMixin initializes a mixin test client, with the output buffered, and an in-memory file system.
+// NewTestMixin initializes a mixin test client, with the output buffered, an in-memory file system and a fake kubernetes cluster.
 func NewTestMixin(t *testing.T) *TestMixin {
 	c := portercontext.NewTestContext(t)
 	m := New()
 	m.Context = c.Context
-	m.ClientFactory = &testKubernetesFactory{}
+	kubeClient := testclient.NewSimpleClientset()
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	m.ClientFactory = &testKubernetesFactory{client: kubeClient, dynamicClient: dynamicClient}
 	m.HelmClientVersion = MockHelmClientVersion
 
 	return &TestMixin{
-		Mixin:       m,
-		TestContext: c,
+		Mixin:         m,
+		TestContext:   c,
+		KubeClient:    kubeClient,
+		DynamicClient: dynamicClient,
 	}
 }
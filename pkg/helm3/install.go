@@ -2,12 +2,9 @@ package helm3
 
 import (
 	"context"
-	"fmt"
+	"io"
 	"os/exec"
-	"sort"
-	"strings"
 
-	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
 
@@ -20,18 +17,18 @@ type InstallStep struct {
 }
 
 type InstallArguments struct {
-	Step `yaml:",inline"`
+	Step                `yaml:",inline"`
+	RepositoryArguments `yaml:",inline"`
+	KubeConnection      `yaml:",inline"`
+	Identity            `yaml:",inline"`
 
 	Namespace       string            `yaml:"namespace"`
 	Name            string            `yaml:"name"`
 	Chart           string            `yaml:"chart"`
 	Devel           bool              `yaml:"devel"`
 	NoHooks         bool              `yaml:"noHooks"`
-	Repo            string            `yaml:"repo"`
 	Set             map[string]string `yaml:"set"`
 	SkipCrds        bool              `yaml:"skipCrds"`
-	Password        string            `yaml:"password"`
-	Username        string            `yaml:"username"`
 	Values          []string          `yaml:"values"`
 	Version         string            `yaml:"version"`
 	Wait            bool              `yaml:"wait"`
@@ -39,121 +36,105 @@ type InstallArguments struct {
 	Debug           bool              `yaml:"debug"`
 	Atomic          *bool             `yaml:"atomic,omitempty"`
 	CreateNamespace *bool             `yaml:"createNamespace,omitempty"`
+	DependsOn       []string          `yaml:"dependsOn,omitempty"`
+	PostRenderer    *PostRenderer     `yaml:"postRenderer,omitempty"`
+	Preflight       *Preflight        `yaml:"preflight,omitempty"`
+	KubeVersion     string            `yaml:"kubeVersion,omitempty"`
+	Diagnostics     *Diagnostics      `yaml:"diagnostics,omitempty"`
+	Retry           *Retry            `yaml:"retry,omitempty"`
+	RecoverPending  string            `yaml:"recoverPending,omitempty"`
+
+	CommonLabels      map[string]string `yaml:"commonLabels,omitempty"`
+	CommonAnnotations map[string]string `yaml:"commonAnnotations,omitempty"`
+
+	// Clusters deploys the release to each of these clusters, instead of the cluster of the step
+	Clusters []ClusterTarget `yaml:"clusters,omitempty"`
+	// Parallelism is the maximum number of clusters deployed at the same time, defaults to one at a time
+	Parallelism int `yaml:"parallelism,omitempty"`
 }
 
-func (m *Mixin) Install(ctx context.Context) error {
+func (m *Mixin) Install(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "helm3.Install")
+	defer func() { endSpan(span, err) }()
 
 	payload, err := m.getPayloadData()
 	if err != nil {
 		return err
 	}
 
-	kubeClient, err := m.getKubernetesClient()
-	if err != nil {
-		return errors.Wrap(err, "couldn't get kubernetes client")
-	}
-
 	var action InstallAction
 	err = yaml.Unmarshal(payload, &action)
 	if err != nil {
 		return err
 	}
-	if len(action.Steps) != 1 {
-		return errors.Errorf("expected a single step, but got %d", len(action.Steps))
-	}
-	step := action.Steps[0]
 
-	cmd := m.NewCommand(ctx, "helm3")
-
-	cmd.Args = append(cmd.Args, "upgrade", "--install", step.Name, step.Chart)
-
-	if step.Namespace != "" {
-		cmd.Args = append(cmd.Args, "--namespace", step.Namespace)
+	steps := make([]actionStep, len(action.Steps))
+	for i, step := range action.Steps {
+		steps[i] = actionStep{Step: step.Step, Releases: []string{step.Name}, DependsOn: step.DependsOn}
 	}
+	return m.runSteps(ctx, "install", steps, false, func(ctx context.Context, i int, out io.Writer, errOut io.Writer) error {
+		return m.install(ctx, action.Steps[i], out, errOut)
+	})
+}
 
-	if step.Version != "" {
-		cmd.Args = append(cmd.Args, "--version", step.Version)
-	}
+// install runs a single install step
+func (m *Mixin) install(ctx context.Context, step InstallStep, out io.Writer, errOut io.Writer) error {
+	var flags []string
 
 	if step.Wait {
-		cmd.Args = append(cmd.Args, "--wait")
+		flags = append(flags, "--wait")
 	}
 
 	if step.Devel {
-		cmd.Args = append(cmd.Args, "--devel")
+		flags = append(flags, "--devel")
 	}
 
 	for _, v := range step.Values {
-		cmd.Args = append(cmd.Args, "--values", v)
+		flags = append(flags, "--values", v)
 	}
 
 	if step.SkipCrds {
-		cmd.Args = append(cmd.Args, "--skip-crds")
+		flags = append(flags, "--skip-crds")
 	}
 
 	if step.NoHooks {
-		cmd.Args = append(cmd.Args, "--no-hooks")
-	}
-
-	if step.Repo != "" && step.Username != "" && step.Password != "" {
-		cmd.Args = append(cmd.Args, "--repo", step.Repo, "--username", step.Username, "--password", step.Password)
-	}
-
-	if step.Timeout != "" {
-		cmd.Args = append(cmd.Args, "--timeout", step.Timeout)
-	}
-
-	if step.Debug {
-		cmd.Args = append(cmd.Args, "--debug")
+		flags = append(flags, "--no-hooks")
 	}
 
-	if step.Atomic == nil || *step.Atomic {
-		// This will ensure the installation process deletes the installation on failure.
-		cmd.Args = append(cmd.Args, "--atomic")
-	}
-
-	if step.CreateNamespace == nil || *step.CreateNamespace {
-		// This will ensure the creation of the release namespace if not present.
-		cmd.Args = append(cmd.Args, "--create-namespace")
-	}
-
-	// Set values
-	cmd.Args = HandleSettingChartValuesForInstall(step, cmd)
+	flags = append(flags, step.repositoryArgs()...)
 
-	cmd.Stdout = m.Out
-	cmd.Stderr = m.Err
-
-	// format the command with all arguments
-	prettyCmd := fmt.Sprintf("%s %s", cmd.Path, strings.Join(cmd.Args, " "))
-	fmt.Fprintln(m.Out, prettyCmd)
+	return m.deploy(ctx, step.deployment(), flags, out, errOut)
+}
 
-	// Here where really the command get executed
-	err = cmd.Start()
-	// Exit on error
-	if err != nil {
-		return fmt.Errorf("could not execute command, %s: %s", prettyCmd, err)
+// deployment is the release deployed by the install step
+func (step InstallStep) deployment() deployment {
+	return deployment{
+		Step:              step.Step,
+		KubeConnection:    step.KubeConnection,
+		Identity:          step.Identity,
+		Namespace:         step.Namespace,
+		Name:              step.Name,
+		Chart:             step.Chart,
+		Version:           step.Version,
+		Set:               step.Set,
+		Timeout:           step.Timeout,
+		Debug:             step.Debug,
+		Atomic:            step.Atomic,
+		CreateNamespace:   step.CreateNamespace,
+		PostRenderer:      step.PostRenderer,
+		Preflight:         step.Preflight,
+		KubeVersion:       step.KubeVersion,
+		Diagnostics:       step.Diagnostics,
+		Retry:             step.Retry,
+		RecoverPending:    step.RecoverPending,
+		CommonLabels:      step.CommonLabels,
+		CommonAnnotations: step.CommonAnnotations,
+		Clusters:          step.Clusters,
+		Parallelism:       step.Parallelism,
 	}
-	err = cmd.Wait()
-	// Exit on error
-	if err != nil {
-		return err
-	}
-	err = m.handleOutputs(ctx, kubeClient, step.Namespace, step.Outputs)
-	return err
 }
 
 // Prepare set arguments
 func HandleSettingChartValuesForInstall(step InstallStep, cmd *exec.Cmd) []string {
-	// sort the set consistently
-	setKeys := make([]string, 0, len(step.Set))
-	for k := range step.Set {
-
-		setKeys = append(setKeys, k)
-	}
-	sort.Strings(setKeys)
-
-	for _, k := range setKeys {
-		cmd.Args = append(cmd.Args, "--set", fmt.Sprintf("%s=%s", k, step.Set[k]))
-	}
-	return cmd.Args
+	return append(cmd.Args, setArgs(step.Set)...)
 }
@@ -98,6 +98,27 @@ func TestMixin_UnmarshalInstallCreateNamespaceExplicitTrue(t *testing.T) {
 	assert.True(t, *step.CreateNamespace)
 }
 
+func TestMixin_UnmarshalInstallRepository(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/install-input-repo-tls.yaml")
+	require.NoError(t, err)
+
+	var action InstallAction
+	err = yaml.Unmarshal(b, &action)
+	require.NoError(t, err)
+	require.Len(t, action.Steps, 1)
+	step := action.Steps[0]
+
+	assert.Equal(t, RepositoryArguments{
+		Repo:            "https://charts.example.com",
+		Username:        "myuser",
+		Password:        "mypass",
+		CaFile:          "/cnab/app/certs/ca.crt",
+		CertFile:        "/cnab/app/certs/client.crt",
+		KeyFile:         "/cnab/app/certs/client.key",
+		PassCredentials: true,
+	}, step.RepositoryArguments)
+}
+
 func TestMixin_Install(t *testing.T) {
 	namespace := "MY-NAMESPACE"
 	name := "MYRELEASE"
@@ -241,6 +262,49 @@ func TestMixin_Install(t *testing.T) {
 				},
 			},
 		},
+		{
+			expectedCommand: fmt.Sprintf(`%s %s %s %s %s`, baseInstall, baseValues, `--repo https://charts.example.com`, baseAddFlags, baseSetArgs),
+			installStep: InstallStep{
+				InstallArguments: InstallArguments{
+					Step:      Step{Description: "Install Foo"},
+					Namespace: namespace,
+					Name:      name,
+					Chart:     chart,
+					Version:   version,
+					Set:       setArgs,
+					Values:    values,
+					RepositoryArguments: RepositoryArguments{
+						Repo: "https://charts.example.com",
+					},
+				},
+			},
+		},
+		{
+			expectedCommand: fmt.Sprintf(`%s %s %s %s %s`, baseInstall, baseValues,
+				`--repo https://charts.example.com --username myuser --password mypass --ca-file ca.crt --cert-file client.crt --key-file client.key --insecure-skip-tls-verify --pass-credentials`,
+				baseAddFlags, baseSetArgs),
+			installStep: InstallStep{
+				InstallArguments: InstallArguments{
+					Step:      Step{Description: "Install Foo"},
+					Namespace: namespace,
+					Name:      name,
+					Chart:     chart,
+					Version:   version,
+					Set:       setArgs,
+					Values:    values,
+					RepositoryArguments: RepositoryArguments{
+						Repo:                  "https://charts.example.com",
+						Username:              "myuser",
+						Password:              "mypass",
+						CaFile:                "ca.crt",
+						CertFile:              "client.crt",
+						KeyFile:               "client.key",
+						InsecureSkipTLSVerify: true,
+						PassCredentials:       true,
+					},
+				},
+			},
+		},
 	}
 
 	defer os.Unsetenv(test.ExpectedCommandEnv)
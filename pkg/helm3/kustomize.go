@@ -0,0 +1,237 @@
+package helm3
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+// KustomizeOverlay is a subset of a kustomization, applied by the mixin to the manifests rendered by helm
+type KustomizeOverlay struct {
+	Labels  map[string]string `yaml:"labels,omitempty"`
+	Patches []KustomizePatch  `yaml:"patches,omitempty"`
+}
+
+// KustomizePatch is either a strategic merge patch or a list of JSON 6902 operations
+type KustomizePatch struct {
+	Patch  string       `yaml:"patch"`
+	Target *PatchTarget `yaml:"target,omitempty"`
+}
+
+// PatchTarget selects the resources a patch applies to, empty fields match any resource
+type PatchTarget struct {
+	Group         string `yaml:"group,omitempty"`
+	Version       string `yaml:"version,omitempty"`
+	Kind          string `yaml:"kind,omitempty"`
+	Name          string `yaml:"name,omitempty"`
+	Namespace     string `yaml:"namespace,omitempty"`
+	LabelSelector string `yaml:"labelSelector,omitempty"`
+}
+
+// resourceMeta holds the fields used to select the resources of a manifest
+type resourceMeta struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"metadata"`
+}
+
+func (r resourceMeta) gvk() schema.GroupVersionKind {
+	return schema.FromAPIVersionAndKind(r.APIVersion, r.Kind)
+}
+
+// renderKustomize applies the overlay to each resource of a multi-document YAML manifest
+func renderKustomize(manifest []byte, overlay KustomizeOverlay) ([]byte, error) {
+	return transformManifest(manifest, func(doc []byte) ([]byte, error) {
+		var err error
+		for _, patch := range overlay.Patches {
+			doc, err = applyPatch(doc, patch)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return addMetadata(doc, "labels", overlay.Labels)
+	})
+}
+
+// transformManifest applies transform to each resource of a multi-document YAML manifest
+func transformManifest(manifest []byte, transform func(doc []byte) ([]byte, error)) ([]byte, error) {
+	docs, err := splitManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &bytes.Buffer{}
+	for i, doc := range docs {
+		doc, err = transform(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := yaml.JSONToYAML(doc)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not convert the rendered resource to yaml")
+		}
+		if i > 0 {
+			out.WriteString("---\n")
+		}
+		out.Write(b)
+	}
+	return out.Bytes(), nil
+}
+
+// splitManifest converts each non-empty document of a YAML stream to JSON
+func splitManifest(manifest []byte) ([][]byte, error) {
+	var docs [][]byte
+	for _, doc := range strings.Split("\n"+string(manifest), "\n---") {
+		// Keep only what follows the separator line, such as "--- # Source: chart/templates/x.yaml"
+		if i := strings.Index(doc, "\n"); i >= 0 {
+			doc = doc[i+1:]
+		} else {
+			continue
+		}
+
+		j, err := yaml.YAMLToJSON([]byte(doc))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse the rendered manifest")
+		}
+		if string(j) == "null" {
+			continue
+		}
+		docs = append(docs, j)
+	}
+	return docs, nil
+}
+
+// addMetadata merges values into the labels or annotations of a resource
+func addMetadata(doc []byte, field string, values map[string]string) ([]byte, error) {
+	return addMetadataAt(doc, nil, field, values)
+}
+
+// addMetadataAt merges values into the labels or annotations of the object found at path in the resource
+func addMetadataAt(doc []byte, path []string, field string, values map[string]string) ([]byte, error) {
+	if len(values) == 0 {
+		return doc, nil
+	}
+	var patch interface{} = map[string]interface{}{
+		"metadata": map[string]interface{}{field: values},
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		patch = map[string]interface{}{path[i]: patch}
+	}
+	b, err := json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+	doc, err = jsonpatch.MergePatch(doc, b)
+	return doc, errors.Wrapf(err, "could not add %s", field)
+}
+
+// applyPatch applies a single patch to a resource if the resource is targeted by the patch
+func applyPatch(doc []byte, patch KustomizePatch) ([]byte, error) {
+	var meta resourceMeta
+	if err := json.Unmarshal(doc, &meta); err != nil {
+		return nil, errors.Wrap(err, "could not read the rendered resource metadata")
+	}
+
+	patchJSON, err := yaml.YAMLToJSON([]byte(patch.Patch))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse patch")
+	}
+	patchJSON = bytes.TrimSpace(patchJSON)
+	isJSON6902 := bytes.HasPrefix(patchJSON, []byte("["))
+
+	target := patch.Target
+	if target == nil {
+		if isJSON6902 {
+			return nil, errors.New("a target is required for a JSON 6902 patch")
+		}
+		// Like kustomize, a strategic merge patch without target selects the resource it names
+		var patchMeta resourceMeta
+		if err := json.Unmarshal(patchJSON, &patchMeta); err != nil {
+			return nil, errors.Wrap(err, "could not read the patch metadata")
+		}
+		if patchMeta.Kind == "" || patchMeta.Metadata.Name == "" {
+			return nil, errors.New("a patch without target must define its kind and metadata.name")
+		}
+		gvk := patchMeta.gvk()
+		target = &PatchTarget{
+			Group:     gvk.Group,
+			Version:   gvk.Version,
+			Kind:      gvk.Kind,
+			Name:      patchMeta.Metadata.Name,
+			Namespace: patchMeta.Metadata.Namespace,
+		}
+	}
+
+	ok, err := target.matches(meta)
+	if err != nil || !ok {
+		return doc, err
+	}
+
+	if isJSON6902 {
+		ops, err := jsonpatch.DecodePatch(patchJSON)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decode JSON 6902 patch")
+		}
+		doc, err = ops.Apply(doc)
+		return doc, errors.Wrapf(err, "could not patch %s %s", meta.Kind, meta.Metadata.Name)
+	}
+
+	doc, err = strategicMerge(doc, meta.gvk(), patchJSON)
+	return doc, errors.Wrapf(err, "could not patch %s %s", meta.Kind, meta.Metadata.Name)
+}
+
+// strategicMerge uses the patch strategy of the built-in kubernetes types,
+// and falls back to a JSON merge patch for the other types such as custom resources.
+func strategicMerge(doc []byte, gvk schema.GroupVersionKind, patch []byte) ([]byte, error) {
+	obj, err := scheme.Scheme.New(gvk)
+	if runtime.IsNotRegisteredError(err) {
+		return jsonpatch.MergePatch(doc, patch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strategicpatch.StrategicMergePatch(doc, patch, obj)
+}
+
+func (t PatchTarget) matches(meta resourceMeta) (bool, error) {
+	gvk := meta.gvk()
+	if t.Group != "" && t.Group != gvk.Group {
+		return false, nil
+	}
+	if t.Version != "" && t.Version != gvk.Version {
+		return false, nil
+	}
+	if t.Kind != "" && t.Kind != gvk.Kind {
+		return false, nil
+	}
+	if t.Name != "" && t.Name != meta.Metadata.Name {
+		return false, nil
+	}
+	if t.Namespace != "" && t.Namespace != meta.Metadata.Namespace {
+		return false, nil
+	}
+	if t.LabelSelector != "" {
+		selector, err := labels.Parse(t.LabelSelector)
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid label selector %q", t.LabelSelector)
+		}
+		if !selector.Matches(labels.Set(meta.Metadata.Labels)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,186 @@
+package helm3
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// renderOverlay applies the overlay to the test manifest and returns the rendered resources
+func renderOverlay(t *testing.T, overlay KustomizeOverlay) []map[string]interface{} {
+	manifest, err := ioutil.ReadFile("testdata/post-render-manifest.yaml")
+	require.NoError(t, err)
+
+	rendered, err := renderKustomize(manifest, overlay)
+	require.NoError(t, err)
+
+	docs, err := splitManifest(rendered)
+	require.NoError(t, err)
+
+	resources := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		require.NoError(t, json.Unmarshal(doc, &resources[i]))
+	}
+	return resources
+}
+
+// lookup walks the path of nested fields and list indexes of a resource
+func lookup(resource interface{}, path ...interface{}) interface{} {
+	current := resource
+	for _, p := range path {
+		switch key := p.(type) {
+		case string:
+			m, ok := current.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			current = m[key]
+		case int:
+			l, ok := current.([]interface{})
+			if !ok || key >= len(l) {
+				return nil
+			}
+			current = l[key]
+		}
+	}
+	return current
+}
+
+func TestRenderKustomize(t *testing.T) {
+	t.Run("without overlay", func(t *testing.T) {
+		resources := renderOverlay(t, KustomizeOverlay{})
+		require.Len(t, resources, 3)
+		assert.Equal(t, "Service", resources[0]["kind"])
+		assert.Equal(t, "Deployment", resources[1]["kind"])
+		assert.Equal(t, "Schedule", resources[2]["kind"])
+	})
+
+	t.Run("labels", func(t *testing.T) {
+		resources := renderOverlay(t, KustomizeOverlay{
+			Labels: map[string]string{"team": "data"},
+		})
+		require.Len(t, resources, 3)
+		for _, resource := range resources {
+			assert.Equal(t, "data", lookup(resource, "metadata", "labels", "team"), resource["kind"])
+		}
+		assert.Equal(t, "mysql", lookup(resources[0], "metadata", "labels", "app"), "existing labels are kept")
+	})
+
+	t.Run("strategic merge patch selecting the resource it names", func(t *testing.T) {
+		resources := renderOverlay(t, KustomizeOverlay{
+			Patches: []KustomizePatch{
+				{Patch: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: mysql
+spec:
+  template:
+    spec:
+      containers:
+      - name: mysql
+        image: mirror.example.com/mysql:5.7
+`},
+			},
+		})
+		deployment := resources[1]
+		assert.Equal(t, "mirror.example.com/mysql:5.7", lookup(deployment, "spec", "template", "spec", "containers", 0, "image"))
+		assert.Equal(t, "mydb", lookup(deployment, "spec", "template", "spec", "containers", 0, "env", 0, "value"),
+			"containers are merged by name")
+		assert.Equal(t, "exporter:1.0", lookup(deployment, "spec", "template", "spec", "containers", 1, "image"),
+			"the other containers are kept")
+	})
+
+	t.Run("merge patch of a custom resource", func(t *testing.T) {
+		resources := renderOverlay(t, KustomizeOverlay{
+			Patches: []KustomizePatch{
+				{
+					Target: &PatchTarget{Group: "backup.example.com", Kind: "Schedule"},
+					Patch: `
+spec:
+  retention:
+    days: 30
+`,
+				},
+			},
+		})
+		assert.Equal(t, float64(30), lookup(resources[2], "spec", "retention", "days"))
+		assert.Equal(t, "0 * * * *", lookup(resources[2], "spec", "cron"))
+	})
+
+	t.Run("JSON 6902 patch", func(t *testing.T) {
+		resources := renderOverlay(t, KustomizeOverlay{
+			Patches: []KustomizePatch{
+				{
+					Target: &PatchTarget{Version: "v1", Kind: "Service", Name: "mysql"},
+					Patch: `
+- op: replace
+  path: /spec/ports/0/port
+  value: 3307
+- op: add
+  path: /spec/type
+  value: NodePort
+`,
+				},
+			},
+		})
+		assert.Equal(t, float64(3307), lookup(resources[0], "spec", "ports", 0, "port"))
+		assert.Equal(t, "NodePort", lookup(resources[0], "spec", "type"))
+	})
+
+	t.Run("label selector", func(t *testing.T) {
+		resources := renderOverlay(t, KustomizeOverlay{
+			Patches: []KustomizePatch{
+				{
+					Target: &PatchTarget{LabelSelector: "app=mysql"},
+					Patch: `
+metadata:
+  annotations:
+    patched: "true"
+`,
+				},
+			},
+		})
+		assert.Equal(t, "true", lookup(resources[0], "metadata", "annotations", "patched"))
+		assert.Equal(t, "true", lookup(resources[1], "metadata", "annotations", "patched"))
+		assert.Nil(t, lookup(resources[2], "metadata", "annotations"), "the schedule is not labeled")
+	})
+}
+
+func TestRenderKustomize_InvalidPatches(t *testing.T) {
+	manifest, err := ioutil.ReadFile("testdata/post-render-manifest.yaml")
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name      string
+		patch     KustomizePatch
+		wantError string
+	}{
+		{
+			name:      "JSON 6902 patch without target",
+			patch:     KustomizePatch{Patch: `[{"op": "remove", "path": "/spec"}]`},
+			wantError: "a target is required for a JSON 6902 patch",
+		},
+		{
+			name:      "strategic merge patch without target nor name",
+			patch:     KustomizePatch{Patch: "spec:\n  replicas: 2\n"},
+			wantError: "a patch without target must define its kind and metadata.name",
+		},
+		{
+			name:      "invalid label selector",
+			patch:     KustomizePatch{Target: &PatchTarget{LabelSelector: "app in (mysql"}, Patch: "spec: {}"},
+			wantError: `invalid label selector "app in (mysql"`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := renderKustomize(manifest, KustomizeOverlay{Patches: []KustomizePatch{tc.patch}})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantError)
+		})
+	}
+}
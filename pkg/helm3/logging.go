@@ -0,0 +1,219 @@
+package helm3
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"get.porter.sh/porter/pkg/runtime"
+)
+
+// Formats of the logs of the install, upgrade, uninstall and invoke commands
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// mixinLogSource is the source of the records written by the mixin itself, the records of a child process have its name as source
+const mixinLogSource = "mixin"
+
+// Outcome of a step in its result record
+const (
+	stepSucceeded = "succeeded"
+	stepFailed    = "failed"
+)
+
+// logClock is the time of the log records
+var logClock = time.Now
+
+// logRecord is a line of the logs in the json format
+type logRecord struct {
+	Time    string `json:"time"`
+	Source  string `json:"source"`
+	Stream  string `json:"stream"`
+	Action  string `json:"action,omitempty"`
+	Step    string `json:"step,omitempty"`
+	Release string `json:"release,omitempty"`
+	Message string `json:"msg"`
+	// Duration of the step in seconds, set on the result record of a step
+	Duration float64 `json:"duration,omitempty"`
+	Outcome  string  `json:"outcome,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// logWriter writes each line written to it as a JSON record to dest
+type logWriter struct {
+	dest    io.Writer
+	fields  logRecord
+	partial []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(w.partial[:i])
+		w.partial = w.partial[i+1:]
+		if err := w.writeLine(line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// flush writes the last line, when it does not end with a new line
+func (w *logWriter) flush() error {
+	if len(w.partial) == 0 {
+		return nil
+	}
+	line := string(w.partial)
+	w.partial = nil
+	return w.writeLine(line)
+}
+
+func (w *logWriter) writeLine(line string) error {
+	record := w.fields
+	record.Message = strings.TrimRight(line, "\r")
+	return w.writeRecord(record)
+}
+
+func (w *logWriter) writeRecord(record logRecord) error {
+	record.Time = logClock().UTC().Format(time.RFC3339Nano)
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = w.dest.Write(append(b, '\n'))
+	return err
+}
+
+// with returns a writer of records with the same fields, updated by set, that writes to dest
+func (w *logWriter) with(dest io.Writer, set func(fields *logRecord)) *logWriter {
+	clone := &logWriter{dest: dest, fields: w.fields}
+	if set != nil {
+		set(&clone.fields)
+	}
+	return clone
+}
+
+// stepLogWriters returns the writers of the logs of a step. With the json format, each line is a record
+// identifying the action, the step and its releases, otherwise out and errOut are returned unchanged.
+func (m *Mixin) stepLogWriters(action string, step actionStep, out io.Writer, errOut io.Writer) (io.Writer, io.Writer) {
+	if m.LogFormat != LogFormatJSON {
+		return out, errOut
+	}
+	fields := logRecord{
+		Source:  mixinLogSource,
+		Stream:  "stdout",
+		Action:  action,
+		Step:    step.Description,
+		Release: strings.Join(step.Releases, ","),
+	}
+	errFields := fields
+	errFields.Stream = "stderr"
+	return &logWriter{dest: out, fields: fields}, &logWriter{dest: errOut, fields: errFields}
+}
+
+// logStepStarted writes the start of a step, with the json format
+func logStepStarted(out io.Writer) {
+	if w, ok := out.(*logWriter); ok {
+		record := w.fields
+		record.Message = "step started"
+		w.writeRecord(record)
+	}
+}
+
+// logStepResult writes the outcome and the duration of a step, with the json format
+func logStepResult(out io.Writer, errOut io.Writer, started time.Time, err error) {
+	w, ok := out.(*logWriter)
+	if !ok {
+		return
+	}
+	flushLogs(out, errOut)
+
+	record := w.fields
+	record.Duration = logClock().Sub(started).Seconds()
+	if err != nil {
+		record.Message = fmt.Sprintf("step %s", stepFailed)
+		record.Outcome = stepFailed
+		record.Error = err.Error()
+	} else {
+		record.Message = fmt.Sprintf("step %s", stepSucceeded)
+		record.Outcome = stepSucceeded
+	}
+	w.writeRecord(record)
+}
+
+// processOutput labels the output of a child process with its name, with the json format
+func processOutput(w io.Writer, process string) io.Writer {
+	if lw, ok := w.(*logWriter); ok {
+		// Write the messages of the mixin before the output of the process
+		lw.flush()
+		return lw.with(lw.dest, func(fields *logRecord) { fields.Source = process })
+	}
+	return w
+}
+
+// releaseLogs records the logs of a step about one of its releases with the name of this release, with the json format
+func releaseLogs(w io.Writer, release string) io.Writer {
+	if lw, ok := w.(*logWriter); ok {
+		return lw.with(lw.dest, func(fields *logRecord) { fields.Release = release })
+	}
+	return w
+}
+
+// bufferLogs returns a writer of the same logs as w, that writes to buf
+func bufferLogs(w io.Writer, buf *bytes.Buffer) io.Writer {
+	if lw, ok := w.(*logWriter); ok {
+		return lw.with(buf, nil)
+	}
+	return buf
+}
+
+// copyBufferedLogs copies logs written by bufferLogs to the destination of w
+func copyBufferedLogs(w io.Writer, buf *bytes.Buffer) {
+	if lw, ok := w.(*logWriter); ok {
+		w = lw.dest
+	}
+	io.Copy(w, buf)
+}
+
+// flushLogs writes the last line of the writers of records
+func flushLogs(writers ...io.Writer) {
+	for _, w := range writers {
+		if lw, ok := w.(*logWriter); ok {
+			lw.flush()
+		}
+	}
+}
+
+// processConfig is the runtime configuration of a child process run by the builder of porter, writing to out and errOut
+func (m *Mixin) processConfig(out io.Writer, errOut io.Writer) runtime.RuntimeConfig {
+	cfg := m.RuntimeConfig
+	processContext := *m.Context
+	processContext.Out = out
+	processContext.Err = errOut
+	cfg.Context = &processContext
+	return cfg
+}
+
+// WriteError writes the error that ends the mixin to w, as a JSON record with the json format
+func WriteError(w io.Writer, format string, err error) {
+	if format != LogFormatJSON {
+		fmt.Fprintf(w, "err: %s\n", err)
+		return
+	}
+	writer := &logWriter{dest: w}
+	writer.writeRecord(logRecord{
+		Source:  mixinLogSource,
+		Stream:  "stderr",
+		Message: fmt.Sprintf("mixin %s", stepFailed),
+		Outcome: stepFailed,
+		Error:   err.Error(),
+	})
+}
@@ -0,0 +1,222 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"get.porter.sh/porter/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+// parseLogRecords parses the records of logs written with the json format, without their time
+func parseLogRecords(t *testing.T, logs string) []logRecord {
+	var records []logRecord
+	for _, line := range strings.Split(strings.TrimSuffix(logs, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var record logRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &record), "invalid record %q", line)
+		assert.NotEmpty(t, record.Time)
+		record.Time = ""
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLogWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := &logWriter{dest: out, fields: logRecord{Source: mixinLogSource, Stream: "stdout", Action: "install"}}
+
+	fmt.Fprint(w, "Installing ")
+	fmt.Fprintln(w, "mysql")
+	fmt.Fprint(w, "first\r\nsecond\nlast")
+	assert.Len(t, parseLogRecords(t, out.String()), 3, "the last line is kept until it is complete")
+
+	flushLogs(w)
+	assert.Equal(t, []logRecord{
+		{Source: mixinLogSource, Stream: "stdout", Action: "install", Message: "Installing mysql"},
+		{Source: mixinLogSource, Stream: "stdout", Action: "install", Message: "first"},
+		{Source: mixinLogSource, Stream: "stdout", Action: "install", Message: "second"},
+		{Source: mixinLogSource, Stream: "stdout", Action: "install", Message: "last"},
+	}, parseLogRecords(t, out.String()))
+}
+
+func TestLogWriters_Text(t *testing.T) {
+	m := NewTestMixin(t)
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+
+	stepOut, stepErrOut := m.stepLogWriters("install", actionStep{Step: Step{Description: "Install MySQL"}}, out, errOut)
+	assert.Same(t, out, stepOut, "the text format writes the logs unchanged")
+	assert.Same(t, errOut, stepErrOut)
+	assert.Same(t, out, processOutput(stepOut, "helm3"))
+	assert.Same(t, out, releaseLogs(stepOut, "mysql"))
+}
+
+func TestMixin_InstallJSONLogs(t *testing.T) {
+	ctx := context.Background()
+
+	// Each record is a second after the previous one, the output of helm is written from other goroutines
+	defer func() { logClock = time.Now }()
+	var mu sync.Mutex
+	now := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+	logClock = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(time.Second)
+		return now
+	}
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	defer os.Unsetenv(test.ExpectedCommandOutputEnv)
+	defer os.Unsetenv(test.ExpectedCommandErrorEnv)
+	os.Setenv(test.ExpectedCommandEnv, "helm3 upgrade --install mysql bitnami/mysql --namespace mydb --atomic --create-namespace")
+	os.Setenv(test.ExpectedCommandOutputEnv, "Release \"mysql\" has been upgraded. Happy Helming!")
+
+	action := InstallAction{Steps: []InstallStep{
+		{
+			InstallArguments: InstallArguments{
+				Step:      Step{Description: "Install MySQL"},
+				Name:      "mysql",
+				Chart:     "bitnami/mysql",
+				Namespace: "mydb",
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	t.Run("succeeded", func(t *testing.T) {
+		os.Setenv(test.ExpectedCommandErrorEnv, "")
+
+		h := NewTestMixin(t)
+		h.LogFormat = LogFormatJSON
+		h.In = bytes.NewReader(b)
+
+		err := h.Install(ctx)
+		require.NoError(t, err)
+
+		records := parseLogRecords(t, h.TestContext.GetOutput())
+		require.Len(t, records, 4)
+		assert.Equal(t, logRecord{Source: mixinLogSource, Stream: "stdout", Action: "install", Step: "Install MySQL", Release: "mysql", Message: "step started"}, records[0])
+		assert.Equal(t, mixinLogSource, records[1].Source)
+		assert.True(t, strings.HasSuffix(records[1].Message, "upgrade --install mysql bitnami/mysql --namespace mydb --atomic --create-namespace"), "the command is logged by the mixin")
+		assert.Equal(t, logRecord{Source: "helm3", Stream: "stdout", Action: "install", Step: "Install MySQL", Release: "mysql", Message: `Release "mysql" has been upgraded. Happy Helming!`}, records[2])
+		assert.Equal(t, "step succeeded", records[3].Message)
+		assert.Equal(t, stepSucceeded, records[3].Outcome)
+		assert.Greater(t, records[3].Duration, 0.0)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		os.Setenv(test.ExpectedCommandErrorEnv, "Error: timed out waiting for the condition")
+
+		h := NewTestMixin(t)
+		h.LogFormat = LogFormatJSON
+		h.In = bytes.NewReader(b)
+
+		err := h.Install(ctx)
+		require.Error(t, err)
+
+		errRecords := parseLogRecords(t, h.TestContext.GetError())
+		require.NotEmpty(t, errRecords)
+		assert.Equal(t, logRecord{Source: "helm3", Stream: "stderr", Action: "install", Step: "Install MySQL", Release: "mysql", Message: "Error: timed out waiting for the condition"}, errRecords[0])
+
+		records := parseLogRecords(t, h.TestContext.GetOutput())
+		result := records[len(records)-1]
+		assert.Equal(t, stepFailed, result.Outcome)
+		assert.Equal(t, "exit status 1", result.Error)
+	})
+}
+
+func TestMixin_UninstallJSONLogs(t *testing.T) {
+	ctx := context.Background()
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, strings.Join([]string{
+		"helm3 uninstall foo --namespace mydb",
+		"helm3 uninstall bar --namespace mydb",
+	}, "\n"))
+
+	action := UninstallAction{Steps: []UninstallStep{
+		{
+			UninstallArguments: UninstallArguments{
+				Step:        Step{Description: "Uninstall Foo and Bar"},
+				Namespace:   "mydb",
+				Releases:    []string{"foo", "bar"},
+				Parallelism: 2,
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.LogFormat = LogFormatJSON
+	h.In = bytes.NewReader(b)
+	addRelease(t, h.KubeClient, "mydb", "foo", 1, "deployed")
+	addRelease(t, h.KubeClient, "mydb", "bar", 1, "deployed")
+
+	err = h.Uninstall(ctx)
+	require.NoError(t, err)
+
+	var releases []string
+	for _, record := range parseLogRecords(t, h.TestContext.GetOutput()) {
+		assert.Equal(t, "uninstall", record.Action)
+		// The helm commands
+		if strings.Contains(record.Message, " uninstall ") {
+			releases = append(releases, record.Release)
+		}
+	}
+	assert.Equal(t, []string{"foo", "bar"}, releases, "the records about a release of the step hold its name, in the order of the releases")
+}
+
+func TestMixin_InstallJSONLogsOutputError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake commands are shell scripts")
+	}
+
+	action := InstallAction{Steps: []InstallStep{
+		{
+			InstallArguments: InstallArguments{
+				Step: Step{
+					Description: "Install MySQL",
+					Outputs:     []HelmOutput{{Name: "host", ResourceType: "service", ResourceName: "mysql", JSONPath: "{.spec.clusterIP}"}},
+				},
+				Name:      "mysql",
+				Chart:     "bitnami/mysql",
+				Namespace: "mydb",
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.LogFormat = LogFormatJSON
+	h.In = bytes.NewReader(b)
+	h.NewCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		if name == "kubectl" {
+			return exec.CommandContext(ctx, "sh", "-c", `echo 'Error from server (NotFound): services "mysql" not found' >&2; exit 1`)
+		}
+		return exec.CommandContext(ctx, "sh", "-c", "exit 0")
+	}
+
+	err = h.Install(context.Background())
+	require.Error(t, err)
+
+	errRecords := parseLogRecords(t, h.TestContext.GetError())
+	require.NotEmpty(t, errRecords)
+	assert.Equal(t, logRecord{Source: "kubectl", Stream: "stderr", Action: "install", Step: "Install MySQL", Release: "mysql", Message: `Error from server (NotFound): services "mysql" not found`}, errRecords[0],
+		"the errors of kubectl are recorded with the step")
+}
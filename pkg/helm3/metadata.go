@@ -0,0 +1,87 @@
+package helm3
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Labels and annotations identifying the Porter installation that deployed a resource
+const (
+	InstallationLabel       = "porter.sh/installation"
+	BundleLabel             = "porter.sh/bundle"
+	BundleVersionAnnotation = "porter.sh/bundle-version"
+)
+
+// Environment variables set by Porter in the bundle runtime, as defined by the CNAB specification
+const (
+	installationNameEnv = "CNAB_INSTALLATION_NAME"
+	bundleNameEnv       = "CNAB_BUNDLE_NAME"
+	bundleVersionEnv    = "CNAB_BUNDLE_VERSION"
+)
+
+// podTemplatePaths locates the templates of the objects created by workloads, so that they get the common metadata too
+var podTemplatePaths = map[string][][]string{
+	"Deployment":  {{"spec", "template"}},
+	"StatefulSet": {{"spec", "template"}},
+	"DaemonSet":   {{"spec", "template"}},
+	"ReplicaSet":  {{"spec", "template"}},
+	"Job":         {{"spec", "template"}},
+	"CronJob":     {{"spec", "jobTemplate"}, {"spec", "jobTemplate", "spec", "template"}},
+}
+
+// addCommonMetadata adds the labels and annotations to every resource of the manifest and, with podTemplates,
+// to the pod templates of workloads. A change to the metadata of a pod template rolls out the workload.
+func addCommonMetadata(manifest []byte, labels map[string]string, annotations map[string]string, podTemplates bool) ([]byte, error) {
+	return transformManifest(manifest, func(doc []byte) ([]byte, error) {
+		var meta resourceMeta
+		if err := json.Unmarshal(doc, &meta); err != nil {
+			return nil, errors.Wrap(err, "could not read the rendered resource metadata")
+		}
+
+		paths := [][]string{nil}
+		if podTemplates {
+			paths = append(paths, podTemplatePaths[meta.Kind]...)
+		}
+		var err error
+		for _, path := range paths {
+			doc, err = addMetadataAt(doc, path, "labels", labels)
+			if err != nil {
+				return nil, err
+			}
+			doc, err = addMetadataAt(doc, path, "annotations", annotations)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return doc, nil
+	})
+}
+
+// porterMetadata returns the labels and annotations describing the Porter installation and bundle running the mixin.
+// Values that are not valid label values, such as long names, are only kept as annotations.
+func (m *Mixin) porterMetadata() (map[string]string, map[string]string) {
+	labels := make(map[string]string)
+	annotations := make(map[string]string)
+
+	for key, env := range map[string]string{
+		InstallationLabel: installationNameEnv,
+		BundleLabel:       bundleNameEnv,
+	} {
+		value := m.Getenv(env)
+		if value == "" {
+			continue
+		}
+		annotations[key] = value
+		if len(validation.IsValidLabelValue(value)) == 0 {
+			labels[key] = value
+		}
+	}
+
+	if version := m.Getenv(bundleVersionEnv); version != "" {
+		annotations[BundleVersionAnnotation] = version
+	}
+
+	return labels, annotations
+}
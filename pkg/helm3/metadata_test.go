@@ -0,0 +1,99 @@
+package helm3
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddCommonMetadata(t *testing.T) {
+	manifest, err := ioutil.ReadFile("testdata/post-render-manifest.yaml")
+	require.NoError(t, err)
+	manifest = append(manifest, []byte(`---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: backup
+spec:
+  schedule: "0 * * * *"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: backup
+            image: backup:1.0
+`)...)
+
+	rendered, err := addCommonMetadata(manifest,
+		map[string]string{"team": "data"},
+		map[string]string{"example.com/owner": "data-platform"}, true)
+	require.NoError(t, err)
+
+	docs, err := splitManifest(rendered)
+	require.NoError(t, err)
+	require.Len(t, docs, 4)
+	resources := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		require.NoError(t, json.Unmarshal(doc, &resources[i]))
+	}
+
+	for _, resource := range resources {
+		assert.Equal(t, "data", lookup(resource, "metadata", "labels", "team"), resource["kind"])
+		assert.Equal(t, "data-platform", lookup(resource, "metadata", "annotations", "example.com/owner"), resource["kind"])
+	}
+	assert.Equal(t, "mysql", lookup(resources[0], "metadata", "labels", "app"), "existing labels are kept")
+
+	deployment := resources[1]
+	assert.Equal(t, "data", lookup(deployment, "spec", "template", "metadata", "labels", "team"))
+	assert.Equal(t, "mysql", lookup(deployment, "spec", "template", "metadata", "labels", "app"), "existing pod labels are kept")
+	assert.Equal(t, "data-platform", lookup(deployment, "spec", "template", "metadata", "annotations", "example.com/owner"))
+
+	cronJob := resources[3]
+	assert.Equal(t, "data", lookup(cronJob, "spec", "jobTemplate", "metadata", "labels", "team"))
+	assert.Equal(t, "data", lookup(cronJob, "spec", "jobTemplate", "spec", "template", "metadata", "labels", "team"))
+
+	assert.Nil(t, lookup(resources[2], "spec", "template"), "custom resources are only labeled at the top level")
+}
+
+func TestMixin_PorterMetadata(t *testing.T) {
+	t.Run("outside of porter", func(t *testing.T) {
+		m := NewTestMixin(t)
+
+		labels, annotations := m.porterMetadata()
+		assert.Empty(t, labels)
+		assert.Empty(t, annotations)
+	})
+
+	t.Run("installation and bundle", func(t *testing.T) {
+		m := NewTestMixin(t)
+		m.Setenv("CNAB_INSTALLATION_NAME", "mysql-prod")
+		m.Setenv("CNAB_BUNDLE_NAME", "mysql")
+		m.Setenv("CNAB_BUNDLE_VERSION", "0.1.0")
+
+		labels, annotations := m.porterMetadata()
+		assert.Equal(t, map[string]string{
+			"porter.sh/installation": "mysql-prod",
+			"porter.sh/bundle":       "mysql",
+		}, labels)
+		assert.Equal(t, map[string]string{
+			"porter.sh/installation":   "mysql-prod",
+			"porter.sh/bundle":         "mysql",
+			"porter.sh/bundle-version": "0.1.0",
+		}, annotations)
+	})
+
+	t.Run("name that is not a valid label value", func(t *testing.T) {
+		m := NewTestMixin(t)
+		name := "mysql " + strings.Repeat("x", 70)
+		m.Setenv("CNAB_INSTALLATION_NAME", name)
+
+		labels, annotations := m.porterMetadata()
+		assert.Empty(t, labels)
+		assert.Equal(t, map[string]string{"porter.sh/installation": name}, annotations)
+	})
+}
@@ -0,0 +1,236 @@
+package helm3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// Values of the deleteNamespace setting of an Uninstall step
+const (
+	deleteNamespaceAlways  = "true"
+	deleteNamespaceNever   = "false"
+	deleteNamespaceIfEmpty = "ifEmpty"
+)
+
+// protectedNamespaces are never deleted by the mixin
+var protectedNamespaces = []string{"default", "kube-system", "kube-public", "kube-node-lease"}
+
+// defaultNamespaceTimeout bounds the wait for the namespace termination when the step has no valid timeout
+const defaultNamespaceTimeout = 5 * time.Minute
+
+// namespacePollInterval is the delay between two checks of the namespace termination, tests reduce it
+var namespacePollInterval = 2 * time.Second
+
+// namespaceContent counts the objects of a kind left in a namespace, ignoring the ones kubernetes creates in every namespace
+type namespaceContent struct {
+	kind  string
+	count func(ctx context.Context, client k8s.Interface, namespace string) (int, error)
+}
+
+var namespaceContents = []namespaceContent{
+	{"pods", func(ctx context.Context, client k8s.Interface, namespace string) (int, error) {
+		list, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return 0, err
+		}
+		return len(list.Items), nil
+	}},
+	{"services", func(ctx context.Context, client k8s.Interface, namespace string) (int, error) {
+		list, err := client.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return 0, err
+		}
+		return len(list.Items), nil
+	}},
+	{"persistentvolumeclaims", func(ctx context.Context, client k8s.Interface, namespace string) (int, error) {
+		list, err := client.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return 0, err
+		}
+		return len(list.Items), nil
+	}},
+	{"configmaps", func(ctx context.Context, client k8s.Interface, namespace string) (int, error) {
+		list, err := client.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return 0, err
+		}
+		count := 0
+		for _, configMap := range list.Items {
+			// Published in every namespace by the root CA configmap publisher
+			if configMap.Name != "kube-root-ca.crt" {
+				count++
+			}
+		}
+		return count, nil
+	}},
+	{"secrets", func(ctx context.Context, client k8s.Interface, namespace string) (int, error) {
+		list, err := client.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return 0, err
+		}
+		count := 0
+		for _, secret := range list.Items {
+			// Token of the default service account, created by clusters older than kubernetes 1.24
+			if secret.Type == corev1.SecretTypeServiceAccountToken && secret.Annotations[corev1.ServiceAccountNameKey] == "default" {
+				continue
+			}
+			count++
+		}
+		return count, nil
+	}},
+	{"serviceaccounts", func(ctx context.Context, client k8s.Interface, namespace string) (int, error) {
+		list, err := client.CoreV1().ServiceAccounts(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return 0, err
+		}
+		count := 0
+		for _, serviceAccount := range list.Items {
+			if serviceAccount.Name != "default" {
+				count++
+			}
+		}
+		return count, nil
+	}},
+	{"deployments", func(ctx context.Context, client k8s.Interface, namespace string) (int, error) {
+		list, err := client.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return 0, err
+		}
+		return len(list.Items), nil
+	}},
+	{"statefulsets", func(ctx context.Context, client k8s.Interface, namespace string) (int, error) {
+		list, err := client.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return 0, err
+		}
+		return len(list.Items), nil
+	}},
+	{"daemonsets", func(ctx context.Context, client k8s.Interface, namespace string) (int, error) {
+		list, err := client.AppsV1().DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return 0, err
+		}
+		return len(list.Items), nil
+	}},
+	{"jobs", func(ctx context.Context, client k8s.Interface, namespace string) (int, error) {
+		list, err := client.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return 0, err
+		}
+		return len(list.Items), nil
+	}},
+	{"cronjobs", func(ctx context.Context, client k8s.Interface, namespace string) (int, error) {
+		list, err := client.BatchV1().CronJobs(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return 0, err
+		}
+		return len(list.Items), nil
+	}},
+	{"ingresses", func(ctx context.Context, client k8s.Interface, namespace string) (int, error) {
+		list, err := client.NetworkingV1().Ingresses(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return 0, err
+		}
+		return len(list.Items), nil
+	}},
+}
+
+// validateDeleteNamespace checks the deleteNamespace setting of an Uninstall step
+func validateDeleteNamespace(policy string, namespace string) error {
+	switch policy {
+	case "", deleteNamespaceNever:
+		return nil
+	case deleteNamespaceAlways, deleteNamespaceIfEmpty:
+	default:
+		return fmt.Errorf("invalid deleteNamespace %q, must be true, false or %s", policy, deleteNamespaceIfEmpty)
+	}
+
+	if namespace == "" {
+		return errors.New("deleteNamespace requires the namespace of the step")
+	}
+	if containsString(protectedNamespaces, namespace) {
+		return fmt.Errorf("deleteNamespace cannot delete the %s namespace", namespace)
+	}
+	return nil
+}
+
+// namespaceLeftovers lists the kinds of objects left in the namespace, with their count
+func namespaceLeftovers(ctx context.Context, client k8s.Interface, namespace string) ([]string, error) {
+	var leftovers []string
+	for _, content := range namespaceContents {
+		count, err := content.count(ctx, client, namespace)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not list the %s of namespace %s", content.kind, namespace)
+		}
+		if count > 0 {
+			leftovers = append(leftovers, fmt.Sprintf("%d %s", count, content.kind))
+		}
+	}
+	return leftovers, nil
+}
+
+// deleteNamespace deletes the namespace of an Uninstall step according to its deleteNamespace policy,
+// and waits for its termination when the step waits for the uninstallation.
+func (m *Mixin) deleteNamespace(ctx context.Context, client k8s.Interface, step UninstallStep, out io.Writer) error {
+	policy, namespace := step.DeleteNamespace, step.Namespace
+	if policy == "" || policy == deleteNamespaceNever {
+		return nil
+	}
+
+	_, err := client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		fmt.Fprintf(out, "Namespace %s does not exist, skipping its deletion\n", namespace)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not get namespace %s", namespace)
+	}
+
+	if policy == deleteNamespaceIfEmpty {
+		leftovers, err := namespaceLeftovers(ctx, client, namespace)
+		if err != nil {
+			return err
+		}
+		if len(leftovers) > 0 {
+			fmt.Fprintf(out, "Namespace %s is not empty, keeping it: %s\n", namespace, strings.Join(leftovers, ", "))
+			return nil
+		}
+	}
+
+	fmt.Fprintf(out, "Deleting namespace %s\n", namespace)
+	err = client.CoreV1().Namespaces().Delete(ctx, namespace, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "could not delete namespace %s", namespace)
+	}
+
+	if !step.Wait {
+		return nil
+	}
+
+	timeout, err := time.ParseDuration(step.Timeout)
+	if err != nil {
+		timeout = defaultNamespaceTimeout
+	}
+	err = wait.PollImmediateWithContext(ctx, namespacePollInterval, timeout, func(ctx context.Context) (bool, error) {
+		_, err := client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "namespace %s was not terminated", namespace)
+	}
+	fmt.Fprintf(out, "Namespace %s deleted\n", namespace)
+	return nil
+}
@@ -0,0 +1,204 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"get.porter.sh/porter/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// defaultNamespaceObjects are created by kubernetes in every namespace
+func defaultNamespaceObjects(namespace string) []runtime.Object {
+	return []runtime.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "kube-root-ca.crt", Namespace: namespace}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: namespace}},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "default-token-x2p4k",
+				Namespace:   namespace,
+				Annotations: map[string]string{corev1.ServiceAccountNameKey: "default"},
+			},
+			Type: corev1.SecretTypeServiceAccountToken,
+		},
+	}
+}
+
+func TestMixin_UnmarshalDeleteNamespace(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/uninstall-input-delete-namespace.yaml")
+	require.NoError(t, err)
+
+	var action UninstallAction
+	err = yaml.Unmarshal(b, &action)
+	require.NoError(t, err)
+	require.Len(t, action.Steps, 2)
+
+	assert.Equal(t, "ifEmpty", action.Steps[0].DeleteNamespace)
+	assert.Equal(t, "true", action.Steps[1].DeleteNamespace)
+}
+
+func TestValidateDeleteNamespace(t *testing.T) {
+	assert.NoError(t, validateDeleteNamespace("", ""))
+	assert.NoError(t, validateDeleteNamespace("false", ""))
+	assert.NoError(t, validateDeleteNamespace("ifEmpty", "mydb"))
+	assert.EqualError(t, validateDeleteNamespace("always", "mydb"), `invalid deleteNamespace "always", must be true, false or ifEmpty`)
+	assert.EqualError(t, validateDeleteNamespace("true", ""), "deleteNamespace requires the namespace of the step")
+	assert.EqualError(t, validateDeleteNamespace("true", "kube-system"), "deleteNamespace cannot delete the kube-system namespace")
+}
+
+func TestMixin_DeleteNamespace(t *testing.T) {
+	ctx := context.Background()
+	namespacePollInterval = time.Millisecond
+	defer func() { namespacePollInterval = 2 * time.Second }()
+
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "mysql", Namespace: "mydb"}}
+
+	testcases := []struct {
+		name        string
+		policy      string
+		objects     []runtime.Object
+		wantDeleted bool
+		wantOutput  string
+	}{
+		{
+			name:        "empty namespace",
+			policy:      "ifEmpty",
+			objects:     defaultNamespaceObjects("mydb"),
+			wantDeleted: true,
+			wantOutput:  "Deleting namespace mydb\nNamespace mydb deleted\n",
+		},
+		{
+			name:       "namespace with leftovers",
+			policy:     "ifEmpty",
+			objects:    append(defaultNamespaceObjects("mydb"), deployment),
+			wantOutput: "Namespace mydb is not empty, keeping it: 1 deployments\n",
+		},
+		{
+			name:        "namespace deleted even if not empty",
+			policy:      "true",
+			objects:     append(defaultNamespaceObjects("mydb"), deployment),
+			wantDeleted: true,
+			wantOutput:  "Deleting namespace mydb\nNamespace mydb deleted\n",
+		},
+		{
+			name:       "missing namespace",
+			policy:     "true",
+			wantOutput: "Namespace mydb does not exist, skipping its deletion\n",
+		},
+		{
+			name:       "namespace kept",
+			policy:     "false",
+			objects:    defaultNamespaceObjects("mydb"),
+			wantOutput: "",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewTestMixin(t)
+			for _, obj := range tc.objects {
+				require.NoError(t, m.KubeClient.Tracker().Add(obj))
+			}
+
+			step := UninstallStep{UninstallArguments{Namespace: "mydb", DeleteNamespace: tc.policy, Wait: true, Timeout: "1s"}}
+			out := &bytes.Buffer{}
+			err := m.deleteNamespace(ctx, m.KubeClient, step, out)
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantOutput, out.String())
+
+			_, err = m.KubeClient.CoreV1().Namespaces().Get(ctx, "mydb", metav1.GetOptions{})
+			assert.Equal(t, tc.wantDeleted || len(tc.objects) == 0, apierrors.IsNotFound(err), "namespace deleted")
+		})
+	}
+
+	t.Run("namespace not terminated in time", func(t *testing.T) {
+		m := NewTestMixin(t)
+		for _, obj := range defaultNamespaceObjects("mydb") {
+			require.NoError(t, m.KubeClient.Tracker().Add(obj))
+		}
+		// Keep the namespace terminating, as a finalizer would
+		m.KubeClient.PrependReactor("delete", "namespaces", func(k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, nil
+		})
+
+		step := UninstallStep{UninstallArguments{Namespace: "mydb", DeleteNamespace: "true", Wait: true, Timeout: "10ms"}}
+		err := m.deleteNamespace(ctx, m.KubeClient, step, &bytes.Buffer{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "namespace mydb was not terminated")
+	})
+}
+
+func TestMixin_UninstallDeleteNamespace(t *testing.T) {
+	ctx := context.Background()
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	defer os.Unsetenv(test.ExpectedCommandErrorEnv)
+
+	action := UninstallAction{Steps: []UninstallStep{
+		{
+			UninstallArguments: UninstallArguments{
+				Step:            Step{Description: "Uninstall Foo"},
+				Namespace:       "mydb",
+				Releases:        []string{"foo"},
+				DeleteNamespace: "ifEmpty",
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	t.Run("after the releases are uninstalled", func(t *testing.T) {
+		os.Setenv(test.ExpectedCommandEnv, "helm3 uninstall foo --namespace mydb")
+		os.Setenv(test.ExpectedCommandErrorEnv, "")
+
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(b)
+		for _, obj := range defaultNamespaceObjects("mydb") {
+			require.NoError(t, h.KubeClient.Tracker().Add(obj))
+		}
+		addRelease(t, h.KubeClient, "mydb", "foo", 1, "deployed")
+		// The fake helm does not remove the release storage
+		h.KubeClient.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if action.(k8stesting.ListAction).GetListRestrictions().Labels.Empty() {
+				return true, &corev1.SecretList{}, nil
+			}
+			return false, nil, nil
+		})
+
+		err := h.Uninstall(ctx)
+		require.NoError(t, err)
+		assert.Contains(t, h.TestContext.GetOutput(), "Deleting namespace mydb\n")
+	})
+
+	t.Run("not when a release failed", func(t *testing.T) {
+		os.Setenv(test.ExpectedCommandEnv, "helm3 uninstall foo --namespace mydb")
+		os.Setenv(test.ExpectedCommandErrorEnv, "Error: uninstall: timed out waiting for the condition")
+
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(b)
+		for _, obj := range defaultNamespaceObjects("mydb") {
+			require.NoError(t, h.KubeClient.Tracker().Add(obj))
+		}
+		addRelease(t, h.KubeClient, "mydb", "foo", 1, "deployed")
+
+		err := h.Uninstall(ctx)
+		require.Error(t, err)
+		assert.NotContains(t, h.TestContext.GetOutput(), "Deleting namespace mydb")
+
+		_, err = h.KubeClient.CoreV1().Namespaces().Get(ctx, "mydb", metav1.GetOptions{})
+		require.NoError(t, err)
+	})
+}
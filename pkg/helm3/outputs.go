@@ -3,6 +3,7 @@ package helm3
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
@@ -31,15 +32,22 @@ func (m *Mixin) getSecret(ctx context.Context, client kubernetes.Interface, name
 	return val, nil
 }
 
-func (m *Mixin) getOutput(ctx context.Context, resourceType, resourceName, namespace, jsonPath string) ([]byte, error) {
+func (m *Mixin) getOutput(ctx context.Context, conn clusterConnection, resourceType, resourceName, namespace, jsonPath string, errOut io.Writer) ([]byte, error) {
 	args := []string{"get", resourceType, resourceName}
 	args = append(args, fmt.Sprintf("-o=jsonpath=%s", jsonPath))
 	if namespace != "" {
 		args = append(args, fmt.Sprintf("--namespace=%s", namespace))
 	}
+	args = append(args, conn.kubectlArgs()...)
+	if err := commandNotStarted(ctx, "kubectl get"); err != nil {
+		return nil, err
+	}
 	cmd := m.NewCommand(ctx, "kubectl", args...)
-	cmd.Stderr = m.Err
+	cmd.Stderr = processOutput(errOut, "kubectl")
+	span := startProcessSpan(ctx, "kubectl get", namespaceAttribute.String(namespace))
 	out, err := cmd.Output()
+	endProcessSpan(span, err)
+	flushLogs(cmd.Stderr)
 	if err != nil {
 		prettyCmd := fmt.Sprintf("%s%s", cmd.Dir, strings.Join(cmd.Args, " "))
 		return nil, errors.Wrap(err, fmt.Sprintf("couldn't run command %s", prettyCmd))
@@ -47,44 +55,66 @@ func (m *Mixin) getOutput(ctx context.Context, resourceType, resourceName, names
 	return out, nil
 }
 
-func (m *Mixin) handleOutputs(ctx context.Context, client kubernetes.Interface, namespace string, outputs []HelmOutput) error {
-	var outputError error
+// handleOutputs writes the outputs of a step, the errors of the commands reading them are written to errOut
+func (m *Mixin) handleOutputs(ctx context.Context, conn clusterConnection, client kubernetes.Interface, namespace string, outputs []HelmOutput, errOut io.Writer) error {
 	//Now get the outputs
 	for _, output := range outputs {
+		// Override namespace if output.Namespace is set
+		if output.Secret != "" && output.Key != "" && output.Namespace != "" {
+			namespace = output.Namespace
+		}
 
-		if output.Secret != "" && output.Key != "" {
-			// Override namespace if output.Namespace is set
-			if output.Namespace != "" {
-				namespace = output.Namespace
-			}
+		if err := m.handleOutput(ctx, conn, client, namespace, output, errOut); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			val, err := m.getSecret(ctx, client, namespace, output.Secret, output.Key)
+// handleOutput writes an output read from a secret or from a resource, in a span of its own
+func (m *Mixin) handleOutput(ctx context.Context, conn clusterConnection, client kubernetes.Interface, namespace string, output HelmOutput, errOut io.Writer) (err error) {
+	ctx, span := startSpan(ctx, "output "+output.Name, outputAttribute.String(output.Name))
+	defer func() { endSpan(span, err) }()
 
-			if err != nil {
-				return err
-			}
+	var outputError error
+	if output.Secret != "" && output.Key != "" {
+		span.SetAttributes(namespaceAttribute.String(namespace))
+		val, err := m.getSecret(ctx, client, namespace, output.Secret, output.Key)
 
-			outputError = m.Context.WriteMixinOutputToFile(output.Name, val)
+		if err != nil {
+			return err
 		}
 
-		if output.ResourceType != "" && output.ResourceName != "" && output.JSONPath != "" {
-			bytes, err := m.getOutput(ctx,
-				output.ResourceType,
-				output.ResourceName,
-				output.Namespace,
-				output.JSONPath,
-			)
-			if err != nil {
-				return err
-			}
-
-			outputError = m.Context.WriteMixinOutputToFile(output.Name, bytes)
+		outputError = m.writeOutput(ctx, output.Name, val)
+	}
 
+	if output.ResourceType != "" && output.ResourceName != "" && output.JSONPath != "" {
+		bytes, err := m.getOutput(ctx, conn,
+			output.ResourceType,
+			output.ResourceName,
+			output.Namespace,
+			output.JSONPath,
+			errOut,
+		)
+		if err != nil {
+			return err
 		}
 
-		if outputError != nil {
-			return errors.Wrapf(outputError, "unable to write output '%s'", output.Name)
-		}
+		outputError = m.writeOutput(ctx, output.Name, bytes)
+
+	}
+
+	if outputError != nil {
+		return errors.Wrapf(outputError, "unable to write output '%s'", output.Name)
+	}
+	return nil
+}
+
+// writeOutput writes an output of the mixin, and records it in the summary of the step
+func (m *Mixin) writeOutput(ctx context.Context, name string, value []byte) error {
+	if err := m.Context.WriteMixinOutputToFile(name, value); err != nil {
+		return err
 	}
+	stepSummaryFrom(ctx).addOutput(name)
 	return nil
 }
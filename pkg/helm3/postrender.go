@@ -0,0 +1,165 @@
+package helm3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// PostRendererCommand is the hidden mixin command used by helm to transform the rendered manifests
+const PostRendererCommand = "post-render"
+
+// PostRenderer represents the post-renderer settings of the Install and Upgrade steps.
+// Either a binary is run with its arguments, or the mixin applies the kustomize overlay itself.
+type PostRenderer struct {
+	Binary    string            `yaml:"binary,omitempty"`
+	Args      []string          `yaml:"args,omitempty"`
+	Kustomize *KustomizeOverlay `yaml:"kustomize,omitempty"`
+}
+
+// postRenderConfig is written by the mixin for its post-render command.
+// The binary runs first, then the kustomize overlay is applied and finally the porter and common metadata are added.
+type postRenderConfig struct {
+	Binary            string            `yaml:"binary,omitempty"`
+	Args              []string          `yaml:"args,omitempty"`
+	Kustomize         KustomizeOverlay  `yaml:"kustomize,omitempty"`
+	CommonLabels      map[string]string `yaml:"commonLabels,omitempty"`
+	CommonAnnotations map[string]string `yaml:"commonAnnotations,omitempty"`
+	// PorterLabels and PorterAnnotations identify the Porter installation, they are not added to the pod templates
+	// so that a new version of the bundle does not roll out the workloads of unchanged releases
+	PorterLabels      map[string]string `yaml:"porterLabels,omitempty"`
+	PorterAnnotations map[string]string `yaml:"porterAnnotations,omitempty"`
+}
+
+// makeTempDir creates the directory holding the generated post-renderer files, tests replace it to get a stable path
+var makeTempDir = ioutil.TempDir
+
+// postRendererArgs generates the executable helm runs as post-renderer and returns the helm flags using it.
+// Helm only accepts the path of an executable, so the binary and its arguments, or the mixin itself, are
+// wrapped in a script. The mixin post-renders the manifests whenever a kustomize overlay, common labels
+// and annotations, or the metadata of the Porter installation are to be added to the resources.
+// The returned cleanup function removes the generated files once helm has completed.
+func (m *Mixin) postRendererArgs(postRenderer *PostRenderer, commonLabels map[string]string, commonAnnotations map[string]string) ([]string, func(), error) {
+	cleanup := func() {}
+
+	var config postRenderConfig
+	if postRenderer != nil {
+		if (postRenderer.Binary == "") == (postRenderer.Kustomize == nil) {
+			return nil, cleanup, errors.New("postRenderer requires either a binary or a kustomize overlay")
+		}
+		config.Binary = postRenderer.Binary
+		config.Args = postRenderer.Args
+		if postRenderer.Kustomize != nil {
+			config.Kustomize = *postRenderer.Kustomize
+		}
+	}
+
+	config.PorterLabels, config.PorterAnnotations = m.porterMetadata()
+	config.CommonLabels, config.CommonAnnotations = commonLabels, commonAnnotations
+
+	builtin := postRenderer != nil && postRenderer.Kustomize != nil ||
+		len(config.CommonLabels) > 0 || len(config.CommonAnnotations) > 0 ||
+		len(config.PorterLabels) > 0 || len(config.PorterAnnotations) > 0
+	if !builtin && config.Binary == "" {
+		return nil, cleanup, nil
+	}
+
+	dir, err := makeTempDir("", "helm3-post-renderer-")
+	if err != nil {
+		return nil, cleanup, errors.Wrap(err, "could not create the post-renderer directory")
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	command := append([]string{config.Binary}, config.Args...)
+	if builtin {
+		contents, err := yaml.Marshal(config)
+		if err != nil {
+			cleanup()
+			return nil, func() {}, errors.Wrap(err, "could not marshal the post-renderer configuration")
+		}
+		configFile := filepath.Join(dir, "post-render.yaml")
+		if err = ioutil.WriteFile(configFile, contents, 0600); err != nil {
+			cleanup()
+			return nil, func() {}, errors.Wrap(err, "could not write the post-renderer configuration")
+		}
+
+		mixinPath, err := os.Executable()
+		if err != nil {
+			cleanup()
+			return nil, func() {}, errors.Wrap(err, "could not locate the mixin executable")
+		}
+		command = []string{mixinPath, PostRendererCommand, "--config", configFile}
+	}
+
+	script := filepath.Join(dir, "post-renderer")
+	if err = ioutil.WriteFile(script, []byte(postRendererScript(command)), 0700); err != nil {
+		cleanup()
+		return nil, func() {}, errors.Wrap(err, "could not write the post-renderer script")
+	}
+
+	return []string{"--post-renderer", script}, cleanup, nil
+}
+
+// postRendererScript builds a shell script running command, with each argument quoted
+func postRendererScript(command []string) string {
+	quoted := make([]string, len(command))
+	for i, arg := range command {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return fmt.Sprintf("#!/bin/sh\nexec %s\n", strings.Join(quoted, " "))
+}
+
+// PostRender transforms the manifests helm writes to STDIN as defined in configFile,
+// and writes the result to STDOUT for helm to install.
+func (m *Mixin) PostRender(ctx context.Context, configFile string) error {
+	contents, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return errors.Wrapf(err, "could not read the post-renderer configuration %s", configFile)
+	}
+
+	var config postRenderConfig
+	if err = yaml.Unmarshal(contents, &config); err != nil {
+		return errors.Wrapf(err, "could not unmarshal the post-renderer configuration %s", configFile)
+	}
+
+	manifest, err := ioutil.ReadAll(bufio.NewReader(m.In))
+	if err != nil {
+		return errors.Wrap(err, "could not read the rendered manifests from STDIN")
+	}
+
+	if config.Binary != "" {
+		cmd := m.NewCommand(ctx, config.Binary, config.Args...)
+		cmd.Stdin = bytes.NewReader(manifest)
+		cmd.Stderr = m.Err
+		manifest, err = cmd.Output()
+		if err != nil {
+			return errors.Wrapf(err, "post-renderer %s failed", config.Binary)
+		}
+	}
+
+	rendered, err := renderKustomize(manifest, config.Kustomize)
+	if err != nil {
+		return err
+	}
+
+	// The common metadata of the step comes last, to take precedence over the porter metadata
+	rendered, err = addCommonMetadata(rendered, config.PorterLabels, config.PorterAnnotations, false)
+	if err != nil {
+		return err
+	}
+	rendered, err = addCommonMetadata(rendered, config.CommonLabels, config.CommonAnnotations, true)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.Out.Write(rendered)
+	return err
+}
@@ -0,0 +1,320 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"get.porter.sh/porter/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+// useTempDir makes the post-renderer files predictable for the duration of a test
+func useTempDir(t *testing.T) string {
+	dir := t.TempDir()
+	makeTempDir = func(string, string) (string, error) {
+		return dir, os.MkdirAll(dir, 0700)
+	}
+	t.Cleanup(func() { makeTempDir = ioutil.TempDir })
+	return dir
+}
+
+func TestMixin_UnmarshalPostRenderer(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/install-input-post-renderer.yaml")
+	require.NoError(t, err)
+
+	var action InstallAction
+	err = yaml.Unmarshal(b, &action)
+	require.NoError(t, err)
+	require.Len(t, action.Steps, 1)
+	step := action.Steps[0]
+
+	require.NotNil(t, step.PostRenderer)
+	require.NotNil(t, step.PostRenderer.Kustomize)
+	assert.Equal(t, map[string]string{"team": "data"}, step.PostRenderer.Kustomize.Labels)
+	require.Len(t, step.PostRenderer.Kustomize.Patches, 1)
+	assert.Equal(t, &PatchTarget{Kind: "Deployment", Name: "mysql"}, step.PostRenderer.Kustomize.Patches[0].Target)
+}
+
+func TestPostRendererScript(t *testing.T) {
+	script := postRendererScript([]string{"/usr/local/bin/render", "--message", "it's done"})
+	assert.Equal(t, "#!/bin/sh\nexec '/usr/local/bin/render' '--message' 'it'\\''s done'\n", script)
+}
+
+func TestMixin_PostRendererArgs(t *testing.T) {
+	t.Run("without post-renderer", func(t *testing.T) {
+		m := NewTestMixin(t)
+
+		args, cleanup, err := m.postRendererArgs(nil, nil, nil)
+		require.NoError(t, err)
+		defer cleanup()
+		assert.Empty(t, args)
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		dir := useTempDir(t)
+		m := NewTestMixin(t)
+
+		args, cleanup, err := m.postRendererArgs(&PostRenderer{Binary: "/usr/local/bin/render", Args: []string{"--env", "prod"}}, nil, nil)
+		require.NoError(t, err)
+
+		script := filepath.Join(dir, "post-renderer")
+		assert.Equal(t, []string{"--post-renderer", script}, args)
+		contents, err := ioutil.ReadFile(script)
+		require.NoError(t, err)
+		assert.Equal(t, "#!/bin/sh\nexec '/usr/local/bin/render' '--env' 'prod'\n", string(contents))
+
+		cleanup()
+		_, err = os.Stat(dir)
+		assert.True(t, os.IsNotExist(err), "the post-renderer files should be removed")
+	})
+
+	t.Run("kustomize", func(t *testing.T) {
+		dir := useTempDir(t)
+		m := NewTestMixin(t)
+
+		overlay := &KustomizeOverlay{Labels: map[string]string{"team": "data"}}
+		args, cleanup, err := m.postRendererArgs(&PostRenderer{Kustomize: overlay}, nil, nil)
+		require.NoError(t, err)
+		defer cleanup()
+
+		script := filepath.Join(dir, "post-renderer")
+		configFile := filepath.Join(dir, "post-render.yaml")
+		assert.Equal(t, []string{"--post-renderer", script}, args)
+
+		mixinPath, err := os.Executable()
+		require.NoError(t, err)
+		contents, err := ioutil.ReadFile(script)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("#!/bin/sh\nexec '%s' 'post-render' '--config' '%s'\n", mixinPath, configFile), string(contents))
+
+		contents, err = ioutil.ReadFile(configFile)
+		require.NoError(t, err)
+		var config postRenderConfig
+		require.NoError(t, yaml.Unmarshal(contents, &config))
+		assert.Equal(t, *overlay, config.Kustomize)
+	})
+
+	t.Run("common metadata with a binary", func(t *testing.T) {
+		dir := useTempDir(t)
+		m := NewTestMixin(t)
+		m.Setenv("CNAB_INSTALLATION_NAME", "mysql-prod")
+
+		args, cleanup, err := m.postRendererArgs(&PostRenderer{Binary: "render", Args: []string{"--env", "prod"}},
+			map[string]string{"team": "data", "porter.sh/installation": "mysql"},
+			map[string]string{"example.com/owner": "data-platform"})
+		require.NoError(t, err)
+		defer cleanup()
+
+		script := filepath.Join(dir, "post-renderer")
+		configFile := filepath.Join(dir, "post-render.yaml")
+		assert.Equal(t, []string{"--post-renderer", script}, args)
+
+		mixinPath, err := os.Executable()
+		require.NoError(t, err)
+		contents, err := ioutil.ReadFile(script)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("#!/bin/sh\nexec '%s' 'post-render' '--config' '%s'\n", mixinPath, configFile), string(contents),
+			"the mixin runs the binary before adding the metadata")
+
+		contents, err = ioutil.ReadFile(configFile)
+		require.NoError(t, err)
+		var config postRenderConfig
+		require.NoError(t, yaml.Unmarshal(contents, &config))
+		assert.Equal(t, postRenderConfig{
+			Binary:            "render",
+			Args:              []string{"--env", "prod"},
+			CommonLabels:      map[string]string{"team": "data", "porter.sh/installation": "mysql"},
+			CommonAnnotations: map[string]string{"example.com/owner": "data-platform"},
+			PorterLabels:      map[string]string{"porter.sh/installation": "mysql-prod"},
+			PorterAnnotations: map[string]string{"porter.sh/installation": "mysql-prod"},
+		}, config)
+	})
+
+	t.Run("binary and kustomize", func(t *testing.T) {
+		m := NewTestMixin(t)
+
+		_, _, err := m.postRendererArgs(&PostRenderer{Binary: "render", Kustomize: &KustomizeOverlay{}}, nil, nil)
+		require.EqualError(t, err, "postRenderer requires either a binary or a kustomize overlay")
+	})
+}
+
+func TestMixin_PostRender(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "post-render.yaml")
+	err := ioutil.WriteFile(configFile, []byte(`kustomize:
+  labels:
+    team: data
+commonAnnotations:
+  porter.sh/installation: mysql-prod
+`), 0600)
+	require.NoError(t, err)
+
+	m := NewTestMixin(t)
+	m.In = bytes.NewBufferString(`---
+# Source: mychart/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  key: value
+`)
+
+	err = m.PostRender(context.Background(), configFile)
+	require.NoError(t, err)
+
+	wantOutput := `apiVersion: v1
+data:
+  key: value
+kind: ConfigMap
+metadata:
+  annotations:
+    porter.sh/installation: mysql-prod
+  labels:
+    team: data
+  name: settings
+`
+	assert.Equal(t, wantOutput, m.TestContext.GetOutput())
+}
+
+func TestMixin_PostRenderPorterMetadata(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "post-render.yaml")
+	err := ioutil.WriteFile(configFile, []byte(`commonLabels:
+  team: data
+porterLabels:
+  porter.sh/installation: mysql-prod
+  team: platform
+porterAnnotations:
+  porter.sh/bundle-version: 0.2.0
+`), 0600)
+	require.NoError(t, err)
+
+	m := NewTestMixin(t)
+	m.In = bytes.NewBufferString(`---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: mysql
+spec:
+  template:
+    spec:
+      containers:
+      - name: mysql
+        image: mysql:8.0
+`)
+
+	err = m.PostRender(context.Background(), configFile)
+	require.NoError(t, err)
+
+	wantOutput := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    porter.sh/bundle-version: 0.2.0
+  labels:
+    porter.sh/installation: mysql-prod
+    team: data
+  name: mysql
+spec:
+  template:
+    metadata:
+      labels:
+        team: data
+    spec:
+      containers:
+      - image: mysql:8.0
+        name: mysql
+`
+	assert.Equal(t, wantOutput, m.TestContext.GetOutput(),
+		"the porter metadata is not added to the pod template, so that a new bundle version does not roll out the workload")
+}
+
+func TestMixin_InstallWithPostRenderer(t *testing.T) {
+	ctx := context.Background()
+	dir := useTempDir(t)
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, fmt.Sprintf("helm3 upgrade --install foo mychart --post-renderer %s --atomic --create-namespace",
+		filepath.Join(dir, "post-renderer")))
+
+	action := InstallAction{Steps: []InstallStep{
+		{
+			InstallArguments: InstallArguments{
+				Step:         Step{Description: "Install Foo"},
+				Name:         "foo",
+				Chart:        "mychart",
+				PostRenderer: &PostRenderer{Binary: "render"},
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+
+	err = h.Install(ctx)
+	require.NoError(t, err)
+}
+
+func TestMixin_InstallWithCommonLabels(t *testing.T) {
+	ctx := context.Background()
+	dir := useTempDir(t)
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, fmt.Sprintf("helm3 upgrade --install foo mychart --post-renderer %s --atomic --create-namespace",
+		filepath.Join(dir, "post-renderer")))
+
+	action := InstallAction{Steps: []InstallStep{
+		{
+			InstallArguments: InstallArguments{
+				Step:         Step{Description: "Install Foo"},
+				Name:         "foo",
+				Chart:        "mychart",
+				CommonLabels: map[string]string{"team": "data"},
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+
+	err = h.Install(ctx)
+	require.NoError(t, err)
+}
+
+func TestMixin_UpgradeWithPostRenderer(t *testing.T) {
+	ctx := context.Background()
+	dir := useTempDir(t)
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, fmt.Sprintf("helm3 upgrade --install foo mychart --post-renderer %s --atomic --create-namespace",
+		filepath.Join(dir, "post-renderer")))
+
+	action := UpgradeAction{Steps: []UpgradeStep{
+		{
+			UpgradeArguments: UpgradeArguments{
+				Step:         Step{Description: "Upgrade Foo"},
+				Name:         "foo",
+				Chart:        "mychart",
+				PostRenderer: &PostRenderer{Kustomize: &KustomizeOverlay{Labels: map[string]string{"team": "data"}}},
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+
+	err = h.Upgrade(ctx)
+	require.NoError(t, err)
+}
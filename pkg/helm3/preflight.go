@@ -0,0 +1,264 @@
+package helm3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// Preflight lists the checks run against the cluster before helm is run by an Install or Upgrade step
+type Preflight struct {
+	// ServerVersion is a semver constraint on the version of the kubernetes API server
+	ServerVersion string `yaml:"serverVersion,omitempty"`
+	// APIs are the API groups, or group versions such as networking.k8s.io/v1, that must be served
+	APIs []string `yaml:"apis,omitempty"`
+	// CRDs are the names of the custom resource definitions that must exist
+	CRDs []string `yaml:"crds,omitempty"`
+	// Permissions must be granted to the user running the bundle
+	Permissions []PreflightPermission `yaml:"permissions,omitempty"`
+	// Quota is the room required in the resource quotas of the namespace, such as pods: "3" or requests.cpu: "500m"
+	Quota map[string]string `yaml:"quota,omitempty"`
+}
+
+// PreflightPermission is an action checked with a SelfSubjectAccessReview
+type PreflightPermission struct {
+	Verb      string `yaml:"verb"`
+	Group     string `yaml:"group,omitempty"`
+	Resource  string `yaml:"resource"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+func (p PreflightPermission) String() string {
+	resource := p.Resource
+	if p.Group != "" {
+		resource += "." + p.Group
+	}
+	if p.Namespace != "" {
+		return fmt.Sprintf("%s %s in namespace %s", p.Verb, resource, p.Namespace)
+	}
+	return fmt.Sprintf("%s %s", p.Verb, resource)
+}
+
+// runPreflight runs the checks of a step, and reports all the failed ones together
+func (m *Mixin) runPreflight(ctx context.Context, conn clusterConnection, kubeClient k8s.Interface, namespace string, preflight *Preflight, out io.Writer) error {
+	if preflight == nil {
+		return nil
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	fmt.Fprintln(out, "Running preflight checks")
+
+	// Every other check fails when the API server cannot be reached, so stop early
+	version, err := getServerVersion(kubeClient)
+	if err != nil {
+		return preflightError(multierror.Append(nil, err))
+	}
+
+	var result error
+	if preflight.ServerVersion != "" {
+		ok, err := validate(version, preflight.ServerVersion)
+		if err != nil {
+			result = multierror.Append(result, err)
+		} else if !ok {
+			result = multierror.Append(result, fmt.Errorf("server version %s does not meet the constraint %q", version, preflight.ServerVersion))
+		}
+	}
+
+	if len(preflight.APIs) > 0 {
+		if err := checkAPIs(kubeClient, preflight.APIs); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	if len(preflight.CRDs) > 0 {
+		if err := m.checkCRDs(ctx, conn, preflight.CRDs); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	for _, permission := range preflight.Permissions {
+		if permission.Namespace == "" {
+			permission.Namespace = namespace
+		}
+		if err := checkPermission(ctx, kubeClient, permission); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	if len(preflight.Quota) > 0 {
+		if err := checkQuota(ctx, kubeClient, namespace, preflight.Quota); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	if result != nil {
+		return preflightError(result)
+	}
+	fmt.Fprintln(out, "Preflight checks passed")
+	return nil
+}
+
+func preflightError(err error) error {
+	return errors.Wrap(err, "preflight checks failed")
+}
+
+// getServerVersion returns the version of the API server, without the distribution specific suffix,
+// so that a version such as v1.25.3-gke.100 matches a constraint such as >=1.24
+func getServerVersion(kubeClient k8s.Interface) (string, error) {
+	info, err := kubeClient.Discovery().ServerVersion()
+	if err != nil {
+		return "", errors.Wrap(err, "could not reach the kubernetes API server")
+	}
+	v, err := semver.NewVersion(info.GitVersion)
+	if err != nil {
+		return "", errors.Wrapf(err, "server version %q cannot be parsed as semver", info.GitVersion)
+	}
+	return fmt.Sprintf("%d.%d.%d", v.Major(), v.Minor(), v.Patch()), nil
+}
+
+// checkKubeVersion ensures that the version of the API server meets the kubeVersion constraint of a release
+func checkKubeVersion(kubeClient k8s.Interface, release string, constraint string) error {
+	if constraint == "" {
+		return nil
+	}
+	version, err := getServerVersion(kubeClient)
+	if err != nil {
+		return err
+	}
+	ok, err := validate(version, constraint)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Errorf("release %s requires a kubernetes version matching %q, but the cluster runs %s", release, constraint, version)
+	}
+	return nil
+}
+
+// checkAPIs ensures that each API group, or group version, is served
+func checkAPIs(kubeClient k8s.Interface, apis []string) error {
+	groups, err := kubeClient.Discovery().ServerGroups()
+	if err != nil {
+		return errors.Wrap(err, "could not list the API groups of the server")
+	}
+
+	served := make(map[string]bool)
+	for _, group := range groups.Groups {
+		served[group.Name] = true
+		for _, version := range group.Versions {
+			served[version.GroupVersion] = true
+		}
+	}
+
+	var missing []string
+	for _, api := range apis {
+		if !served[api] {
+			missing = append(missing, api)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required APIs are not served: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkCRDs ensures that each custom resource definition exists
+func (m *Mixin) checkCRDs(ctx context.Context, conn clusterConnection, crds []string) error {
+	dynamicClient, err := m.getDynamicClient(ctx, conn)
+	if err != nil {
+		return errors.Wrap(err, "couldn't get kubernetes dynamic client")
+	}
+
+	var missing []string
+	for _, name := range crds {
+		_, err := dynamicClient.Resource(crdResource).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			missing = append(missing, name)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "could not get custom resource definition %s", name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required custom resource definitions do not exist: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkPermission asks the API server whether the current user may perform an action
+func checkPermission(ctx context.Context, kubeClient k8s.Interface, permission PreflightPermission) error {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: permission.Namespace,
+				Verb:      permission.Verb,
+				Group:     permission.Group,
+				Resource:  permission.Resource,
+			},
+		},
+	}
+	review, err := kubeClient.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "could not check permission to %s", permission)
+	}
+	if !review.Status.Allowed {
+		if review.Status.Reason != "" {
+			return fmt.Errorf("permission denied to %s: %s", permission, review.Status.Reason)
+		}
+		return fmt.Errorf("permission denied to %s", permission)
+	}
+	return nil
+}
+
+// checkQuota ensures that the resource quotas of the namespace leave the required room for each resource
+func checkQuota(ctx context.Context, kubeClient k8s.Interface, namespace string, required map[string]string) error {
+	quotas, err := kubeClient.CoreV1().ResourceQuotas(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "could not list the resource quotas of namespace %s", namespace)
+	}
+
+	names := make([]string, 0, len(required))
+	for name := range required {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result error
+	for _, name := range names {
+		want, err := resource.ParseQuantity(required[name])
+		if err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "invalid quota quantity %q for %s", required[name], name))
+			continue
+		}
+		for _, quota := range quotas.Items {
+			hard, ok := quota.Status.Hard[corev1.ResourceName(name)]
+			if !ok {
+				continue
+			}
+			room := hard.DeepCopy()
+			if used, ok := quota.Status.Used[corev1.ResourceName(name)]; ok {
+				room.Sub(used)
+			}
+			if room.Cmp(want) < 0 {
+				result = multierror.Append(result, fmt.Errorf("resource quota %s of namespace %s only has room for %s %s, %s required",
+					quota.Name, namespace, room.String(), name, want.String()))
+			}
+		}
+	}
+	return result
+}
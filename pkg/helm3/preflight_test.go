@@ -0,0 +1,252 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"get.porter.sh/porter/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// unreachableClient is a cluster whose API server cannot be reached
+type unreachableClient struct {
+	*testclient.Clientset
+}
+
+func (c unreachableClient) Discovery() discovery.DiscoveryInterface {
+	return unreachableDiscovery{c.Clientset.Discovery().(*fakediscovery.FakeDiscovery)}
+}
+
+type unreachableDiscovery struct {
+	*fakediscovery.FakeDiscovery
+}
+
+func (unreachableDiscovery) ServerVersion() (*version.Info, error) {
+	return nil, errors.New("dial tcp 10.0.0.1:443: connect: connection refused")
+}
+
+// setupPreflightCluster fakes a cluster running kubernetes 1.25 on GKE, serving a few APIs and CRDs,
+// where the user can only manage deployments and the namespace has room for one more pod
+func setupPreflightCluster(t *testing.T, m *TestMixin) {
+	fakeDiscovery := m.KubeClient.Discovery().(*fakediscovery.FakeDiscovery)
+	fakeDiscovery.FakedServerVersion = &version.Info{GitVersion: "v1.25.3-gke.100"}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{
+		{GroupVersion: "v1"},
+		{GroupVersion: "apps/v1"},
+		{GroupVersion: "networking.k8s.io/v1"},
+	}
+
+	m.KubeClient.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		review.Status.Allowed = review.Spec.ResourceAttributes.Resource == "deployments"
+		return true, review, nil
+	})
+
+	quota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "compute", Namespace: "mydb"},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{corev1.ResourcePods: resource.MustParse("10"), corev1.ResourceRequestsCPU: resource.MustParse("2")},
+			Used: corev1.ResourceList{corev1.ResourcePods: resource.MustParse("9"), corev1.ResourceRequestsCPU: resource.MustParse("500m")},
+		},
+	}
+	require.NoError(t, m.KubeClient.Tracker().Add(quota))
+
+	m.DynamicClient = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), crd("certificates.cert-manager.io"))
+	m.ClientFactory = &testKubernetesFactory{client: m.KubeClient, dynamicClient: m.DynamicClient}
+}
+
+func TestMixin_RunPreflight(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("all checks pass", func(t *testing.T) {
+		m := NewTestMixin(t)
+		setupPreflightCluster(t, m)
+
+		preflight := &Preflight{
+			ServerVersion: ">=1.24",
+			APIs:          []string{"apps", "networking.k8s.io/v1"},
+			CRDs:          []string{"certificates.cert-manager.io"},
+			Permissions:   []PreflightPermission{{Verb: "create", Group: "apps", Resource: "deployments"}},
+			Quota:         map[string]string{"pods": "1", "requests.cpu": "1500m"},
+		}
+		out := &bytes.Buffer{}
+		err := m.runPreflight(ctx, clusterConnection{}, m.KubeClient, "mydb", preflight, out)
+		require.NoError(t, err)
+		assert.Equal(t, "Running preflight checks\nPreflight checks passed\n", out.String())
+	})
+
+	t.Run("all failures are reported", func(t *testing.T) {
+		m := NewTestMixin(t)
+		setupPreflightCluster(t, m)
+
+		preflight := &Preflight{
+			ServerVersion: ">=1.26",
+			APIs:          []string{"apps", "policy/v1beta1", "gateway.networking.k8s.io"},
+			CRDs:          []string{"certificates.cert-manager.io", "issuers.cert-manager.io"},
+			Permissions: []PreflightPermission{
+				{Verb: "create", Group: "apps", Resource: "deployments"},
+				{Verb: "create", Group: "rbac.authorization.k8s.io", Resource: "clusterroles"},
+			},
+			Quota: map[string]string{"pods": "2", "requests.cpu": "1"},
+		}
+		err := m.runPreflight(ctx, clusterConnection{}, m.KubeClient, "mydb", preflight, &bytes.Buffer{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "preflight checks failed")
+		assert.Contains(t, err.Error(), `server version 1.25.3 does not meet the constraint ">=1.26"`)
+		assert.Contains(t, err.Error(), "required APIs are not served: policy/v1beta1, gateway.networking.k8s.io")
+		assert.Contains(t, err.Error(), "required custom resource definitions do not exist: issuers.cert-manager.io")
+		assert.Contains(t, err.Error(), "permission denied to create clusterroles.rbac.authorization.k8s.io in namespace mydb")
+		assert.NotContains(t, err.Error(), "permission denied to create deployments")
+		assert.Contains(t, err.Error(), "resource quota compute of namespace mydb only has room for 1 pods, 2 required")
+		assert.NotContains(t, err.Error(), "requests.cpu")
+	})
+
+	t.Run("unreachable API server", func(t *testing.T) {
+		m := NewTestMixin(t)
+
+		preflight := &Preflight{APIs: []string{"apps"}}
+		err := m.runPreflight(ctx, clusterConnection{}, unreachableClient{m.KubeClient}, "mydb", preflight, &bytes.Buffer{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not reach the kubernetes API server: dial tcp 10.0.0.1:443: connect: connection refused")
+		assert.NotContains(t, err.Error(), "required APIs")
+	})
+
+	t.Run("without preflight", func(t *testing.T) {
+		m := NewTestMixin(t)
+
+		out := &bytes.Buffer{}
+		err := m.runPreflight(ctx, clusterConnection{}, unreachableClient{m.KubeClient}, "mydb", nil, out)
+		require.NoError(t, err)
+		assert.Empty(t, out.String())
+	})
+}
+
+func TestMixin_InstallPreflightFailure(t *testing.T) {
+	ctx := context.Background()
+
+	// helm must not run when the preflight checks fail
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, "")
+
+	action := InstallAction{Steps: []InstallStep{
+		{
+			InstallArguments: InstallArguments{
+				Step:      Step{Description: "Install MySQL"},
+				Name:      "mysql",
+				Chart:     "bitnami/mysql",
+				Namespace: "mydb",
+				Preflight: &Preflight{CRDs: []string{"issuers.cert-manager.io"}},
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+	setupPreflightCluster(t, h)
+
+	err = h.Install(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "required custom resource definitions do not exist: issuers.cert-manager.io")
+	assert.NotContains(t, h.TestContext.GetOutput(), "helm3 upgrade")
+}
+
+func TestMixin_UnmarshalPreflight(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/install-input-preflight.yaml")
+	require.NoError(t, err)
+
+	var action InstallAction
+	err = yaml.Unmarshal(b, &action)
+	require.NoError(t, err)
+	require.Len(t, action.Steps, 1)
+
+	assert.Equal(t, &Preflight{
+		ServerVersion: ">=1.24",
+		APIs:          []string{"networking.k8s.io/v1"},
+		CRDs:          []string{"certificates.cert-manager.io"},
+		Permissions:   []PreflightPermission{{Verb: "create", Group: "apps", Resource: "statefulsets"}},
+		Quota:         map[string]string{"pods": "3", "requests.memory": "1Gi"},
+	}, action.Steps[0].Preflight)
+	assert.Equal(t, ">=1.24, <1.28", action.Steps[0].KubeVersion)
+}
+
+func TestCheckKubeVersion(t *testing.T) {
+	m := NewTestMixin(t)
+	setupPreflightCluster(t, m)
+
+	assert.NoError(t, checkKubeVersion(m.KubeClient, "mysql", ""))
+	assert.NoError(t, checkKubeVersion(m.KubeClient, "mysql", ">=1.24.0-0"))
+	assert.NoError(t, checkKubeVersion(m.KubeClient, "mysql", "~1.25"))
+	assert.EqualError(t, checkKubeVersion(m.KubeClient, "mysql", ">=1.26"),
+		`release mysql requires a kubernetes version matching ">=1.26", but the cluster runs 1.25.3`)
+
+	err := checkKubeVersion(m.KubeClient, "mysql", "not a constraint")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unable to parse version constraint "not a constraint"`)
+
+	err = checkKubeVersion(unreachableClient{m.KubeClient}, "mysql", ">=1.24")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "could not reach the kubernetes API server")
+}
+
+func TestMixin_UpgradeKubeVersion(t *testing.T) {
+	ctx := context.Background()
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, "helm3 upgrade --install mysql bitnami/mysql --namespace mydb --atomic --create-namespace")
+
+	for _, tc := range []struct {
+		kubeVersion string
+		wantError   string
+	}{
+		{kubeVersion: ">=1.22, <1.27"},
+		{kubeVersion: "<1.25", wantError: `release mysql requires a kubernetes version matching "<1.25", but the cluster runs 1.25.3`},
+	} {
+		t.Run(tc.kubeVersion, func(t *testing.T) {
+			action := UpgradeAction{Steps: []UpgradeStep{
+				{
+					UpgradeArguments: UpgradeArguments{
+						Step:        Step{Description: "Upgrade MySQL"},
+						Name:        "mysql",
+						Chart:       "bitnami/mysql",
+						Namespace:   "mydb",
+						KubeVersion: tc.kubeVersion,
+					},
+				},
+			}}
+			b, err := yaml.Marshal(action)
+			require.NoError(t, err)
+
+			h := NewTestMixin(t)
+			h.In = bytes.NewReader(b)
+			setupPreflightCluster(t, h)
+
+			err = h.Upgrade(ctx)
+			if tc.wantError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.wantError)
+				assert.NotContains(t, h.TestContext.GetOutput(), "helm3 upgrade")
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
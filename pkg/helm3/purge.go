@@ -0,0 +1,166 @@
+package helm3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// crdResource is the resource of the CustomResourceDefinitions, deleted with the dynamic client
+var crdResource = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+// instanceLabel is the recommended label set by charts on the objects of a release, including the PVCs of their StatefulSets
+const instanceLabel = "app.kubernetes.io/instance"
+
+// purgeTargets are the objects left behind by helm when a release is uninstalled
+type purgeTargets struct {
+	CRDs []string
+	PVCs []string
+}
+
+// manifestResource holds the fields of a rendered resource used to find the objects left behind by a release
+type manifestResource struct {
+	resourceMeta
+	Spec struct {
+		VolumeClaimTemplates []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		} `json:"volumeClaimTemplates"`
+	} `json:"spec"`
+}
+
+// findPurgeTargets finds the CRDs and PVCs of an installed release that helm does not delete:
+// the CRDs of the manifest and of the crds directory of the chart, and the PVCs labeled with
+// the release name or created from the volume claim templates of its StatefulSets.
+func (m *Mixin) findPurgeTargets(ctx context.Context, client k8s.Interface, step UninstallStep, revision releaseRevision) (purgeTargets, error) {
+	var targets purgeTargets
+
+	release, err := m.getRelease(ctx, client, revision)
+	if err != nil {
+		return targets, err
+	}
+
+	manifests := []string{release.Manifest}
+	for _, file := range release.Chart.Files {
+		if strings.HasPrefix(file.Name, "crds/") {
+			manifests = append(manifests, string(file.Data))
+		}
+	}
+
+	var claimPatterns []*regexp.Regexp
+	for _, manifest := range manifests {
+		docs, err := splitManifest([]byte(manifest))
+		if err != nil {
+			return targets, errors.Wrapf(err, "could not read the manifest of release %s", revision.Name)
+		}
+		for _, doc := range docs {
+			var resource manifestResource
+			if err := json.Unmarshal(doc, &resource); err != nil {
+				return targets, errors.Wrapf(err, "could not read the manifest of release %s", revision.Name)
+			}
+			switch gvk := resource.gvk(); {
+			case gvk.Group == crdResource.Group && gvk.Kind == "CustomResourceDefinition":
+				targets.CRDs = appendUnique(targets.CRDs, resource.Metadata.Name)
+			case gvk.Kind == "StatefulSet":
+				// The StatefulSet controller names the claims <template>-<statefulset>-<ordinal>
+				for _, template := range resource.Spec.VolumeClaimTemplates {
+					prefix := regexp.QuoteMeta(template.Metadata.Name + "-" + resource.Metadata.Name)
+					claimPatterns = append(claimPatterns, regexp.MustCompile("^"+prefix+`-[0-9]+$`))
+				}
+			}
+		}
+	}
+
+	if step.PurgePvcs {
+		claims, err := client.CoreV1().PersistentVolumeClaims(revision.Namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return targets, errors.Wrapf(err, "could not list the persistent volume claims of namespace %s", revision.Namespace)
+		}
+		for _, claim := range claims.Items {
+			match := claim.Labels[instanceLabel] == revision.Name
+			for _, pattern := range claimPatterns {
+				match = match || pattern.MatchString(claim.Name)
+			}
+			if match {
+				targets.PVCs = appendUnique(targets.PVCs, claim.Name)
+			}
+		}
+	}
+
+	if !step.PurgeCrds {
+		targets.CRDs = nil
+	}
+	targets.CRDs = filterAllowed(targets.CRDs, step.PurgeAllowlist)
+	targets.PVCs = filterAllowed(targets.PVCs, step.PurgeAllowlist)
+	sort.Strings(targets.CRDs)
+	sort.Strings(targets.PVCs)
+	return targets, nil
+}
+
+// purge deletes the objects left behind by an uninstalled release
+func (m *Mixin) purge(ctx context.Context, conn clusterConnection, client k8s.Interface, release string, namespace string, targets purgeTargets, out io.Writer) error {
+	var result error
+
+	if len(targets.PVCs) > 0 {
+		fmt.Fprintf(out, "Purging the persistent volume claims of release %s: %s\n", release, strings.Join(targets.PVCs, ", "))
+		for _, name := range targets.PVCs {
+			err := client.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				result = multierror.Append(result, errors.Wrapf(err, "could not delete persistent volume claim %s", name))
+			}
+		}
+	}
+
+	if len(targets.CRDs) > 0 {
+		fmt.Fprintf(out, "Purging the custom resource definitions of release %s: %s\n", release, strings.Join(targets.CRDs, ", "))
+		dynamicClient, err := m.getDynamicClient(ctx, conn)
+		if err != nil {
+			return multierror.Append(result, errors.Wrap(err, "couldn't get kubernetes dynamic client"))
+		}
+		for _, name := range targets.CRDs {
+			err := dynamicClient.Resource(crdResource).Delete(ctx, name, metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				result = multierror.Append(result, errors.Wrapf(err, "could not delete custom resource definition %s", name))
+			}
+		}
+	}
+
+	return result
+}
+
+// filterAllowed keeps the names matching one of the patterns of the allowlist, all the names are kept without allowlist
+func filterAllowed(names []string, allowlist []string) []string {
+	if len(allowlist) == 0 {
+		return names
+	}
+	var allowed []string
+	for _, name := range names {
+		for _, pattern := range allowlist {
+			if ok, _ := path.Match(pattern, name); ok {
+				allowed = append(allowed, name)
+				break
+			}
+		}
+	}
+	return allowed
+}
+
+func appendUnique(values []string, value string) []string {
+	if containsString(values, value) {
+		return values
+	}
+	return append(values, value)
+}
@@ -0,0 +1,187 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"get.porter.sh/porter/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+const purgeManifest = `---
+# Source: mysql/templates/statefulset.yaml
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: mysql
+spec:
+  volumeClaimTemplates:
+  - metadata:
+      name: data
+---
+# Source: mysql/templates/crd.yaml
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: schedules.backup.example.com
+`
+
+var purgeChartFiles = map[string]string{
+	"crds/restores.yaml": `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: restores.backup.example.com
+`,
+	"README.md": "kind: CustomResourceDefinition",
+}
+
+// addPurgeObjects stores the mysql release, the claims of its StatefulSet and the CRDs it installed
+func addPurgeObjects(t *testing.T, m *TestMixin) {
+	addReleaseRecord(t, m.KubeClient, "mydb", "mysql", 1, "deployed", purgeManifest, purgeChartFiles)
+
+	claims := []*corev1.PersistentVolumeClaim{
+		{ObjectMeta: metav1.ObjectMeta{Name: "data-mysql-0", Namespace: "mydb"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "data-mysql-1", Namespace: "mydb"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "logs", Namespace: "mydb", Labels: map[string]string{"app.kubernetes.io/instance": "mysql"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "data-mysql-backup-0", Namespace: "mydb"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "cache", Namespace: "mydb", Labels: map[string]string{"app.kubernetes.io/instance": "redis"}}},
+	}
+	for _, claim := range claims {
+		require.NoError(t, m.KubeClient.Tracker().Add(claim))
+	}
+
+	m.DynamicClient = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		crd("schedules.backup.example.com"), crd("restores.backup.example.com"), crd("other.example.com"))
+	m.ClientFactory = &testKubernetesFactory{client: m.KubeClient, dynamicClient: m.DynamicClient}
+}
+
+func crd(name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("apiextensions.k8s.io/v1")
+	obj.SetKind("CustomResourceDefinition")
+	obj.SetName(name)
+	return obj
+}
+
+func TestMixin_FindPurgeTargets(t *testing.T) {
+	ctx := context.Background()
+	revision := releaseRevision{Name: "mysql", Namespace: "mydb", Version: 1, Status: "deployed"}
+
+	testcases := []struct {
+		name string
+		step UninstallArguments
+		want purgeTargets
+	}{
+		{
+			name: "crds",
+			step: UninstallArguments{PurgeCrds: true},
+			want: purgeTargets{CRDs: []string{"restores.backup.example.com", "schedules.backup.example.com"}},
+		},
+		{
+			name: "pvcs",
+			step: UninstallArguments{PurgePvcs: true},
+			want: purgeTargets{PVCs: []string{"data-mysql-0", "data-mysql-1", "logs"}},
+		},
+		{
+			name: "allowlist",
+			step: UninstallArguments{PurgeCrds: true, PurgePvcs: true, PurgeAllowlist: []string{"data-*", "schedules.backup.example.com"}},
+			want: purgeTargets{CRDs: []string{"schedules.backup.example.com"}, PVCs: []string{"data-mysql-0", "data-mysql-1"}},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewTestMixin(t)
+			addPurgeObjects(t, m)
+
+			targets, err := m.findPurgeTargets(ctx, m.KubeClient, UninstallStep{tc.step}, revision)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, targets)
+		})
+	}
+}
+
+func TestFilterAllowed(t *testing.T) {
+	names := []string{"data-mysql-0", "logs"}
+	assert.Equal(t, names, filterAllowed(names, nil))
+	assert.Equal(t, []string{"logs"}, filterAllowed(names, []string{"logs", "cache"}))
+	assert.Empty(t, filterAllowed(names, []string{"cache"}))
+}
+
+func TestMixin_UninstallPurge(t *testing.T) {
+	ctx := context.Background()
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, "helm3 uninstall mysql --namespace mydb")
+
+	action := UninstallAction{Steps: []UninstallStep{
+		{
+			UninstallArguments: UninstallArguments{
+				Step:           Step{Description: "Uninstall MySQL"},
+				Namespace:      "mydb",
+				Releases:       []string{"mysql"},
+				PurgeCrds:      true,
+				PurgePvcs:      true,
+				PurgeAllowlist: []string{"data-*", "*.backup.example.com"},
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+	addPurgeObjects(t, h)
+
+	err = h.Uninstall(ctx)
+	require.NoError(t, err)
+
+	output := h.TestContext.GetOutput()
+	assert.Contains(t, output, "Purging the persistent volume claims of release mysql: data-mysql-0, data-mysql-1\n")
+	assert.Contains(t, output, "Purging the custom resource definitions of release mysql: restores.backup.example.com, schedules.backup.example.com\n")
+
+	claims, err := h.KubeClient.CoreV1().PersistentVolumeClaims("mydb").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	var remaining []string
+	for _, claim := range claims.Items {
+		remaining = append(remaining, claim.Name)
+	}
+	assert.ElementsMatch(t, []string{"logs", "data-mysql-backup-0", "cache"}, remaining)
+
+	_, err = h.DynamicClient.Resource(crdResource).Get(ctx, "schedules.backup.example.com", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err), "the CRD of the release is deleted")
+	_, err = h.DynamicClient.Resource(crdResource).Get(ctx, "other.example.com", metav1.GetOptions{})
+	assert.NoError(t, err, "the other CRDs are kept")
+}
+
+func TestMixin_UninstallInvalidAllowlist(t *testing.T) {
+	action := UninstallAction{Steps: []UninstallStep{
+		{
+			UninstallArguments: UninstallArguments{
+				Step:           Step{Description: "Uninstall MySQL"},
+				Releases:       []string{"mysql"},
+				PurgePvcs:      true,
+				PurgeAllowlist: []string{"data-["},
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+
+	err = h.Uninstall(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid purgeAllowlist pattern "data-["`)
+}
@@ -0,0 +1,100 @@
+package helm3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// Policies recovering a release stuck in a pending status, accepted by the recoverPending setting of an Install or Upgrade step
+const (
+	recoverPendingRollback   = "rollback"
+	recoverPendingMarkFailed = "markFailed"
+)
+
+var recoverPendingPolicies = []string{recoverPendingRollback, recoverPendingMarkFailed}
+
+// validateRecoverPending checks the recoverPending setting of a step, empty when the step does not recover pending releases
+func validateRecoverPending(policy string) error {
+	if policy != "" && !containsString(recoverPendingPolicies, policy) {
+		return fmt.Errorf("invalid recoverPending %q, must be one of %s", policy, strings.Join(recoverPendingPolicies, ", "))
+	}
+	return nil
+}
+
+// recoverPending recovers a release whose latest revision is stuck in a pending status, left by an interrupted helm operation,
+// so that helm does not fail with "another operation (install/upgrade/rollback) is in progress". With the rollback policy,
+// the release is rolled back to its deployed revision, and without any, such as after an interrupted first install,
+// the pending revision is marked failed like with the markFailed policy.
+func (m *Mixin) recoverPending(ctx context.Context, conn clusterConnection, kubeClient k8s.Interface, policy string, release string, namespace string, out io.Writer, errOut io.Writer) error {
+	if policy == "" {
+		return nil
+	}
+
+	history, err := m.getReleaseHistory(ctx, kubeClient, namespace, release)
+	if err != nil {
+		return errors.Wrapf(err, "could not check if release %s is pending", release)
+	}
+	if len(history) == 0 {
+		return nil
+	}
+	latest := history[len(history)-1]
+	if !containsString(pendingReleaseStatuses, latest.Status) {
+		return nil
+	}
+
+	if policy == recoverPendingRollback {
+		if deployed := deployedRevision(history); deployed != nil {
+			fmt.Fprintf(out, "Release %s revision %d is %s, rolling back to revision %d\n", release, latest.Version, latest.Status, deployed.Version)
+			return m.rollback(ctx, conn, release, namespace, deployed.Version, out, errOut)
+		}
+		fmt.Fprintf(out, "Release %s has no deployed revision to roll back to\n", release)
+	}
+
+	fmt.Fprintf(out, "Release %s revision %d is %s, marking it %s\n", release, latest.Version, latest.Status, releaseStatusFailed)
+	description := fmt.Sprintf("Marked %s by the helm3 mixin, the operation was interrupted while %s", releaseStatusFailed, latest.Status)
+	if err := m.setReleaseStatus(ctx, kubeClient, latest, releaseStatusFailed, description); err != nil {
+		return errors.Wrapf(err, "could not mark release %s revision %d %s", release, latest.Version, releaseStatusFailed)
+	}
+	return nil
+}
+
+// rollback rolls a release back to a revision with helm
+func (m *Mixin) rollback(ctx context.Context, conn clusterConnection, release string, namespace string, revision int, out io.Writer, errOut io.Writer) error {
+	cmd := m.NewCommand(withoutCancel(ctx), "helm3", "rollback", release, strconv.Itoa(revision))
+
+	if namespace != "" {
+		cmd.Args = append(cmd.Args, "--namespace", namespace)
+	}
+
+	cmd.Args = append(cmd.Args, conn.helmArgs()...)
+
+	cmd.Stdout = processOutput(out, "helm3")
+	cmd.Stderr = processOutput(errOut, "helm3")
+	stepSummaryFrom(ctx).addCommand(cmd.Args)
+
+	prettyCmd := fmt.Sprintf("%s %s", cmd.Path, strings.Join(redactArgs(cmd.Args), " "))
+	fmt.Fprintln(out, prettyCmd)
+
+	if err := commandNotStarted(ctx, "helm3 rollback"); err != nil {
+		return err
+	}
+	span := startProcessSpan(ctx, "helm3 rollback", releaseAttributes(release, "", "", namespace)...)
+	err := cmd.Start()
+	if err != nil {
+		endProcessSpan(span, err)
+		return fmt.Errorf("could not execute command, %s: %s", prettyCmd, err)
+	}
+	err = m.waitProcess(ctx, cmd)
+	endProcessSpan(span, err)
+	flushLogs(cmd.Stdout, cmd.Stderr)
+	if err != nil {
+		return errors.Wrapf(err, "could not roll back release %s to revision %d", release, revision)
+	}
+	return nil
+}
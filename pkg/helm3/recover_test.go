@@ -0,0 +1,123 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"get.porter.sh/porter/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestValidateRecoverPending(t *testing.T) {
+	assert.NoError(t, validateRecoverPending(""))
+	assert.NoError(t, validateRecoverPending("rollback"))
+	assert.NoError(t, validateRecoverPending("markFailed"))
+	assert.EqualError(t, validateRecoverPending("delete"), `invalid recoverPending "delete", must be one of rollback, markFailed`)
+}
+
+func TestMixin_UpgradeRecoverPending(t *testing.T) {
+	ctx := context.Background()
+	upgradeCmd := "helm3 upgrade --install mysql bitnami/mysql --namespace mydb --atomic --create-namespace"
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+
+	upgrade := func(policy string) []byte {
+		action := UpgradeAction{Steps: []UpgradeStep{
+			{
+				UpgradeArguments: UpgradeArguments{
+					Step:           Step{Description: "Upgrade MySQL"},
+					Name:           "mysql",
+					Chart:          "bitnami/mysql",
+					Namespace:      "mydb",
+					RecoverPending: policy,
+				},
+			},
+		}}
+		b, err := yaml.Marshal(action)
+		require.NoError(t, err)
+		return b
+	}
+
+	t.Run("rolls back to the deployed revision", func(t *testing.T) {
+		os.Setenv(test.ExpectedCommandEnv, strings.Join([]string{
+			"helm3 rollback mysql 2 --namespace mydb",
+			upgradeCmd,
+		}, "\n"))
+
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(upgrade("rollback"))
+		addRelease(t, h.KubeClient, "mydb", "mysql", 1, "superseded")
+		addRelease(t, h.KubeClient, "mydb", "mysql", 2, "deployed")
+		addRelease(t, h.KubeClient, "mydb", "mysql", 3, "pending-upgrade")
+
+		err := h.Upgrade(ctx)
+		require.NoError(t, err)
+
+		output := h.TestContext.GetOutput()
+		assert.Contains(t, output, "Release mysql revision 3 is pending-upgrade, rolling back to revision 2\n")
+		assert.Less(t, strings.Index(output, "rollback mysql 2"), strings.Index(output, "upgrade --install mysql bitnami/mysql"), "the release is recovered before it is upgraded")
+	})
+
+	t.Run("marks the pending revision failed", func(t *testing.T) {
+		os.Setenv(test.ExpectedCommandEnv, upgradeCmd)
+
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(upgrade("markFailed"))
+		addRelease(t, h.KubeClient, "mydb", "mysql", 1, "deployed")
+		addRelease(t, h.KubeClient, "mydb", "mysql", 2, "pending-upgrade")
+
+		err := h.Upgrade(ctx)
+		require.NoError(t, err)
+
+		assert.Contains(t, h.TestContext.GetOutput(), "Release mysql revision 2 is pending-upgrade, marking it failed\n")
+		history, err := h.getReleaseHistory(ctx, h.KubeClient, "mydb", "mysql")
+		require.NoError(t, err)
+		assert.Equal(t, "deployed", history[0].Status)
+		assert.Equal(t, "failed", history[1].Status)
+	})
+
+	t.Run("marks an interrupted first install failed", func(t *testing.T) {
+		os.Setenv(test.ExpectedCommandEnv, upgradeCmd)
+
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(upgrade("rollback"))
+		addRelease(t, h.KubeClient, "mydb", "mysql", 1, "pending-install")
+
+		err := h.Upgrade(ctx)
+		require.NoError(t, err)
+
+		output := h.TestContext.GetOutput()
+		assert.Contains(t, output, "Release mysql has no deployed revision to roll back to\n")
+		assert.Contains(t, output, "Release mysql revision 1 is pending-install, marking it failed\n")
+		history, err := h.getReleaseHistory(ctx, h.KubeClient, "mydb", "mysql")
+		require.NoError(t, err)
+		assert.Equal(t, "failed", history[0].Status)
+	})
+
+	t.Run("leaves a release that is not pending", func(t *testing.T) {
+		os.Setenv(test.ExpectedCommandEnv, upgradeCmd)
+
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(upgrade("rollback"))
+		addRelease(t, h.KubeClient, "mydb", "mysql", 1, "deployed")
+
+		err := h.Upgrade(ctx)
+		require.NoError(t, err)
+
+		assert.NotContains(t, h.TestContext.GetOutput(), "rollback")
+	})
+
+	t.Run("invalid policy", func(t *testing.T) {
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(upgrade("delete"))
+
+		err := h.Upgrade(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `invalid recoverPending "delete"`)
+	})
+}
@@ -0,0 +1,324 @@
+package helm3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Statuses of a release revision recorded by helm
+const (
+	releaseStatusDeployed = "deployed"
+	releaseStatusFailed   = "failed"
+	// releaseStatusUninstalled is the status helm records on the last revision of a release uninstalled with its history kept
+	releaseStatusUninstalled = "uninstalled"
+)
+
+// pendingReleaseStatuses are the statuses of a revision during a helm operation, left as is when the operation is interrupted
+var pendingReleaseStatuses = []string{"pending-install", "pending-upgrade", "pending-rollback"}
+
+// helmDriverEnv selects the release storage backend of helm
+const helmDriverEnv = "HELM_DRIVER"
+
+// releaseRevision is a revision of a release, read from the labels helm sets on its storage objects
+type releaseRevision struct {
+	Name      string
+	Namespace string
+	Version   int
+	Status    string
+}
+
+// getReleaseHistory returns the revisions of a release stored by helm in namespace, oldest first.
+// No revision is returned when the release, or the namespace, does not exist.
+func (m *Mixin) getReleaseHistory(ctx context.Context, client kubernetes.Interface, namespace string, release string) ([]releaseRevision, error) {
+	return m.listReleaseRevisions(ctx, client, namespace, labels.Set{"name": release}.AsSelector())
+}
+
+// listReleaseRevisions returns the revisions stored by helm in namespace with labels matching selector, sorted by release and version
+func (m *Mixin) listReleaseRevisions(ctx context.Context, client kubernetes.Interface, namespace string, selector labels.Selector) ([]releaseRevision, error) {
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	requirements, _ := selector.Requirements()
+	owner, _ := labels.NewRequirement("owner", "=", []string{"helm"})
+	opts := metav1.ListOptions{LabelSelector: labels.NewSelector().Add(*owner).Add(requirements...).String()}
+
+	var objects []metav1.ObjectMeta
+	switch driver := m.Getenv(helmDriverEnv); driver {
+	case "", "secret", "secrets":
+		secrets, err := client.CoreV1().Secrets(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read the helm release storage in namespace %s", namespace)
+		}
+		for _, secret := range secrets.Items {
+			objects = append(objects, secret.ObjectMeta)
+		}
+	case "configmap", "configmaps":
+		configMaps, err := client.CoreV1().ConfigMaps(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read the helm release storage in namespace %s", namespace)
+		}
+		for _, configMap := range configMaps.Items {
+			objects = append(objects, configMap.ObjectMeta)
+		}
+	default:
+		return nil, fmt.Errorf("the %s helm release storage driver is not supported, use secret or configmap", driver)
+	}
+
+	revisions := make([]releaseRevision, 0, len(objects))
+	for _, object := range objects {
+		version, err := strconv.Atoi(object.Labels["version"])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid version label on the helm release storage object %s/%s", namespace, object.Name)
+		}
+		revisions = append(revisions, releaseRevision{
+			Name:      object.Labels["name"],
+			Namespace: namespace,
+			Version:   version,
+			Status:    object.Labels["status"],
+		})
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		if revisions[i].Name != revisions[j].Name {
+			return revisions[i].Name < revisions[j].Name
+		}
+		return revisions[i].Version < revisions[j].Version
+	})
+	return revisions, nil
+}
+
+// readsReleaseStorage tells whether the mixin can read the release storage of the helm driver itself,
+// the secrets or the configmaps of the namespace of the release
+func (m *Mixin) readsReleaseStorage() bool {
+	switch m.Getenv(helmDriverEnv) {
+	case "", "secret", "secrets", "configmap", "configmaps":
+		return true
+	}
+	return false
+}
+
+// historyEntry is a revision listed by helm history
+type historyEntry struct {
+	Revision int    `json:"revision"`
+	Status   string `json:"status"`
+}
+
+// getReleaseHistoryWithHelm returns the revisions of a release listed by helm history, oldest first, for the storage
+// drivers the mixin cannot read, such as sql or memory. No revision is returned when the release does not exist.
+func (m *Mixin) getReleaseHistoryWithHelm(ctx context.Context, conn clusterConnection, namespace string, release string) ([]releaseRevision, error) {
+	if err := commandNotStarted(ctx, "helm3 history"); err != nil {
+		return nil, err
+	}
+	cmd := m.NewCommand(ctx, "helm3", "history", release, "--output", "json", "--namespace", namespace)
+	cmd.Args = append(cmd.Args, conn.helmArgs()...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	span := startProcessSpan(ctx, "helm3 history", releaseAttributes(release, "", "", namespace)...)
+	out, err := cmd.Output()
+	endProcessSpan(span, err)
+	if err != nil {
+		// The error of helm when the storage holds no revision of the release
+		if strings.Contains(stderr.String(), "release: not found") {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "could not list the revisions of release %s: %s", release, strings.TrimSpace(stderr.String()))
+	}
+
+	var entries []historyEntry
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, errors.Wrapf(err, "could not read the revisions of release %s listed by helm", release)
+	}
+	revisions := make([]releaseRevision, 0, len(entries))
+	for _, entry := range entries {
+		revisions = append(revisions, releaseRevision{Name: release, Namespace: namespace, Version: entry.Revision, Status: entry.Status})
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Version < revisions[j].Version
+	})
+	return revisions, nil
+}
+
+// storedRelease holds the parts of a release record used by the mixin
+type storedRelease struct {
+	Manifest string `json:"manifest"`
+	Chart    struct {
+		Metadata struct {
+			Version string `json:"version"`
+		} `json:"metadata"`
+		Files []struct {
+			Name string `json:"name"`
+			Data []byte `json:"data"`
+		} `json:"files"`
+	} `json:"chart"`
+}
+
+// releaseObjectName is the name of the storage object of a release revision
+func releaseObjectName(revision releaseRevision) string {
+	return fmt.Sprintf("sh.helm.release.v1.%s.v%d", revision.Name, revision.Version)
+}
+
+// getRelease reads the record of a release revision from the helm release storage
+func (m *Mixin) getRelease(ctx context.Context, client kubernetes.Interface, revision releaseRevision) (*storedRelease, error) {
+	name := releaseObjectName(revision)
+
+	var data []byte
+	switch driver := m.Getenv(helmDriverEnv); driver {
+	case "", "secret", "secrets":
+		secret, err := client.CoreV1().Secrets(revision.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read release %s revision %d", revision.Name, revision.Version)
+		}
+		data = secret.Data["release"]
+	case "configmap", "configmaps":
+		configMap, err := client.CoreV1().ConfigMaps(revision.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read release %s revision %d", revision.Name, revision.Version)
+		}
+		data = []byte(configMap.Data["release"])
+	default:
+		return nil, fmt.Errorf("the %s helm release storage driver is not supported, use secret or configmap", driver)
+	}
+
+	release, err := decodeRelease(data)
+	return release, errors.Wrapf(err, "could not decode release %s revision %d", revision.Name, revision.Version)
+}
+
+// setReleaseStatus changes the status of a release revision in the helm release storage,
+// both in the labels of its storage object and in its record, the way helm does
+func (m *Mixin) setReleaseStatus(ctx context.Context, client kubernetes.Interface, revision releaseRevision, status string, description string) error {
+	name := releaseObjectName(revision)
+
+	switch driver := m.Getenv(helmDriverEnv); driver {
+	case "", "secret", "secrets":
+		secret, err := client.CoreV1().Secrets(revision.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		data, err := setRecordStatus(secret.Data["release"], status, description)
+		if err != nil {
+			return err
+		}
+		secret.Data["release"] = data
+		secret.Labels["status"] = status
+		_, err = client.CoreV1().Secrets(revision.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	case "configmap", "configmaps":
+		configMap, err := client.CoreV1().ConfigMaps(revision.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		data, err := setRecordStatus([]byte(configMap.Data["release"]), status, description)
+		if err != nil {
+			return err
+		}
+		configMap.Data["release"] = string(data)
+		configMap.Labels["status"] = status
+		_, err = client.CoreV1().ConfigMaps(revision.Namespace).Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	default:
+		return fmt.Errorf("the %s helm release storage driver is not supported, use secret or configmap", driver)
+	}
+}
+
+// setRecordStatus changes the status and the description of an encoded release record, keeping all its other fields
+func setRecordStatus(data []byte, status string, description string) ([]byte, error) {
+	b, err := decodeReleaseData(data)
+	if err != nil {
+		return nil, err
+	}
+	var record map[string]interface{}
+	if err = json.Unmarshal(b, &record); err != nil {
+		return nil, err
+	}
+	info, _ := record["info"].(map[string]interface{})
+	if info == nil {
+		info = map[string]interface{}{}
+		record["info"] = info
+	}
+	info["status"] = status
+	info["description"] = description
+
+	b, err = json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return encodeReleaseData(b)
+}
+
+// decodeRelease decodes a release the way helm encodes it in its storage, gzipped JSON encoded in base64
+func decodeRelease(data []byte) (*storedRelease, error) {
+	b, err := decodeReleaseData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var release storedRelease
+	if err = json.Unmarshal(b, &release); err != nil {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// decodeReleaseData returns the JSON of a release record from its storage encoding
+func decodeReleaseData(data []byte) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return b, nil
+}
+
+// encodeReleaseData encodes the JSON of a release record for its storage, like helm
+func encodeReleaseData(b []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(b); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// deployedRevision returns the revision of a release that is currently deployed, nil when there is none
+func deployedRevision(history []releaseRevision) *releaseRevision {
+	var deployed *releaseRevision
+	for i := range history {
+		if history[i].Status == releaseStatusDeployed {
+			deployed = &history[i]
+		}
+	}
+	return deployed
+}
+
+// releaseInstalled reports whether the latest revision of a release is still installed,
+// a release uninstalled while keeping its history cannot be uninstalled again.
+func releaseInstalled(history []releaseRevision) bool {
+	return len(history) > 0 && history[len(history)-1].Status != releaseStatusUninstalled
+}
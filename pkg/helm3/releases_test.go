@@ -0,0 +1,226 @@
+package helm3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+// addRelease stores a revision of a release in the fake cluster, the way helm does with its default secret driver
+func addRelease(t *testing.T, client *testclient.Clientset, namespace string, name string, version int, status string) {
+	addReleaseRecord(t, client, namespace, name, version, status, "", nil)
+}
+
+// addReleaseRecord stores a revision of a release with its manifest and chart files
+func addReleaseRecord(t *testing.T, client *testclient.Clientset, namespace string, name string, version int, status string, manifest string, files map[string]string) {
+	var chartFiles []map[string]interface{}
+	for name, data := range files {
+		chartFiles = append(chartFiles, map[string]interface{}{"name": name, "data": []byte(data)})
+	}
+	storeRelease(t, client, namespace, name, version, status, map[string]interface{}{
+		"manifest": manifest,
+		"chart":    map[string]interface{}{"files": chartFiles},
+	})
+}
+
+// addReleaseChart stores a revision of a release deployed from a version of its chart
+func addReleaseChart(t *testing.T, client *testclient.Clientset, namespace string, name string, version int, status string, chartVersion string) {
+	storeRelease(t, client, namespace, name, version, status, map[string]interface{}{
+		"chart": map[string]interface{}{"metadata": map[string]interface{}{"name": name, "version": chartVersion}},
+	})
+}
+
+// storeRelease stores the record of a release revision the way helm does
+func storeRelease(t *testing.T, client *testclient.Clientset, namespace string, name string, version int, status string, record map[string]interface{}) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("sh.helm.release.v1.%s.v%d", name, version),
+			Namespace: namespace,
+			Labels: map[string]string{
+				"owner":   "helm",
+				"name":    name,
+				"version": strconv.Itoa(version),
+				"status":  status,
+			},
+		},
+		Type: "helm.sh/release.v1",
+		Data: map[string][]byte{"release": encodeRelease(t, record)},
+	}
+	require.NoError(t, client.Tracker().Add(secret))
+}
+
+// encodeRelease encodes a release record the way helm does
+func encodeRelease(t *testing.T, record map[string]interface{}) []byte {
+	b, err := json.Marshal(record)
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	_, err = w.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return []byte(base64.StdEncoding.EncodeToString(buf.Bytes()))
+}
+
+func TestMixin_GetReleaseHistory(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("secret driver", func(t *testing.T) {
+		m := NewTestMixin(t)
+		addRelease(t, m.KubeClient, "default", "mysql", 2, "deployed")
+		addRelease(t, m.KubeClient, "default", "mysql", 1, "superseded")
+		addRelease(t, m.KubeClient, "default", "redis", 1, "deployed")
+		addRelease(t, m.KubeClient, "other", "mysql", 1, "deployed")
+
+		history, err := m.getReleaseHistory(ctx, m.KubeClient, "", "mysql")
+		require.NoError(t, err)
+		assert.Equal(t, []releaseRevision{
+			{Name: "mysql", Namespace: "default", Version: 1, Status: "superseded"},
+			{Name: "mysql", Namespace: "default", Version: 2, Status: "deployed"},
+		}, history)
+	})
+
+	t.Run("configmap driver", func(t *testing.T) {
+		m := NewTestMixin(t)
+		m.Setenv("HELM_DRIVER", "configmap")
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "sh.helm.release.v1.mysql.v1",
+				Namespace: "db",
+				Labels:    map[string]string{"owner": "helm", "name": "mysql", "version": "1", "status": "deployed"},
+			},
+		}
+		require.NoError(t, m.KubeClient.Tracker().Add(configMap))
+
+		history, err := m.getReleaseHistory(ctx, m.KubeClient, "db", "mysql")
+		require.NoError(t, err)
+		assert.Equal(t, []releaseRevision{{Name: "mysql", Namespace: "db", Version: 1, Status: "deployed"}}, history)
+	})
+
+	t.Run("missing namespace", func(t *testing.T) {
+		m := NewTestMixin(t)
+
+		history, err := m.getReleaseHistory(ctx, m.KubeClient, "missing", "mysql")
+		require.NoError(t, err)
+		assert.Empty(t, history)
+	})
+
+	t.Run("unsupported driver", func(t *testing.T) {
+		m := NewTestMixin(t)
+		m.Setenv("HELM_DRIVER", "sql")
+
+		_, err := m.getReleaseHistory(ctx, m.KubeClient, "", "mysql")
+		require.EqualError(t, err, "the sql helm release storage driver is not supported, use secret or configmap")
+	})
+
+	t.Run("objects not owned by helm", func(t *testing.T) {
+		m := NewTestMixin(t)
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Name:      "mysql",
+			Namespace: "default",
+			Labels:    map[string]string{"name": "mysql", "version": "1"},
+		}}
+		require.NoError(t, m.KubeClient.Tracker().Add(secret))
+
+		history, err := m.getReleaseHistory(ctx, m.KubeClient, "", "mysql")
+		require.NoError(t, err)
+		assert.Empty(t, history)
+	})
+}
+
+func TestMixin_ListReleaseRevisions(t *testing.T) {
+	m := NewTestMixin(t)
+	addRelease(t, m.KubeClient, "default", "mysql", 1, "deployed")
+	addRelease(t, m.KubeClient, "default", "redis", 1, "failed")
+
+	revisions, err := m.listReleaseRevisions(context.Background(), m.KubeClient, "", labels.Set{"status": "failed"}.AsSelector())
+	require.NoError(t, err)
+	assert.Equal(t, []releaseRevision{{Name: "redis", Namespace: "default", Version: 1, Status: "failed"}}, revisions)
+}
+
+func TestReleaseInstalled(t *testing.T) {
+	assert.False(t, releaseInstalled(nil))
+	assert.True(t, releaseInstalled([]releaseRevision{{Version: 1, Status: "superseded"}, {Version: 2, Status: "failed"}}))
+	assert.False(t, releaseInstalled([]releaseRevision{{Version: 1, Status: "uninstalled"}}))
+}
+
+func TestMixin_GetRelease(t *testing.T) {
+	ctx := context.Background()
+	m := NewTestMixin(t)
+	addReleaseRecord(t, m.KubeClient, "db", "mysql", 3, "deployed", "kind: Service\n", map[string]string{"crds/backup.yaml": "kind: CustomResourceDefinition\n"})
+
+	release, err := m.getRelease(ctx, m.KubeClient, releaseRevision{Name: "mysql", Namespace: "db", Version: 3})
+	require.NoError(t, err)
+	assert.Equal(t, "kind: Service\n", release.Manifest)
+	require.Len(t, release.Chart.Files, 1)
+	assert.Equal(t, "crds/backup.yaml", release.Chart.Files[0].Name)
+	assert.Equal(t, "kind: CustomResourceDefinition\n", string(release.Chart.Files[0].Data))
+
+	_, err = m.getRelease(ctx, m.KubeClient, releaseRevision{Name: "mysql", Namespace: "db", Version: 2})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "could not read release mysql revision 2")
+}
+
+func TestMixin_SetReleaseStatus(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("secret driver", func(t *testing.T) {
+		m := NewTestMixin(t)
+		addReleaseRecord(t, m.KubeClient, "db", "mysql", 2, "pending-upgrade", "kind: Service\n", nil)
+		revision := releaseRevision{Name: "mysql", Namespace: "db", Version: 2, Status: "pending-upgrade"}
+
+		err := m.setReleaseStatus(ctx, m.KubeClient, revision, "failed", "interrupted")
+		require.NoError(t, err)
+
+		history, err := m.getReleaseHistory(ctx, m.KubeClient, "db", "mysql")
+		require.NoError(t, err)
+		assert.Equal(t, []releaseRevision{{Name: "mysql", Namespace: "db", Version: 2, Status: "failed"}}, history)
+
+		secret, err := m.KubeClient.CoreV1().Secrets("db").Get(ctx, "sh.helm.release.v1.mysql.v2", metav1.GetOptions{})
+		require.NoError(t, err)
+		b, err := decodeReleaseData(secret.Data["release"])
+		require.NoError(t, err)
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal(b, &record))
+		assert.Equal(t, map[string]interface{}{"status": "failed", "description": "interrupted"}, record["info"])
+		assert.Equal(t, "kind: Service\n", record["manifest"], "the other fields of the record are kept")
+	})
+
+	t.Run("configmap driver", func(t *testing.T) {
+		m := NewTestMixin(t)
+		m.Setenv("HELM_DRIVER", "configmap")
+		data, err := encodeReleaseData([]byte(`{"name":"mysql","info":{"status":"pending-install"}}`))
+		require.NoError(t, err)
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "sh.helm.release.v1.mysql.v1",
+				Namespace: "db",
+				Labels:    map[string]string{"owner": "helm", "name": "mysql", "version": "1", "status": "pending-install"},
+			},
+			Data: map[string]string{"release": string(data)},
+		}
+		require.NoError(t, m.KubeClient.Tracker().Add(configMap))
+
+		err = m.setReleaseStatus(ctx, m.KubeClient, releaseRevision{Name: "mysql", Namespace: "db", Version: 1}, "failed", "interrupted")
+		require.NoError(t, err)
+
+		configMap, err = m.KubeClient.CoreV1().ConfigMaps("db").Get(ctx, "sh.helm.release.v1.mysql.v1", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "failed", configMap.Labels["status"])
+		b, err := decodeReleaseData([]byte(configMap.Data["release"]))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"name":"mysql","info":{"status":"failed","description":"interrupted"}}`, string(b))
+	})
+}
@@ -0,0 +1,54 @@
+package helm3
+
+// RepositoryArguments represent the chart source settings shared by the Install and Upgrade steps
+type RepositoryArguments struct {
+	Repo                  string `yaml:"repo"`
+	Username              string `yaml:"username"`
+	Password              string `yaml:"password"`
+	CaFile                string `yaml:"caFile"`
+	CertFile              string `yaml:"certFile"`
+	KeyFile               string `yaml:"keyFile"`
+	InsecureSkipTLSVerify bool   `yaml:"insecureSkipTlsVerify"`
+	PassCredentials       bool   `yaml:"passCredentials"`
+}
+
+// repositoryArgs returns the helm flags used to locate and download the chart.
+// Each setting is applied on its own, so a public repository only needs a repo url
+// and credentials or certificates can be used for a chart url without a repo.
+func (r RepositoryArguments) repositoryArgs() []string {
+	var args []string
+
+	if r.Repo != "" {
+		args = append(args, "--repo", r.Repo)
+	}
+
+	if r.Username != "" {
+		args = append(args, "--username", r.Username)
+	}
+
+	if r.Password != "" {
+		args = append(args, "--password", r.Password)
+	}
+
+	if r.CaFile != "" {
+		args = append(args, "--ca-file", r.CaFile)
+	}
+
+	if r.CertFile != "" {
+		args = append(args, "--cert-file", r.CertFile)
+	}
+
+	if r.KeyFile != "" {
+		args = append(args, "--key-file", r.KeyFile)
+	}
+
+	if r.InsecureSkipTLSVerify {
+		args = append(args, "--insecure-skip-tls-verify")
+	}
+
+	if r.PassCredentials {
+		args = append(args, "--pass-credentials")
+	}
+
+	return args
+}
@@ -0,0 +1,171 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults of the retry policy of a step
+const (
+	defaultRetryAttempts = 3
+	defaultRetryBackoff  = 10 * time.Second
+	maxRetryBackoff      = 5 * time.Minute
+)
+
+// defaultRetryPatterns match the transient errors reported by helm and the API server
+var defaultRetryPatterns = []string{
+	`another operation \(install/upgrade/rollback\) is in progress`,
+	`etcdserver: request timed out`,
+	`etcdserver: leader changed`,
+	`TLS handshake timeout`,
+	`i/o timeout`,
+	`connection reset by peer`,
+	`the server is currently unable to handle the request`,
+	`the object has been modified; please apply your changes to the latest version`,
+}
+
+// Retry runs the helm command of a step again when it fails with a transient error
+type Retry struct {
+	// Attempts is the maximum number of times the command runs, the first one included, defaults to 3
+	Attempts int `yaml:"attempts,omitempty"`
+	// Backoff is the delay before the second attempt, doubled before each following one, defaults to 10s
+	Backoff string `yaml:"backoff,omitempty"`
+	// Patterns are the regular expressions matching the errors that are retried, defaults to the transient errors of helm and the API server
+	Patterns []string `yaml:"patterns,omitempty"`
+}
+
+// retryPolicy is the validated retry settings of a step, a step without retry settings runs its command once
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+	patterns []*regexp.Regexp
+}
+
+// policy validates the retry settings and applies their defaults
+func (r *Retry) policy() (retryPolicy, error) {
+	if r == nil {
+		return retryPolicy{attempts: 1}, nil
+	}
+
+	policy := retryPolicy{attempts: r.Attempts, backoff: defaultRetryBackoff}
+	if policy.attempts == 0 {
+		policy.attempts = defaultRetryAttempts
+	}
+	if policy.attempts < 0 {
+		return retryPolicy{}, fmt.Errorf("invalid retry attempts %d, must be at least 1", r.Attempts)
+	}
+
+	if r.Backoff != "" {
+		backoff, err := time.ParseDuration(r.Backoff)
+		if err != nil || backoff < 0 {
+			return retryPolicy{}, fmt.Errorf("invalid retry backoff %q, must be a duration such as 10s", r.Backoff)
+		}
+		policy.backoff = backoff
+	}
+
+	patterns := r.Patterns
+	if len(patterns) == 0 {
+		patterns = defaultRetryPatterns
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return retryPolicy{}, errors.Wrapf(err, "invalid retry pattern %q", pattern)
+		}
+		policy.patterns = append(policy.patterns, re)
+	}
+	return policy, nil
+}
+
+// delay is the time to wait after a failed attempt, the first attempt being 1
+func (p retryPolicy) delay(attempt int) time.Duration {
+	delay := p.backoff
+	for i := 1; i < attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return delay
+}
+
+// match returns the line of the error output matching one of the patterns, the reason to run the command again
+func (p retryPolicy) match(errOutput string) (string, bool) {
+	for _, line := range strings.Split(errOutput, "\n") {
+		for _, pattern := range p.patterns {
+			if pattern.MatchString(line) {
+				return strings.TrimSpace(line), true
+			}
+		}
+	}
+	return "", false
+}
+
+// retrySleep waits before the next attempt, unless ctx is done first
+var retrySleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runCommand runs cmd with run, and runs a new command with the same arguments while it fails with an error matching the retry policy.
+// With several attempts, the reason why each attempt failed is logged to errOut.
+func (m *Mixin) runCommand(ctx context.Context, cmd *exec.Cmd, policy retryPolicy, errOut io.Writer, run func(cmd *exec.Cmd) error) error {
+	stdout, stderr := cmd.Stdout, cmd.Stderr
+	for attempt := 1; ; attempt++ {
+		// Keep the error output of helm to find out whether the error is transient
+		errOutput := &bytes.Buffer{}
+		cmd.Stderr = errOutput
+		if stderr != nil {
+			cmd.Stderr = io.MultiWriter(stderr, errOutput)
+		}
+		err := run(cmd)
+		flushLogs(stdout, stderr)
+		var interrupted *interruptedError
+		if err == nil || policy.attempts <= 1 || errors.As(err, &interrupted) {
+			return err
+		}
+
+		reason, retryable := policy.match(errOutput.String() + "\n" + err.Error())
+		switch {
+		case !retryable:
+			fmt.Fprintf(errOut, "Attempt %d of %d failed with an error that is not retried: %s\n", attempt, policy.attempts, lastLine(errOutput.String(), err))
+			return err
+		case attempt >= policy.attempts:
+			fmt.Fprintf(errOut, "Attempt %d of %d failed: %s\n", attempt, policy.attempts, reason)
+			return err
+		}
+
+		delay := policy.delay(attempt)
+		fmt.Fprintf(errOut, "Attempt %d of %d failed: %s, retrying in %s\n", attempt, policy.attempts, reason, delay)
+		if err := retrySleep(ctx, delay); err != nil {
+			return errors.Wrapf(err, "stopped retrying %s", strings.Join(redactArgs(cmd.Args), " "))
+		}
+
+		next := exec.Command(cmd.Path)
+		next.Args, next.Env, next.Dir, next.Stdin, next.Stdout, next.Stderr = cmd.Args, cmd.Env, cmd.Dir, cmd.Stdin, stdout, stderr
+		cmd = next
+	}
+}
+
+// lastLine is the last line of the error output of a command, or its error when it wrote nothing
+func lastLine(errOutput string, err error) string {
+	lines := strings.Split(strings.TrimSpace(errOutput), "\n")
+	if line := strings.TrimSpace(lines[len(lines)-1]); line != "" {
+		return line
+	}
+	return err.Error()
+}
@@ -0,0 +1,217 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"get.porter.sh/porter/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+// recordRetrySleeps replaces the wait between the attempts with the recording of its delay
+func recordRetrySleeps(t *testing.T) *[]time.Duration {
+	sleeps := &[]time.Duration{}
+	previous := retrySleep
+	retrySleep = func(ctx context.Context, d time.Duration) error {
+		*sleeps = append(*sleeps, d)
+		return ctx.Err()
+	}
+	t.Cleanup(func() { retrySleep = previous })
+	return sleeps
+}
+
+func TestRetry_Policy(t *testing.T) {
+	testcases := []struct {
+		name         string
+		retry        *Retry
+		wantAttempts int
+		wantBackoff  time.Duration
+		wantPatterns int
+		wantError    string
+	}{
+		{name: "no retry", retry: nil, wantAttempts: 1},
+		{name: "defaults", retry: &Retry{}, wantAttempts: 3, wantBackoff: 10 * time.Second, wantPatterns: len(defaultRetryPatterns)},
+		{name: "custom", retry: &Retry{Attempts: 5, Backoff: "2s", Patterns: []string{"timeout"}}, wantAttempts: 5, wantBackoff: 2 * time.Second, wantPatterns: 1},
+		{name: "negative attempts", retry: &Retry{Attempts: -1}, wantError: "invalid retry attempts -1"},
+		{name: "invalid backoff", retry: &Retry{Backoff: "soon"}, wantError: `invalid retry backoff "soon"`},
+		{name: "invalid pattern", retry: &Retry{Patterns: []string{"("}}, wantError: `invalid retry pattern "("`},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := tc.retry.policy()
+			if tc.wantError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.wantError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantAttempts, policy.attempts)
+			assert.Equal(t, tc.wantBackoff, policy.backoff)
+			assert.Len(t, policy.patterns, tc.wantPatterns)
+		})
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	policy := retryPolicy{attempts: 10, backoff: 10 * time.Second}
+	assert.Equal(t, 10*time.Second, policy.delay(1))
+	assert.Equal(t, 20*time.Second, policy.delay(2))
+	assert.Equal(t, 40*time.Second, policy.delay(3))
+	assert.Equal(t, maxRetryBackoff, policy.delay(9), "the delay is capped")
+}
+
+func TestMixin_RunCommand(t *testing.T) {
+	ctx := context.Background()
+	policy, err := (&Retry{Attempts: 3, Backoff: "1s"}).policy()
+	require.NoError(t, err)
+
+	t.Run("retries transient errors", func(t *testing.T) {
+		sleeps := recordRetrySleeps(t)
+		m := NewTestMixin(t)
+		out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+		cmd := exec.Command("helm3", "upgrade", "mysql", "--password", "pass")
+		cmd.Stdout, cmd.Stderr = out, errOut
+
+		var cmds []*exec.Cmd
+		err := m.runCommand(ctx, cmd, policy, errOut, func(cmd *exec.Cmd) error {
+			cmds = append(cmds, cmd)
+			if len(cmds) < 3 {
+				fmt.Fprintln(cmd.Stderr, "Error: UPGRADE FAILED: another operation (install/upgrade/rollback) is in progress")
+				return errors.New("exit status 1")
+			}
+			return nil
+		})
+		require.NoError(t, err)
+
+		require.Len(t, cmds, 3)
+		assert.NotSame(t, cmds[0], cmds[1], "each attempt runs a new command")
+		for _, c := range cmds {
+			assert.Equal(t, []string{"helm3", "upgrade", "mysql", "--password", "pass"}, c.Args)
+		}
+		assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, *sleeps)
+		assert.Contains(t, errOut.String(), "Attempt 1 of 3 failed: Error: UPGRADE FAILED: another operation (install/upgrade/rollback) is in progress, retrying in 1s\n")
+		assert.Contains(t, errOut.String(), "Attempt 2 of 3 failed: Error: UPGRADE FAILED: another operation (install/upgrade/rollback) is in progress, retrying in 2s\n")
+	})
+
+	t.Run("does not retry other errors", func(t *testing.T) {
+		sleeps := recordRetrySleeps(t)
+		m := NewTestMixin(t)
+		errOut := &bytes.Buffer{}
+		cmd := exec.Command("helm3", "upgrade", "mysql")
+		cmd.Stderr = errOut
+
+		attempts := 0
+		err := m.runCommand(ctx, cmd, policy, errOut, func(cmd *exec.Cmd) error {
+			attempts++
+			fmt.Fprintln(cmd.Stderr, `Error: UPGRADE FAILED: values don't meet the specifications of the schema`)
+			return errors.New("exit status 1")
+		})
+		require.EqualError(t, err, "exit status 1")
+		assert.Equal(t, 1, attempts)
+		assert.Empty(t, *sleeps)
+		assert.Contains(t, errOut.String(), "Attempt 1 of 3 failed with an error that is not retried: Error: UPGRADE FAILED: values don't meet the specifications of the schema\n")
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		recordRetrySleeps(t)
+		m := NewTestMixin(t)
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		cmd := exec.Command("helm3", "upgrade", "mysql", "--password", "pass")
+
+		err := m.runCommand(ctx, cmd, policy, &bytes.Buffer{}, func(cmd *exec.Cmd) error {
+			fmt.Fprintln(cmd.Stderr, "Error: etcdserver: request timed out")
+			return errors.New("exit status 1")
+		})
+		require.Error(t, err)
+		assert.Equal(t, "stopped retrying helm3 upgrade mysql --password (redacted): context canceled", err.Error())
+	})
+}
+
+func TestMixin_InstallRetry(t *testing.T) {
+	ctx := context.Background()
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	defer os.Unsetenv(test.ExpectedCommandErrorEnv)
+	os.Setenv(test.ExpectedCommandEnv, "helm3 upgrade --install mysql bitnami/mysql --namespace mydb --atomic --create-namespace")
+
+	action := InstallAction{Steps: []InstallStep{
+		{
+			InstallArguments: InstallArguments{
+				Step:      Step{Description: "Install MySQL"},
+				Name:      "mysql",
+				Chart:     "bitnami/mysql",
+				Namespace: "mydb",
+				Retry:     &Retry{Attempts: 3, Backoff: "5s"},
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	t.Run("transient error", func(t *testing.T) {
+		os.Setenv(test.ExpectedCommandErrorEnv, "Error: UPGRADE FAILED: another operation (install/upgrade/rollback) is in progress")
+		sleeps := recordRetrySleeps(t)
+
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(b)
+
+		err := h.Install(ctx)
+		require.Error(t, err)
+
+		assert.Equal(t, []time.Duration{5 * time.Second, 10 * time.Second}, *sleeps)
+		stderr := h.TestContext.GetError()
+		runs := 0
+		for _, line := range strings.Split(stderr, "\n") {
+			if line == "Error: UPGRADE FAILED: another operation (install/upgrade/rollback) is in progress" {
+				runs++
+			}
+		}
+		assert.Equal(t, 3, runs, "helm runs three times")
+		assert.Contains(t, stderr, "Attempt 3 of 3 failed: Error: UPGRADE FAILED: another operation (install/upgrade/rollback) is in progress\n")
+	})
+
+	t.Run("other error", func(t *testing.T) {
+		os.Setenv(test.ExpectedCommandErrorEnv, "Error: INSTALLATION FAILED: chart not found")
+		sleeps := recordRetrySleeps(t)
+
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(b)
+
+		err := h.Install(ctx)
+		require.Error(t, err)
+
+		assert.Empty(t, *sleeps)
+		assert.Contains(t, h.TestContext.GetError(), "Attempt 1 of 3 failed with an error that is not retried: Error: INSTALLATION FAILED: chart not found\n")
+	})
+}
+
+func TestMixin_UninstallInvalidRetry(t *testing.T) {
+	action := UninstallAction{Steps: []UninstallStep{
+		{
+			UninstallArguments: UninstallArguments{
+				Step:     Step{Description: "Uninstall MySQL"},
+				Releases: []string{"mysql"},
+				Retry:    &Retry{Backoff: "-1s"},
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+
+	err = h.Uninstall(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid retry backoff "-1s"`)
+}
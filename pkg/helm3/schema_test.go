@@ -47,6 +47,39 @@ func TestMixin_ValidateSchema(t *testing.T) {
 		{"install", "testdata/uninstall-input.yaml", ""},
 		{"invalid property", "testdata/invalid-input.yaml", "Additional property args is not allowed"},
 		{"mixin config", "testdata/config-input.yaml", ""},
+		{"install from a public repo", "testdata/install-input-repo.yaml", ""},
+		{"install from a private repo", "testdata/install-input-repo-tls.yaml", ""},
+		{"install with dependencies", "testdata/install-input-depends-on.yaml", ""},
+		{"install with a post-renderer", "testdata/install-input-post-renderer.yaml", ""},
+		{"install with common labels and annotations", "testdata/install-input-common-metadata.yaml", ""},
+		{"common label that is not a string", "testdata/bad-install-input.common-labels-not-string.yaml", "Invalid type. Expected: string, given: integer"},
+		{"post-renderer with a binary and kustomize", "testdata/bad-install-input.post-renderer-both.yaml", "Must validate one and only one schema"},
+		{"uninstall by selector", "testdata/uninstall-input-selector.yaml", ""},
+		{"uninstall without ignoring missing releases", "testdata/uninstall-input-ignore-not-found.yaml", ""},
+		{"uninstall without release", "testdata/bad-uninstall-input.no-release.yaml", "Must validate at least one schema (anyOf)"},
+		{"uninstall with an invalid cascade", "testdata/bad-uninstall-input.cascade.yaml", "cascade must be one of the following"},
+		{"uninstall and delete the namespace", "testdata/uninstall-input-delete-namespace.yaml", ""},
+		{"install with a kubeconfig context and in-cluster", "testdata/install-input-connection.yaml", ""},
+		{"install as a service account and impersonating a user", "testdata/install-input-identity.yaml", ""},
+		{"service account without namespace", "testdata/bad-install-input.service-account.yaml", "Does not match pattern"},
+		{"install to several clusters", "testdata/install-input-clusters.yaml", ""},
+		{"cluster without name", "testdata/bad-install-input.cluster-name.yaml", "name is required"},
+		{"uninstall with an invalid namespace deletion", "testdata/bad-uninstall-input.delete-namespace.yaml", "Must validate one and only one schema"},
+		{"uninstall and purge", "testdata/uninstall-input-purge.yaml", ""},
+		{"install with preflight checks", "testdata/install-input-preflight.yaml", ""},
+		{"install with diagnostics", "testdata/install-input-diagnostics.yaml", ""},
+		{"install watching the failing pods", "testdata/install-input-diagnostics-watch.yaml", ""},
+		{"check the drift of a release", "testdata/execute-input-drift.yaml", ""},
+		{"drift without release", "testdata/bad-execute-input.drift-no-release.yaml", "release is required"},
+		{"check the health of a release", "testdata/execute-input-health.yaml", ""},
+		{"uninstall with a summary output", "testdata/uninstall-input-summary.yaml", ""},
+		{"upgrade with retries", "testdata/upgrade-input-retry.yaml", ""},
+		{"install recovering a pending release", "testdata/install-input-recover-pending.yaml", ""},
+		{"upgrade with an invalid recovery", "testdata/bad-upgrade-input.recover-pending.yaml", "recoverPending must be one of the following"},
+		{"install with a deadline", "testdata/install-input-deadline.yaml", ""},
+		{"install with an invalid deadline", "testdata/bad-install-input.deadline.yaml", "Does not match pattern"},
+		{"username without password", "testdata/bad-install-input.username-without-password.yaml", "Has a dependency on password"},
+		{"cert without key", "testdata/bad-upgrade-input.cert-without-key.yaml", "Has a dependency on keyFile"},
 	}
 
 	for _, tc := range testcases {
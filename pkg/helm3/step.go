@@ -3,6 +3,12 @@ package helm3
 type Step struct {
 	Description string       `yaml:"description"`
 	Outputs     []HelmOutput `yaml:"outputs,omitempty"`
+
+	// SummaryOutput is the name of an output the summary of the step is written to as JSON
+	SummaryOutput string `yaml:"summaryOutput,omitempty"`
+
+	// Deadline is the maximum duration of the whole step, such as 15m, unlike the timeout of helm which bounds each of its waits
+	Deadline string `yaml:"deadline,omitempty"`
 }
 
 type HelmOutput struct {
@@ -0,0 +1,220 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// maxParallelStepsEnv holds the maxParallelSteps of the mixin configuration, set in the invocation image by Build
+const maxParallelStepsEnv = "HELM3_MIXIN_MAX_PARALLEL_STEPS"
+
+// stepFunc executes the step at index i of an action, writing its logs to out and errOut
+type stepFunc func(ctx context.Context, i int, out io.Writer, errOut io.Writer) error
+
+// runSteps executes every step of an action payload.
+// Steps run one after the other, ordered by their dependencies and then in the order they were declared,
+// unless the maximum number of parallel steps allows several of them to run at the same time. A step still waits for the steps
+// it depends on, and once a step fails no further step is started.
+// When steps run concurrently their logs are buffered and written in step order,
+// so that the output of one step is never interleaved with another.
+func (m *Mixin) runSteps(ctx context.Context, action string, steps []actionStep, reverse bool, run stepFunc) error {
+	if len(steps) == 0 {
+		return errors.New("expected at least one step, but got 0")
+	}
+
+	if err := validateStepOutputs(steps); err != nil {
+		return err
+	}
+	if err := validateStepDeadlines(steps); err != nil {
+		return err
+	}
+
+	order, waitFor, err := resolveDependencies(steps, reverse)
+	if err != nil {
+		return err
+	}
+
+	// Once the mixin is interrupted, the running commands are stopped and no further command is started
+	ctx, stop := notifyInterruption(ctx)
+	defer stop()
+
+	limit := m.maxParallelSteps()
+	if limit > len(steps) {
+		limit = len(steps)
+	}
+
+	runStep := func(i int, out io.Writer, errOut io.Writer) error {
+		ctx, span := startSpan(ctx, "step "+steps[i].Description, stepAttribute.String(steps[i].Description), releasesAttribute.StringSlice(steps[i].Releases))
+		out, errOut = m.stepLogWriters(action, steps[i], out, errOut)
+		started := logClock()
+		logStepStarted(out)
+		err := m.summarizeStep(ctx, action, steps[i].Step, errOut, func(ctx context.Context) error {
+			return runWithDeadline(ctx, steps[i].Step, func(ctx context.Context) error {
+				return run(ctx, i, out, errOut)
+			})
+		})
+		logStepResult(out, errOut, started, err)
+		endSpan(span, err)
+		return err
+	}
+
+	if limit == 1 {
+		for _, i := range order {
+			if err := runStep(i, m.Out, m.Err); err != nil {
+				// Porter sends a single step in most payloads, its error is returned as is
+				if len(steps) == 1 {
+					return stepError(i, steps[i].Step, err)
+				}
+				return &multierror.Error{Errors: []error{stepError(i, steps[i].Step, err)}}
+			}
+		}
+		return nil
+	}
+
+	outs := make([]bytes.Buffer, len(steps))
+	errOuts := make([]bytes.Buffer, len(steps))
+	stepErrs := make([]error, len(steps))
+	done := make([]chan struct{}, len(steps))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	var mu sync.Mutex
+	failed := false
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+	for _, i := range order {
+		sem <- struct{}{}
+
+		mu.Lock()
+		stop := failed
+		mu.Unlock()
+		if stop {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer close(done[i])
+			defer func() { <-sem }()
+
+			// The steps to wait for come first in the order, so they have already been started
+			for _, j := range waitFor[i] {
+				<-done[j]
+			}
+
+			mu.Lock()
+			stop := failed
+			mu.Unlock()
+			if stop {
+				return
+			}
+
+			if err := runStep(i, &outs[i], &errOuts[i]); err != nil {
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+				stepErrs[i] = stepError(i, steps[i].Step, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var result error
+	for _, i := range order {
+		io.Copy(m.Out, &outs[i])
+		io.Copy(m.Err, &errOuts[i])
+		if stepErrs[i] != nil {
+			result = multierror.Append(result, stepErrs[i])
+		}
+	}
+	return result
+}
+
+// maxParallelSteps is the maximum number of steps run at the same time, set with the --max-parallel-steps flag,
+// or else with the maxParallelSteps of the mixin configuration, in the environment of the invocation image
+func (m *Mixin) maxParallelSteps() int {
+	if m.MaxParallelSteps > 0 {
+		return m.MaxParallelSteps
+	}
+	if limit, err := strconv.Atoi(m.Getenv(maxParallelStepsEnv)); err == nil && limit > 0 {
+		return limit
+	}
+	return 1
+}
+
+// runBuffered calls run for each index from 0 to count, with up to parallelism calls at the same time.
+// Concurrent calls write to buffers, copied to out and errOut in index order once they are all done,
+// so that their logs are not interleaved.
+func runBuffered(count int, parallelism int, out io.Writer, errOut io.Writer, run func(i int, out io.Writer, errOut io.Writer)) {
+	if parallelism <= 1 {
+		for i := 0; i < count; i++ {
+			run(i, out, errOut)
+		}
+		return
+	}
+
+	outs := make([]bytes.Buffer, count)
+	errOuts := make([]bytes.Buffer, count)
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism && w < count; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				o, e := bufferLogs(out, &outs[i]), bufferLogs(errOut, &errOuts[i])
+				run(i, o, e)
+				flushLogs(o, e)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for i := 0; i < count; i++ {
+		copyBufferedLogs(out, &outs[i])
+		copyBufferedLogs(errOut, &errOuts[i])
+	}
+}
+
+// stepError identifies the step that produced err
+func stepError(i int, step Step, err error) error {
+	return errors.Wrapf(err, "step %d (%s) failed", i+1, step.Description)
+}
+
+// validateStepOutputs ensures that each output is written by a single step,
+// otherwise a later step would silently overwrite the output of an earlier one.
+func validateStepOutputs(steps []actionStep) error {
+	owners := make(map[string]int)
+	for i, step := range steps {
+		names := make([]string, 0, len(step.Outputs)+1)
+		for _, output := range step.Outputs {
+			names = append(names, output.Name)
+		}
+		if step.SummaryOutput != "" {
+			names = append(names, step.SummaryOutput)
+		}
+		for _, name := range names {
+			if previous, ok := owners[name]; ok && previous != i {
+				return fmt.Errorf("output %q is declared by both step %d and step %d", name, previous+1, i+1)
+			}
+			owners[name] = i
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"get.porter.sh/porter/pkg/test"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestMixin_MaxParallelSteps(t *testing.T) {
+	testcases := []struct {
+		name string
+		flag int
+		env  string
+		want int
+	}{
+		{name: "default", want: 1},
+		{name: "mixin configuration", env: "3", want: 3},
+		{name: "flag", flag: 2, env: "3", want: 2},
+		{name: "invalid mixin configuration", env: "many", want: 1},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewTestMixin(t)
+			m.MaxParallelSteps = tc.flag
+			m.Setenv("HELM3_MIXIN_MAX_PARALLEL_STEPS", tc.env)
+			assert.Equal(t, tc.want, m.maxParallelSteps())
+		})
+	}
+}
+
+func TestMixin_RunSteps(t *testing.T) {
+	ctx := context.Background()
+	steps := []actionStep{
+		{Step: Step{Description: "First"}},
+		{Step: Step{Description: "Second"}},
+		{Step: Step{Description: "Third"}},
+	}
+
+	t.Run("runs steps in order", func(t *testing.T) {
+		m := NewTestMixin(t)
+
+		var ran []int
+		err := m.runSteps(ctx, "install", steps, false, func(ctx context.Context, i int, out io.Writer, errOut io.Writer) error {
+			ran = append(ran, i)
+			fmt.Fprintf(out, "step %d\n", i)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []int{0, 1, 2}, ran)
+		assert.Equal(t, "step 0\nstep 1\nstep 2\n", m.TestContext.GetOutput())
+	})
+
+	t.Run("stops at the first failed step", func(t *testing.T) {
+		m := NewTestMixin(t)
+
+		var ran []int
+		err := m.runSteps(ctx, "install", steps, false, func(ctx context.Context, i int, out io.Writer, errOut io.Writer) error {
+			ran = append(ran, i)
+			if i == 1 {
+				return errors.New("boom")
+			}
+			return nil
+		})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "step 2 (Second) failed: boom")
+		assert.Equal(t, []int{0, 1}, ran)
+	})
+
+	t.Run("returns the error of a single step as is", func(t *testing.T) {
+		m := NewTestMixin(t)
+
+		err := m.runSteps(ctx, "install", steps[:1], false, func(ctx context.Context, i int, out io.Writer, errOut io.Writer) error {
+			return errors.New("boom")
+		})
+		require.EqualError(t, err, "step 1 (First) failed: boom")
+	})
+
+	t.Run("runs steps concurrently up to the limit", func(t *testing.T) {
+		m := NewTestMixin(t)
+		m.MaxParallelSteps = 2
+
+		var mu sync.Mutex
+		running, maxRunning := 0, 0
+		err := m.runSteps(ctx, "install", steps, false, func(ctx context.Context, i int, out io.Writer, errOut io.Writer) error {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			// Finish the steps in reverse order to check that the logs are still written in step order
+			time.Sleep(time.Duration(len(steps)-i) * 10 * time.Millisecond)
+			fmt.Fprintf(out, "step %d\n", i)
+			fmt.Fprintf(errOut, "step %d error\n", i)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 2, maxRunning)
+		assert.Equal(t, "step 0\nstep 1\nstep 2\n", m.TestContext.GetOutput())
+		// The summary of each step follows its logs
+		assert.Regexp(t, `^step 0 error\nSummary of step First:\n(  .*\n)*step 1 error\nSummary of step Second:\n(  .*\n)*step 2 error\nSummary of step Third:\n(  .*\n)*$`, m.TestContext.GetError())
+	})
+
+	t.Run("reports every failed concurrent step", func(t *testing.T) {
+		m := NewTestMixin(t)
+		m.MaxParallelSteps = 3
+
+		// Only fail once every step has started
+		var started sync.WaitGroup
+		started.Add(len(steps))
+		err := m.runSteps(ctx, "install", steps, false, func(ctx context.Context, i int, out io.Writer, errOut io.Writer) error {
+			started.Done()
+			started.Wait()
+			if i == 1 {
+				return nil
+			}
+			return errors.New("boom")
+		})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "step 1 (First) failed: boom")
+		assert.Contains(t, err.Error(), "step 3 (Third) failed: boom")
+		assert.NotContains(t, err.Error(), "step 2")
+	})
+
+	t.Run("runs steps concurrently up to the limit of the mixin configuration", func(t *testing.T) {
+		m := NewTestMixin(t)
+		m.Setenv("HELM3_MIXIN_MAX_PARALLEL_STEPS", "3")
+
+		// Every step waits for the others, so the steps only complete when they all run at the same time
+		var started sync.WaitGroup
+		started.Add(len(steps))
+		err := m.runSteps(ctx, "install", steps, false, func(ctx context.Context, i int, out io.Writer, errOut io.Writer) error {
+			started.Done()
+			started.Wait()
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("rejects outputs declared by several steps", func(t *testing.T) {
+		m := NewTestMixin(t)
+
+		duplicated := []actionStep{
+			{Step: Step{Description: "First", Outputs: []HelmOutput{{Name: "password"}}}},
+			{Step: Step{Description: "Second", Outputs: []HelmOutput{{Name: "password"}}}},
+		}
+		err := m.runSteps(ctx, "install", duplicated, false, func(ctx context.Context, i int, out io.Writer, errOut io.Writer) error {
+			t.Fatal("no step should run")
+			return nil
+		})
+		require.EqualError(t, err, `output "password" is declared by both step 1 and step 2`)
+	})
+
+	t.Run("requires a step", func(t *testing.T) {
+		m := NewTestMixin(t)
+
+		err := m.runSteps(ctx, "install", nil, false, nil)
+		require.EqualError(t, err, "expected at least one step, but got 0")
+	})
+}
+
+func TestMixin_InstallMultipleSteps(t *testing.T) {
+	ctx := context.Background()
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, "helm3 upgrade --install foo mychart --atomic --create-namespace")
+
+	step := func(description, name string) InstallStep {
+		return InstallStep{
+			InstallArguments: InstallArguments{
+				Step:  Step{Description: description},
+				Name:  name,
+				Chart: "mychart",
+			},
+		}
+	}
+
+	t.Run("all steps succeed", func(t *testing.T) {
+		action := InstallAction{Steps: []InstallStep{step("Install Foo", "foo"), step("Install Foo again", "foo")}}
+		b, err := yaml.Marshal(action)
+		require.NoError(t, err)
+
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(b)
+
+		err = h.Install(ctx)
+		require.NoError(t, err)
+	})
+
+	t.Run("the failed step is reported", func(t *testing.T) {
+		action := InstallAction{Steps: []InstallStep{step("Install Foo", "foo"), step("Install Bar", "bar")}}
+		b, err := yaml.Marshal(action)
+		require.NoError(t, err)
+
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(b)
+
+		err = h.Install(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "step 2 (Install Bar) failed")
+	})
+}
@@ -0,0 +1,206 @@
+package helm3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// redactedFlags are the flags of helm whose value is a credential
+var redactedFlags = []string{"--password", "--token", "--kube-token"}
+
+// settingFlags are the flags of helm setting chart values, whose values are redacted and whose keys are kept
+var settingFlags = []string{"--set", "--set-string"}
+
+// stepSummary is the summary of a step, printed to stderr at its end and written to its summary output
+type stepSummary struct {
+	Action   string           `json:"action"`
+	Step     string           `json:"step"`
+	Commands []string         `json:"commands,omitempty"`
+	Duration float64          `json:"duration"`
+	Releases []releaseSummary `json:"releases,omitempty"`
+	Outputs  []string         `json:"outputs,omitempty"`
+	Error    string           `json:"error,omitempty"`
+
+	// mu guards the summary against the releases of a step deployed or uninstalled at the same time
+	mu sync.Mutex
+}
+
+// releaseSummary is the state of a release before and after a step, a state is not set when the release is not installed
+type releaseSummary struct {
+	Name      string        `json:"name"`
+	Namespace string        `json:"namespace"`
+	Before    *releaseState `json:"before,omitempty"`
+	After     *releaseState `json:"after,omitempty"`
+}
+
+// releaseState is the latest revision of a release
+type releaseState struct {
+	Revision     int    `json:"revision"`
+	ChartVersion string `json:"chartVersion,omitempty"`
+	Status       string `json:"status"`
+}
+
+func (s *releaseState) String() string {
+	if s == nil {
+		return "not installed"
+	}
+	if s.ChartVersion == "" {
+		return fmt.Sprintf("revision %d, %s", s.Revision, s.Status)
+	}
+	return fmt.Sprintf("revision %d, chart %s, %s", s.Revision, s.ChartVersion, s.Status)
+}
+
+type stepSummaryKey struct{}
+
+// withStepSummary returns a context recording the commands, releases and outputs of a step in summary
+func withStepSummary(ctx context.Context, summary *stepSummary) context.Context {
+	return context.WithValue(ctx, stepSummaryKey{}, summary)
+}
+
+// stepSummaryFrom returns the summary of the step running with ctx. Without any, it is nil and records nothing.
+func stepSummaryFrom(ctx context.Context) *stepSummary {
+	summary, _ := ctx.Value(stepSummaryKey{}).(*stepSummary)
+	return summary
+}
+
+// addCommand records a command run by the step, with its credentials and chart values redacted
+func (s *stepSummary) addCommand(args []string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Commands = append(s.Commands, strings.Join(redactArgs(args), " "))
+}
+
+// addRelease records the state of a release before and after the step
+func (s *stepSummary) addRelease(name string, namespace string, before *releaseState, after *releaseState) {
+	if s == nil {
+		return
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Releases = append(s.Releases, releaseSummary{Name: name, Namespace: namespace, Before: before, After: after})
+}
+
+// addOutput records an output written by the step
+func (s *stepSummary) addOutput(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Outputs = append(s.Outputs, name)
+}
+
+// print writes the summary for people reading the logs of the step
+func (s *stepSummary) print(w io.Writer) {
+	fmt.Fprintf(w, "Summary of step %s:\n", s.Step)
+	fmt.Fprintf(w, "  duration: %.1fs\n", s.Duration)
+	for _, command := range s.Commands {
+		fmt.Fprintf(w, "  command: %s\n", command)
+	}
+	for _, release := range s.Releases {
+		fmt.Fprintf(w, "  release %s/%s: %s -> %s\n", release.Namespace, release.Name, release.Before, release.After)
+	}
+	if len(s.Outputs) > 0 {
+		fmt.Fprintf(w, "  outputs: %s\n", strings.Join(s.Outputs, ", "))
+	}
+	if s.Error != "" {
+		fmt.Fprintf(w, "  error: %s\n", s.Error)
+	}
+}
+
+// summarizeStep runs a step with a summary of it recorded in its context. The summary is printed to errOut
+// once the step is done, whether it succeeded or not, and written as JSON to the summary output of the step.
+func (m *Mixin) summarizeStep(ctx context.Context, action string, step Step, errOut io.Writer, run func(ctx context.Context) error) error {
+	summary := &stepSummary{Action: action, Step: step.Description}
+	started := logClock()
+	err := run(withStepSummary(ctx, summary))
+	summary.Duration = logClock().Sub(started).Seconds()
+	if err != nil {
+		summary.Error = err.Error()
+	}
+
+	summary.print(errOut)
+	if step.SummaryOutput == "" {
+		return err
+	}
+
+	b, outputErr := json.MarshalIndent(summary, "", "  ")
+	if outputErr == nil {
+		outputErr = m.Context.WriteMixinOutputToFile(step.SummaryOutput, b)
+	}
+	if outputErr != nil && err == nil {
+		return errors.Wrapf(outputErr, "unable to write output '%s'", step.SummaryOutput)
+	}
+	return err
+}
+
+// readReleaseState reads the latest revision of a release for the summary of a step, nil when the release is not installed.
+// The summary is only informational, so a release storage that cannot be read does not fail the step.
+func (m *Mixin) readReleaseState(ctx context.Context, kubeClient k8s.Interface, namespace string, name string) *releaseState {
+	history, err := m.getReleaseHistory(ctx, kubeClient, namespace, name)
+	if err != nil || len(history) == 0 {
+		return nil
+	}
+	latest := history[len(history)-1]
+
+	state := &releaseState{Revision: latest.Version, Status: latest.Status}
+	if release, err := m.getRelease(ctx, kubeClient, latest); err == nil {
+		state.ChartVersion = release.Chart.Metadata.Version
+	}
+	return state
+}
+
+// redactArgs returns the arguments of a command with the values of the flags holding credentials
+// and the values set on the chart redacted, so that the command can be logged and written as an output
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i := 0; i < len(redacted); i++ {
+		flag, value, inline := strings.Cut(redacted[i], "=")
+		if !strings.HasPrefix(flag, "-") {
+			continue
+		}
+
+		var redact func(string) string
+		switch {
+		case containsString(redactedFlags, flag):
+			redact = func(string) string { return redactedValue }
+		case containsString(settingFlags, flag):
+			redact = redactSettings
+		default:
+			continue
+		}
+
+		if inline {
+			redacted[i] = flag + "=" + redact(value)
+		} else if i+1 < len(redacted) {
+			i++
+			redacted[i] = redact(redacted[i])
+		}
+	}
+	return redacted
+}
+
+// redactSettings redacts the values of a list of chart values such as key1=value1,key2=value2
+func redactSettings(settings string) string {
+	values := strings.Split(settings, ",")
+	for i, value := range values {
+		if key, _, ok := strings.Cut(value, "="); ok {
+			values[i] = key + "=" + redactedValue
+		}
+	}
+	return strings.Join(values, ",")
+}
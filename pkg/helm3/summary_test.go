@@ -0,0 +1,176 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"get.porter.sh/porter/pkg/portercontext"
+	"get.porter.sh/porter/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRedactArgs(t *testing.T) {
+	testcases := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"no secret", []string{"helm3", "status", "mysql"}, []string{"helm3", "status", "mysql"}},
+		{"password", []string{"helm3", "upgrade", "--username", "me", "--password", "pass"}, []string{"helm3", "upgrade", "--username", "me", "--password", "(redacted)"}},
+		{"inline password", []string{"helm3", "registry", "login", "--password=pass"}, []string{"helm3", "registry", "login", "--password=(redacted)"}},
+		{"token", []string{"helm3", "upgrade", "--kube-token", "t0k3n"}, []string{"helm3", "upgrade", "--kube-token", "(redacted)"}},
+		{"short flag", []string{"helm3", "upgrade", "mysql", "-p", "mysql"}, []string{"helm3", "upgrade", "mysql", "-p", "mysql"}},
+		{"values", []string{"helm3", "upgrade", "--set", "password=s3cr3t", "--set-string", "a=1,b=2"}, []string{"helm3", "upgrade", "--set", "password=(redacted)", "--set-string", "a=(redacted),b=(redacted)"}},
+		{"inline values", []string{"helm3", "upgrade", "--set=password=s3cr3t"}, []string{"helm3", "upgrade", "--set=password=(redacted)"}},
+		{"missing value", []string{"helm3", "upgrade", "--password"}, []string{"helm3", "upgrade", "--password"}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			args := append([]string{}, tc.args...)
+			assert.Equal(t, tc.want, redactArgs(args))
+			assert.Equal(t, tc.args, args, "the arguments of the command are unchanged")
+		})
+	}
+}
+
+func TestStepSummary_Print(t *testing.T) {
+	summary := &stepSummary{Action: "upgrade", Step: "Upgrade MySQL", Duration: 12.34}
+	summary.addCommand([]string{"helm3", "upgrade", "mysql", "bitnami/mysql", "--set", "password=s3cr3t"})
+	summary.addRelease("mysql", "", &releaseState{Revision: 1, ChartVersion: "9.4.5", Status: "deployed"}, &releaseState{Revision: 2, ChartVersion: "9.4.6", Status: "deployed"})
+	summary.addRelease("redis", "cache", nil, &releaseState{Revision: 1, Status: "failed"})
+	summary.addOutput("mysql-password")
+	summary.Error = "exit status 1"
+
+	out := &bytes.Buffer{}
+	summary.print(out)
+	assert.Equal(t, `Summary of step Upgrade MySQL:
+  duration: 12.3s
+  command: helm3 upgrade mysql bitnami/mysql --set password=(redacted)
+  release default/mysql: revision 1, chart 9.4.5, deployed -> revision 2, chart 9.4.6, deployed
+  release cache/redis: not installed -> revision 1, failed
+  outputs: mysql-password
+  error: exit status 1
+`, out.String())
+
+	// Without a summary in the context, nothing is recorded
+	stepSummaryFrom(context.Background()).addOutput("mysql-password")
+}
+
+func TestMixin_InstallSummary(t *testing.T) {
+	ctx := context.Background()
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	defer os.Unsetenv(test.ExpectedCommandErrorEnv)
+	os.Setenv(test.ExpectedCommandEnv, "helm3 upgrade --install mysql bitnami/mysql --namespace mydb --version 9.4.6 --username me --password pass --atomic --create-namespace --set password=s3cr3t")
+
+	action := InstallAction{Steps: []InstallStep{
+		{
+			InstallArguments: InstallArguments{
+				Step: Step{
+					Description:   "Install MySQL",
+					Outputs:       []HelmOutput{{Name: "mysql-password", Secret: "mysql", Key: "password"}},
+					SummaryOutput: "mysql-summary",
+				},
+				RepositoryArguments: RepositoryArguments{Username: "me", Password: "pass"},
+				Name:                "mysql",
+				Chart:               "bitnami/mysql",
+				Version:             "9.4.6",
+				Namespace:           "mydb",
+				Set:                 map[string]string{"password": "s3cr3t"},
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	t.Run("succeeded", func(t *testing.T) {
+		os.Setenv(test.ExpectedCommandErrorEnv, "")
+
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(b)
+		addReleaseChart(t, h.KubeClient, "mydb", "mysql", 1, "superseded", "9.4.4")
+		addReleaseChart(t, h.KubeClient, "mydb", "mysql", 2, "deployed", "9.4.5")
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "mysql", Namespace: "mydb"},
+			Data:       map[string][]byte{"password": []byte("s3cr3t")},
+		}
+		require.NoError(t, h.KubeClient.Tracker().Add(secret))
+
+		err := h.Install(ctx)
+		require.NoError(t, err)
+
+		// The commands run by the tests are prefixed with the test binary
+		command := "helm3 upgrade --install mysql bitnami/mysql --namespace mydb --version 9.4.6 --username me --password (redacted) --atomic --create-namespace --set password=(redacted)"
+		stderr := h.TestContext.GetError()
+		assert.Contains(t, stderr, "Summary of step Install MySQL:\n")
+		assert.Contains(t, stderr, " "+command+"\n")
+		// The release storage is not updated by the fake helm command
+		assert.Contains(t, stderr, "  release mydb/mysql: revision 2, chart 9.4.5, deployed -> revision 2, chart 9.4.5, deployed\n")
+		assert.Contains(t, stderr, "  outputs: mysql-password\n")
+		assert.NotContains(t, stderr, "s3cr3t")
+		stdout := h.TestContext.GetOutput()
+		assert.Contains(t, stdout, " "+command+"\n", "the printed command is redacted too")
+		assert.NotContains(t, stdout, "s3cr3t")
+
+		output, err := h.FileSystem.ReadFile(filepath.Join(portercontext.MixinOutputsDir, "mysql-summary"))
+		require.NoError(t, err)
+		var summary stepSummary
+		require.NoError(t, json.Unmarshal(output, &summary))
+		assert.Equal(t, "install", summary.Action)
+		assert.Equal(t, "Install MySQL", summary.Step)
+		require.Len(t, summary.Commands, 1)
+		assert.True(t, strings.HasSuffix(summary.Commands[0], " "+command), summary.Commands[0])
+		assert.Equal(t, []releaseSummary{{
+			Name:      "mysql",
+			Namespace: "mydb",
+			Before:    &releaseState{Revision: 2, ChartVersion: "9.4.5", Status: "deployed"},
+			After:     &releaseState{Revision: 2, ChartVersion: "9.4.5", Status: "deployed"},
+		}}, summary.Releases)
+		assert.Equal(t, []string{"mysql-password"}, summary.Outputs)
+		assert.Greater(t, summary.Duration, 0.0)
+		assert.Empty(t, summary.Error)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		os.Setenv(test.ExpectedCommandErrorEnv, "Error: timed out waiting for the condition")
+
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(b)
+
+		err := h.Install(ctx)
+		require.Error(t, err)
+
+		stderr := h.TestContext.GetError()
+		assert.Contains(t, stderr, "  release mydb/mysql: not installed -> not installed\n")
+		assert.Contains(t, stderr, "  error: exit status 1\n")
+		assert.NotContains(t, stderr, "  outputs:")
+		assert.NotContains(t, err.Error(), "s3cr3t", "the command in the error is redacted")
+		assert.NotContains(t, h.TestContext.GetOutput(), "s3cr3t")
+
+		output, err := h.FileSystem.ReadFile(filepath.Join(portercontext.MixinOutputsDir, "mysql-summary"))
+		require.NoError(t, err, "the summary of a failed step is written too")
+		var summary stepSummary
+		require.NoError(t, json.Unmarshal(output, &summary))
+		assert.Equal(t, "exit status 1", summary.Error)
+		assert.Empty(t, summary.Outputs)
+	})
+}
+
+func TestValidateStepOutputs_Summary(t *testing.T) {
+	steps := []actionStep{
+		{Step: Step{Description: "First", SummaryOutput: "summary"}},
+		{Step: Step{Description: "Second", Outputs: []HelmOutput{{Name: "summary"}}}},
+	}
+	err := validateStepOutputs(steps)
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), `output "summary" is declared by both step 1 and step 2`), err.Error())
+}
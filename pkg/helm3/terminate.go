@@ -0,0 +1,170 @@
+package helm3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultTerminationGracePeriod is the time a child process has to stop once it is asked to, before it is killed
+const defaultTerminationGracePeriod = 30 * time.Second
+
+// detachedContext keeps the values of a context, such as its span, without its cancellation. The child processes are
+// created with it, otherwise the standard library kills them as soon as the context is done, without any grace period.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}             { return nil }
+func (c detachedContext) Err() error                        { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// withoutCancel returns a context with the values of ctx that is never done
+func withoutCancel(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+// interruptedError is the error of a child process stopped because the mixin was interrupted, or because its context was done
+type interruptedError struct {
+	Reason string
+	Err    error
+}
+
+func (e *interruptedError) Error() string {
+	return fmt.Sprintf("interrupted by %s: %s", e.Reason, e.Err)
+}
+
+func (e *interruptedError) Unwrap() error {
+	return e.Err
+}
+
+// interruption is the signal that interrupted the mixin, kept in the context of the action it cancels
+type interruption struct {
+	mu     sync.Mutex
+	signal os.Signal
+}
+
+type interruptionKey struct{}
+
+// withInterruption returns a context canceled by interrupt, which records the first signal it is called with
+func withInterruption(ctx context.Context) (context.Context, func(sig os.Signal), context.CancelFunc) {
+	i := &interruption{}
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, interruptionKey{}, i))
+	interrupt := func(sig os.Signal) {
+		i.mu.Lock()
+		if i.signal == nil {
+			i.signal = sig
+		}
+		i.mu.Unlock()
+		cancel()
+	}
+	return ctx, interrupt, cancel
+}
+
+// notifyInterruption returns the context of an action, canceled like with signal.NotifyContext once the mixin receives
+// SIGTERM or SIGINT, so that no further command is started. The signal is kept to be forwarded to the running child processes.
+// stop releases the signals, and must be called once the action is over.
+func notifyInterruption(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, interrupt, cancel := withInterruption(ctx)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		select {
+		case sig := <-signals:
+			interrupt(sig)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// interruptedBy returns the signal that interrupted the action running with ctx, nil until it is interrupted
+func interruptedBy(ctx context.Context) os.Signal {
+	i, ok := ctx.Value(interruptionKey{}).(*interruption)
+	if !ok {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.signal
+}
+
+// commandNotStarted returns the error of a command that is not started because ctx is done, after the mixin was interrupted
+// or once the deadline of the step is over. It returns nil while ctx is not done.
+func commandNotStarted(ctx context.Context, command string) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	err := errors.Wrapf(ctx.Err(), "%s was not started", command)
+	if sig := interruptedBy(ctx); sig != nil {
+		return &interruptedError{Reason: sig.String(), Err: err}
+	}
+	return err
+}
+
+// waitProcess waits for a started child process to exit. Once ctx is done, it is sent the signal that interrupted
+// the mixin, or SIGTERM, so that helm can stop cleanly and roll back an atomic operation.
+// A process still running at the end of the grace period is killed.
+func (m *Mixin) waitProcess(ctx context.Context, cmd *exec.Cmd) error {
+	return superviseProcess(ctx, cmd, m.TerminationGracePeriod)
+}
+
+// superviseProcess waits for cmd to exit, and stops it when ctx is done, forwarding it the signal that interrupted the mixin.
+// It is killed once the grace period after the signal is over.
+func superviseProcess(ctx context.Context, cmd *exec.Cmd, gracePeriod time.Duration) error {
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	var reason string
+	var kill <-chan time.Time
+	done := ctx.Done()
+	for {
+		select {
+		case err := <-exited:
+			if reason != "" {
+				return &interruptedError{Reason: reason, Err: err}
+			}
+			return err
+		case <-done:
+			done = nil
+			reason = ctx.Err().Error()
+			var sig os.Signal = syscall.SIGTERM
+			if interrupted := interruptedBy(ctx); interrupted != nil {
+				reason, sig = interrupted.String(), interrupted
+			}
+			// Signals are not supported on every platform, the process is killed there
+			if err := cmd.Process.Signal(sig); err != nil {
+				cmd.Process.Kill()
+			}
+			kill = time.After(gracePeriod)
+		case <-kill:
+			cmd.Process.Kill()
+		}
+	}
+}
+
+// reportInterruption reports the state of a release after the helm command deploying it was interrupted,
+// as an atomic operation is only rolled back when helm could stop cleanly
+func reportInterruption(release string, namespace string, state *releaseState, errOut io.Writer) {
+	if namespace == "" {
+		namespace = "default"
+	}
+	fmt.Fprintf(errOut, "The operation on release %s/%s was interrupted, the release is now: %s\n", namespace, release, state)
+	if state != nil && containsString(pendingReleaseStatuses, state.Status) {
+		fmt.Fprintf(errOut, "The release is stuck in %s, set recoverPending to recover it on the next install or upgrade\n", state.Status)
+	}
+}
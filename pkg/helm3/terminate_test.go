@@ -0,0 +1,224 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+// fakeHelm writes a fake helm binary that runs until it is stopped, running onTerm when it receives SIGTERM or SIGINT.
+// It returns the path of the binary, and a channel closed once the binary is ready to handle the signals.
+func fakeHelm(t *testing.T, onTerm string) (string, <-chan struct{}) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake helm binary is a shell script")
+	}
+
+	dir := t.TempDir()
+	started := filepath.Join(dir, "started")
+	helm := filepath.Join(dir, "helm3")
+	script := fmt.Sprintf(`#!/bin/sh
+trap '%s' TERM INT
+echo "helm $*"
+touch %s
+while true; do sleep 0.05; done
+`, onTerm, started)
+	require.NoError(t, os.WriteFile(helm, []byte(script), 0755))
+
+	ready := make(chan struct{})
+	go func() {
+		defer close(ready)
+		for i := 0; i < 200; i++ {
+			if _, err := os.Stat(started); err == nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	return helm, ready
+}
+
+func TestSuperviseProcess(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("exits", func(t *testing.T) {
+		cmd := exec.Command("sh", "-c", "exit 0")
+		require.NoError(t, cmd.Start())
+
+		err := superviseProcess(ctx, cmd, time.Minute)
+		require.NoError(t, err)
+	})
+
+	t.Run("forwards the signals", func(t *testing.T) {
+		helm, ready := fakeHelm(t, `echo cancelled; exit 1`)
+		out := &bytes.Buffer{}
+		cmd := exec.Command(helm, "upgrade")
+		cmd.Stdout = out
+		require.NoError(t, cmd.Start())
+
+		ctx, interrupt, cancel := withInterruption(ctx)
+		defer cancel()
+		go func() {
+			<-ready
+			interrupt(syscall.SIGINT)
+		}()
+		err := superviseProcess(ctx, cmd, time.Minute)
+
+		var interrupted *interruptedError
+		require.True(t, errors.As(err, &interrupted), "unexpected error %v", err)
+		assert.Equal(t, "interrupt", interrupted.Reason)
+		assert.EqualError(t, err, "interrupted by interrupt: exit status 1")
+		assert.Contains(t, out.String(), "cancelled\n", "helm stops cleanly")
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		helm, ready := fakeHelm(t, `echo cancelled; exit 1`)
+		out := &bytes.Buffer{}
+		cmd := exec.Command(helm, "upgrade")
+		cmd.Stdout = out
+		require.NoError(t, cmd.Start())
+
+		ctx, cancel := context.WithCancel(ctx)
+		go func() {
+			<-ready
+			cancel()
+		}()
+		err := superviseProcess(ctx, cmd, time.Minute)
+
+		var interrupted *interruptedError
+		require.True(t, errors.As(err, &interrupted), "unexpected error %v", err)
+		assert.Equal(t, "context canceled", interrupted.Reason)
+		assert.Contains(t, out.String(), "cancelled\n")
+	})
+
+	t.Run("kills helm after the grace period", func(t *testing.T) {
+		helm, ready := fakeHelm(t, `echo ignored`)
+		out := &bytes.Buffer{}
+		cmd := exec.Command(helm, "upgrade")
+		cmd.Stdout = out
+		require.NoError(t, cmd.Start())
+
+		ctx, interrupt, cancel := withInterruption(ctx)
+		defer cancel()
+		go func() {
+			<-ready
+			interrupt(syscall.SIGTERM)
+		}()
+		started := time.Now()
+		err := superviseProcess(ctx, cmd, 200*time.Millisecond)
+
+		var interrupted *interruptedError
+		require.True(t, errors.As(err, &interrupted), "unexpected error %v", err)
+		assert.Equal(t, "terminated", interrupted.Reason)
+		assert.EqualError(t, interrupted.Err, "signal: killed")
+		assert.Contains(t, out.String(), "ignored\n")
+		assert.GreaterOrEqual(t, time.Since(started), 200*time.Millisecond)
+	})
+}
+
+func TestMixin_UpgradeInterrupted(t *testing.T) {
+	helm, ready := fakeHelm(t, `echo "Release mysql has been cancelled" >&2; exit 1`)
+
+	action := UpgradeAction{Steps: []UpgradeStep{
+		{
+			UpgradeArguments: UpgradeArguments{
+				Step:      Step{Description: "Upgrade MySQL"},
+				Name:      "mysql",
+				Chart:     "bitnami/mysql",
+				Namespace: "mydb",
+				Retry:     &Retry{},
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+	h.NewCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, helm, args...)
+	}
+	// The revision helm leaves when it is killed before it could roll back
+	addRelease(t, h.KubeClient, "mydb", "mysql", 1, "deployed")
+	addRelease(t, h.KubeClient, "mydb", "mysql", 2, "pending-upgrade")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-ready
+		cancel()
+	}()
+
+	err = h.Upgrade(ctx)
+	require.Error(t, err)
+	var interrupted *interruptedError
+	require.True(t, errors.As(err, &interrupted), "unexpected error %v", err)
+
+	stderr := h.TestContext.GetError()
+	assert.Contains(t, stderr, "Release mysql has been cancelled\n", "helm is asked to stop instead of being killed")
+	assert.Contains(t, stderr, "The operation on release mydb/mysql was interrupted, the release is now: revision 2, pending-upgrade\n")
+	assert.Contains(t, stderr, "The release is stuck in pending-upgrade, set recoverPending to recover it on the next install or upgrade\n")
+	assert.NotContains(t, stderr, "Attempt 1", "an interrupted command is not retried")
+}
+
+func TestMixin_UninstallInterrupted(t *testing.T) {
+	helm, ready := fakeHelm(t, `echo "Release mysql has been cancelled" >&2; exit 1`)
+
+	action := UninstallAction{Steps: []UninstallStep{
+		{
+			UninstallArguments: UninstallArguments{
+				Step:      Step{Description: "Uninstall the databases"},
+				Releases:  []string{"mysql", "redis"},
+				Namespace: "mydb",
+			},
+		},
+		{
+			UninstallArguments: UninstallArguments{
+				Step:      Step{Description: "Uninstall the cache"},
+				Releases:  []string{"memcached"},
+				Namespace: "mydb",
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+	h.NewCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, helm, args...)
+	}
+	addRelease(t, h.KubeClient, "mydb", "mysql", 1, "deployed")
+	addRelease(t, h.KubeClient, "mydb", "redis", 1, "deployed")
+	addRelease(t, h.KubeClient, "mydb", "memcached", 1, "deployed")
+
+	// The mixin is stopped by porter while helm uninstalls the first release
+	go func() {
+		<-ready
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+
+	err = h.Uninstall(context.Background())
+	require.Error(t, err)
+	var interrupted *interruptedError
+	require.True(t, errors.As(err, &interrupted), "unexpected error %v", err)
+	assert.Equal(t, "terminated", interrupted.Reason)
+	assert.Contains(t, err.Error(), "helm3 uninstall was not started")
+
+	stdout := h.TestContext.GetOutput()
+	assert.Contains(t, stdout, "helm uninstall mysql --namespace mydb\n")
+	assert.NotContains(t, stdout, "helm uninstall redis", "no further release is uninstalled once the mixin is interrupted")
+	assert.NotContains(t, stdout, "helm uninstall memcached", "no further step runs once the mixin is interrupted")
+	assert.Contains(t, h.TestContext.GetError(), "Release mysql has been cancelled\n", "the signal is forwarded to helm")
+}
@@ -0,0 +1,100 @@
+package helm3
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans of the mixin
+const tracerName = "github.com/MChorfa/porter-helm3"
+
+// traceParentEnv and traceStateEnv hold the W3C trace context of the span of porter running the mixin
+const (
+	traceParentEnv = "TRACEPARENT"
+	traceStateEnv  = "TRACESTATE"
+)
+
+// Attributes of the spans of the mixin
+const (
+	releaseAttribute      = attribute.Key("helm.release")
+	chartAttribute        = attribute.Key("helm.chart")
+	chartVersionAttribute = attribute.Key("helm.chart.version")
+	namespaceAttribute    = attribute.Key("k8s.namespace.name")
+	commandAttribute      = attribute.Key("process.command")
+	exitCodeAttribute     = attribute.Key("process.exit_code")
+	outputAttribute       = attribute.Key("porter.output")
+	stepAttribute         = attribute.Key("porter.step.description")
+	releasesAttribute     = attribute.Key("helm.releases")
+)
+
+// ConfigureTracing returns a context holding the trace the mixin runs in, propagated by porter in the TRACEPARENT
+// and TRACESTATE environment variables, so that the spans of the mixin are children of the span of porter.
+func (m *Mixin) ConfigureTracing(ctx context.Context) context.Context {
+	carrier := propagation.MapCarrier{}
+	if parent := m.Getenv(traceParentEnv); parent != "" {
+		carrier.Set("traceparent", parent)
+		carrier.Set("tracestate", m.Getenv(traceStateEnv))
+	}
+	return propagation.TraceContext{}.Extract(ctx, carrier)
+}
+
+// startSpan starts a span with the tracer provider of the span in ctx, or else with the global tracer provider,
+// so that the spans of the mixin are part of the trace of porter. Without any tracer provider, the span is not recorded.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	provider := otel.GetTracerProvider()
+	if parent := trace.SpanFromContext(ctx); parent.IsRecording() {
+		provider = parent.TracerProvider()
+	}
+	return provider.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends a span, with the error status when err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startProcessSpan starts the span of a child process, named after its command such as "helm3 upgrade"
+func startProcessSpan(ctx context.Context, command string, attrs ...attribute.KeyValue) trace.Span {
+	attrs = append(attrs, commandAttribute.String(command))
+	_, span := startSpan(ctx, command, attrs...)
+	return span
+}
+
+// endProcessSpan records the exit code of a child process on its span, and ends it
+func endProcessSpan(span trace.Span, err error) {
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		span.SetAttributes(exitCodeAttribute.Int(0))
+	case errors.As(err, &exitErr):
+		span.SetAttributes(exitCodeAttribute.Int(exitErr.ExitCode()))
+	}
+	endSpan(span, err)
+}
+
+// releaseAttributes are the attributes of the spans about a release, without the empty ones
+func releaseAttributes(release string, chart string, version string, namespace string) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	for _, attr := range []attribute.KeyValue{
+		releaseAttribute.String(release),
+		chartAttribute.String(chart),
+		chartVersionAttribute.String(version),
+		namespaceAttribute.String(namespace),
+	} {
+		if attr.Value.AsString() != "" {
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs
+}
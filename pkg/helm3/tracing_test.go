@@ -0,0 +1,162 @@
+package helm3
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"get.porter.sh/porter/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// startTestTrace returns a context holding the root span of a trace recorded in memory, the way porter passes its trace to the mixin
+func startTestTrace(t *testing.T) (context.Context, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	ctx, _ := provider.Tracer("porter").Start(context.Background(), "porter install")
+	return ctx, exporter
+}
+
+// findSpan returns the ended span with a name
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	require.Failf(t, "span not found", "no span named %q", name)
+	return tracetest.SpanStub{}
+}
+
+func spanAttributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value, len(span.Attributes))
+	for _, attr := range span.Attributes {
+		attrs[attr.Key] = attr.Value
+	}
+	return attrs
+}
+
+func TestMixin_InstallSpans(t *testing.T) {
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	defer os.Unsetenv(test.ExpectedCommandErrorEnv)
+	os.Setenv(test.ExpectedCommandEnv, "helm3 upgrade --install mysql bitnami/mysql --namespace mydb --version 9.4.6 --atomic --create-namespace")
+
+	action := InstallAction{Steps: []InstallStep{
+		{
+			InstallArguments: InstallArguments{
+				Step: Step{
+					Description: "Install MySQL",
+					Outputs:     []HelmOutput{{Name: "mysql-password", Secret: "mysql", Key: "password"}},
+				},
+				Name:      "mysql",
+				Chart:     "bitnami/mysql",
+				Version:   "9.4.6",
+				Namespace: "mydb",
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	t.Run("succeeded", func(t *testing.T) {
+		os.Setenv(test.ExpectedCommandErrorEnv, "")
+		ctx, exporter := startTestTrace(t)
+
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(b)
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "mysql", Namespace: "mydb"},
+			Data:       map[string][]byte{"password": []byte("s3cr3t")},
+		}
+		require.NoError(t, h.KubeClient.Tracker().Add(secret))
+
+		err := h.Install(ctx)
+		require.NoError(t, err)
+
+		spans := exporter.GetSpans()
+		install := findSpan(t, spans, "helm3.Install")
+		step := findSpan(t, spans, "step Install MySQL")
+		helm := findSpan(t, spans, "helm3 upgrade")
+		output := findSpan(t, spans, "output mysql-password")
+
+		porter := trace.SpanContextFromContext(ctx).SpanID()
+		assert.Equal(t, porter, install.Parent.SpanID(), "the action span is a child of the span of porter")
+		assert.Equal(t, install.SpanContext.SpanID(), step.Parent.SpanID())
+		assert.Equal(t, step.SpanContext.SpanID(), helm.Parent.SpanID())
+		assert.Equal(t, step.SpanContext.SpanID(), output.Parent.SpanID())
+
+		attrs := spanAttributes(helm)
+		assert.Equal(t, "mysql", attrs[releaseAttribute].AsString())
+		assert.Equal(t, "bitnami/mysql", attrs[chartAttribute].AsString())
+		assert.Equal(t, "9.4.6", attrs[chartVersionAttribute].AsString())
+		assert.Equal(t, "mydb", attrs[namespaceAttribute].AsString())
+		assert.Equal(t, int64(0), attrs[exitCodeAttribute].AsInt64())
+		assert.Equal(t, "mysql-password", spanAttributes(output)[outputAttribute].AsString())
+		assert.Equal(t, codes.Unset, install.Status.Code)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		os.Setenv(test.ExpectedCommandErrorEnv, "Error: timed out waiting for the condition")
+		ctx, exporter := startTestTrace(t)
+
+		h := NewTestMixin(t)
+		h.In = bytes.NewReader(b)
+
+		err := h.Install(ctx)
+		require.Error(t, err)
+
+		spans := exporter.GetSpans()
+		helm := findSpan(t, spans, "helm3 upgrade")
+		assert.Equal(t, int64(1), spanAttributes(helm)[exitCodeAttribute].AsInt64())
+		assert.Equal(t, codes.Error, helm.Status.Code)
+		assert.Equal(t, codes.Error, findSpan(t, spans, "helm3.Install").Status.Code)
+		for _, span := range spans {
+			assert.NotEqual(t, "output mysql-password", span.Name, "the outputs are not read when helm fails")
+		}
+	})
+}
+
+func TestMixin_ExecuteSpans(t *testing.T) {
+	ctx, exporter := startTestTrace(t)
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, "helm3 status mysql")
+
+	action := Action{Steps: []ExecuteSteps{
+		{ExecuteStep: ExecuteStep{Arguments: []string{"status", "mysql"}}},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+
+	err = h.Execute(ctx)
+	require.NoError(t, err)
+
+	spans := exporter.GetSpans()
+	execute := findSpan(t, spans, "helm3.Execute")
+	helm := findSpan(t, spans, "helm3 status")
+	assert.Equal(t, execute.SpanContext.SpanID(), helm.Parent.SpanID())
+	assert.Equal(t, int64(0), spanAttributes(helm)[exitCodeAttribute].AsInt64())
+}
+
+func TestMixin_SpansWithoutTrace(t *testing.T) {
+	// Without a span in the context, such as when porter does not trace its runs, the spans are not recorded
+	ctx, span := startSpan(context.Background(), "helm3.Install")
+	assert.False(t, span.IsRecording())
+	assert.False(t, trace.SpanContextFromContext(ctx).IsValid())
+	endSpan(span, nil)
+}
@@ -1,15 +1,18 @@
 package helm3
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"os/exec"
+	"path"
 	"strings"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/labels"
+	k8s "k8s.io/client-go/kubernetes"
 )
 
 type UninstallAction struct {
@@ -23,17 +26,62 @@ type UninstallStep struct {
 
 // UninstallArguments are the arguments available for the Uninstall action
 type UninstallArguments struct {
-	Step      `yaml:",inline"`
-	Namespace string   `yaml:"namespace,omitempty"`
-	Releases  []string `yaml:"releases"`
-	NoHooks   bool     `yaml:"noHooks"`
-	Wait      bool     `yaml:"wait"`
-	Timeout   string   `yaml:"timeout"`
-	Debug     bool     `yaml:"debug"`
+	Step           `yaml:",inline"`
+	KubeConnection `yaml:",inline"`
+	Identity       `yaml:",inline"`
+	Namespace      string   `yaml:"namespace,omitempty"`
+	Releases       []string `yaml:"releases"`
+	NoHooks        bool     `yaml:"noHooks"`
+	Wait           bool     `yaml:"wait"`
+	Timeout        string   `yaml:"timeout"`
+	Debug          bool     `yaml:"debug"`
+	DependsOn      []string `yaml:"dependsOn,omitempty"`
+
+	// IgnoreNotFound skips the releases that are not installed instead of failing, defaults to true
+	IgnoreNotFound *bool `yaml:"ignoreNotFound,omitempty"`
+
+	// Selector uninstalls the releases of the namespace whose storage labels match, in addition to Releases
+	Selector string `yaml:"selector,omitempty"`
+	// AllInNamespace uninstalls every release of the namespace
+	AllInNamespace bool `yaml:"allInNamespace,omitempty"`
+	KeepHistory    bool `yaml:"keepHistory,omitempty"`
+	// Cascade is passed to helm uninstall with --cascade, which requires a helm client of v3.12.0 or later
+	Cascade string `yaml:"cascade,omitempty"`
+	// UninstallDescription is passed to helm uninstall with --description, as Description is the one of the step
+	UninstallDescription string `yaml:"uninstallDescription,omitempty"`
+
+	// DeleteNamespace deletes the namespace once its releases are uninstalled, either always with true, or only when it is empty with ifEmpty
+	DeleteNamespace string `yaml:"deleteNamespace,omitempty"`
+
+	// PurgeCrds deletes the CRDs of the releases, that helm keeps when uninstalling a release
+	PurgeCrds bool `yaml:"purgeCrds,omitempty"`
+	// PurgePvcs deletes the persistent volume claims of the releases, that helm keeps when uninstalling a release
+	PurgePvcs bool `yaml:"purgePvcs,omitempty"`
+	// PurgeAllowlist restricts the purged objects to the names matching one of these patterns
+	PurgeAllowlist []string `yaml:"purgeAllowlist,omitempty"`
+
+	// Parallelism is the maximum number of releases uninstalled at the same time, defaults to one at a time
+	Parallelism int `yaml:"parallelism,omitempty"`
+
+	// Retry uninstalls a release again when helm fails with a transient error
+	Retry *Retry `yaml:"retry,omitempty"`
 }
 
+// Deletion propagation policies accepted by the cascade setting of an Uninstall step
+var cascadePolicies = []string{"background", "foreground", "orphan"}
+
+// Outcome of the uninstallation of a release, reported at the end of the step
+const (
+	uninstallResultUninstalled = "uninstalled"
+	uninstallResultSkipped     = "skipped, not installed"
+	uninstallResultFailed      = "failed"
+)
+
 // Uninstall deletes a provided set of Helm releases, supplying optional flags/params
-func (m *Mixin) Uninstall(ctx context.Context) error {
+func (m *Mixin) Uninstall(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "helm3.Uninstall")
+	defer func() { endSpan(span, err) }()
+
 	payload, err := m.getPayloadData()
 	if err != nil {
 		return err
@@ -44,72 +92,254 @@ func (m *Mixin) Uninstall(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	if len(action.Steps) != 1 {
-		return errors.Errorf("expected a single step, but got %d", len(action.Steps))
+
+	steps := make([]actionStep, len(action.Steps))
+	for i, step := range action.Steps {
+		steps[i] = actionStep{Step: step.Step, Releases: step.Releases, DependsOn: step.DependsOn}
 	}
-	step := action.Steps[0]
+	return m.runSteps(ctx, "uninstall", steps, true, func(ctx context.Context, i int, out io.Writer, errOut io.Writer) error {
+		return m.uninstall(ctx, action.Steps[i], out, errOut)
+	})
+}
 
-	// Delete each release one at a time, because helm stops on first error
+// uninstall runs a single uninstall step
+func (m *Mixin) uninstall(ctx context.Context, step UninstallStep, out io.Writer, errOut io.Writer) error {
+	if step.Cascade != "" && !containsString(cascadePolicies, step.Cascade) {
+		return fmt.Errorf("invalid cascade %q, must be one of %s", step.Cascade, strings.Join(cascadePolicies, ", "))
+	}
+	if err := validateDeleteNamespace(step.DeleteNamespace, step.Namespace); err != nil {
+		return err
+	}
+	for _, pattern := range step.PurgeAllowlist {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid purgeAllowlist pattern %q", pattern)
+		}
+	}
+	if _, err := step.Retry.policy(); err != nil {
+		return err
+	}
+
+	conn, disconnect, err := m.connect(ctx, step.KubeConnection, step.Identity)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+
+	kubeClient, err := m.getKubernetesClient(ctx, conn)
+	if err != nil {
+		return errors.Wrap(err, "couldn't get kubernetes client")
+	}
+
+	// Read the releases in the namespace helm uninstalls them from
+	namespace := step.Namespace
+	if namespace == "" {
+		namespace = m.helmNamespace(conn)
+	}
+
+	releases, err := m.resolveReleases(ctx, kubeClient, step, namespace)
+	if err != nil {
+		return err
+	}
+	if len(releases) == 0 {
+		fmt.Fprintln(out, "No release to uninstall")
+		return m.deleteNamespace(ctx, kubeClient, step, out)
+	}
+	fmt.Fprintf(out, "Releases to uninstall: %s\n", strings.Join(releases, ", "))
+
+	// Delete each release separately, because helm stops on first error
 	// This gives us more fine-grained error recovery and handling
+	results := make([]string, len(releases))
+	errs := make([]error, len(releases))
+	runBuffered(len(releases), step.Parallelism, out, errOut, func(i int, out io.Writer, errOut io.Writer) {
+		out, errOut = releaseLogs(out, releases[i]), releaseLogs(errOut, releases[i])
+		results[i], errs[i] = m.uninstallRelease(ctx, conn, kubeClient, step, namespace, releases[i], out, errOut)
+		flushLogs(out, errOut)
+	})
+
 	var result error
-	for _, release := range step.Releases {
-		err = m.delete(ctx, release, step.Namespace, step.NoHooks, step.Wait, step.Timeout, step.Debug)
+	for _, err := range errs {
 		if err != nil {
 			result = multierror.Append(result, err)
 		}
 	}
-	return result
+
+	fmt.Fprintln(out, "Uninstall results:")
+	for i, release := range releases {
+		fmt.Fprintf(out, "  %s: %s\n", release, results[i])
+	}
+	if result != nil {
+		return result
+	}
+
+	return m.deleteNamespace(ctx, kubeClient, step, out)
 }
 
-func (m *Mixin) delete(ctx context.Context, release string, namespace string, noHooks bool, wait bool, timeout string, debug bool) error {
-	cmd := m.NewCommand(ctx, "helm3", "uninstall")
+// uninstallRelease uninstalls a single release of a step from namespace, and purges the objects it leaves behind.
+// It returns the outcome of the uninstallation to report at the end of the step.
+func (m *Mixin) uninstallRelease(ctx context.Context, conn clusterConnection, kubeClient k8s.Interface, step UninstallStep, namespace string, release string, out io.Writer, errOut io.Writer) (string, error) {
+	// Check the release storage first rather than parsing the output of helm uninstall,
+	// so that only a missing release is ignored and not any other missing resource.
+	// helm lists the revisions when the mixin cannot read the storage of the helm driver.
+	var history []releaseRevision
+	var err error
+	if m.readsReleaseStorage() {
+		history, err = m.getReleaseHistory(ctx, kubeClient, namespace, release)
+	} else {
+		history, err = m.getReleaseHistoryWithHelm(ctx, conn, namespace, release)
+	}
+	if err != nil {
+		return uninstallResultFailed, errors.Wrapf(err, "could not check if release %s is installed", release)
+	}
+	if !releaseInstalled(history) {
+		if step.IgnoreNotFound == nil || *step.IgnoreNotFound {
+			fmt.Fprintf(out, "Release %s is not installed, skipping\n", release)
+			return uninstallResultSkipped, nil
+		}
+		return uninstallResultFailed, fmt.Errorf("release %s is not installed", release)
+	}
+	latest := history[len(history)-1]
+
+	// Read the release before uninstalling it, helm deletes its record unless the history is kept
+	var targets purgeTargets
+	if step.PurgeCrds || step.PurgePvcs {
+		targets, err = m.findPurgeTargets(ctx, kubeClient, step, latest)
+		if err != nil {
+			return uninstallResultFailed, errors.Wrapf(err, "could not find the objects of release %s to purge", release)
+		}
+	}
+
+	before := m.readReleaseState(ctx, kubeClient, namespace, release)
+	err = m.delete(ctx, conn, step, release, out, errOut)
+	stepSummaryFrom(ctx).addRelease(release, namespace, before, m.readReleaseState(ctx, kubeClient, namespace, release))
+	if err != nil {
+		return uninstallResultFailed, err
+	}
+
+	if err = m.purge(ctx, conn, kubeClient, release, latest.Namespace, targets, out); err != nil {
+		return uninstallResultFailed, err
+	}
+	return uninstallResultUninstalled, nil
+}
+
+// resolveReleases lists the releases of an uninstall step, the explicit ones first, followed by
+// the installed releases of namespace matching the selector, or all of them with allInNamespace.
+func (m *Mixin) resolveReleases(ctx context.Context, kubeClient k8s.Interface, step UninstallStep, namespace string) ([]string, error) {
+	releases := append([]string{}, step.Releases...)
+	if step.Selector == "" && !step.AllInNamespace {
+		return releases, nil
+	}
+	if step.Selector != "" && step.AllInNamespace {
+		return nil, errors.New("selector and allInNamespace cannot be used together")
+	}
+
+	selector := labels.Everything()
+	if step.Selector != "" {
+		var err error
+		selector, err = labels.Parse(step.Selector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid selector %q", step.Selector)
+		}
+	}
+
+	// Like helm list, only the latest revision of a release is matched against the selector
+	matches, err := m.listReleaseRevisions(ctx, kubeClient, namespace, selector)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list the releases to uninstall")
+	}
+	revisions, err := m.listReleaseRevisions(ctx, kubeClient, namespace, labels.Everything())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list the releases to uninstall")
+	}
+
+	latest := make(map[string]releaseRevision)
+	for _, revision := range revisions {
+		latest[revision.Name] = revision
+	}
+	for _, match := range matches {
+		if match != latest[match.Name] || !releaseInstalled([]releaseRevision{match}) {
+			continue
+		}
+		if !containsString(releases, match.Name) {
+			releases = append(releases, match.Name)
+		}
+	}
+	return releases, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Mixin) delete(ctx context.Context, conn clusterConnection, step UninstallStep, release string, out io.Writer, errOut io.Writer) error {
+	cmd := m.NewCommand(withoutCancel(ctx), "helm3", "uninstall")
 
 	cmd.Args = append(cmd.Args, release)
 
-	if namespace != "" {
-		cmd.Args = append(cmd.Args, "--namespace", namespace)
+	if step.Namespace != "" {
+		cmd.Args = append(cmd.Args, "--namespace", step.Namespace)
 	}
 
-	if noHooks {
+	cmd.Args = append(cmd.Args, conn.helmArgs()...)
+
+	if step.NoHooks {
 		cmd.Args = append(cmd.Args, "--no-hooks")
 	}
 
-	if wait {
+	if step.Wait {
 		cmd.Args = append(cmd.Args, "--wait")
 	}
 
-	if timeout != "" {
-		cmd.Args = append(cmd.Args, "--timeout", timeout)
+	if step.Timeout != "" {
+		cmd.Args = append(cmd.Args, "--timeout", step.Timeout)
 	}
 
-	if debug {
+	if step.Debug {
 		cmd.Args = append(cmd.Args, "--debug")
 	}
-	output := &bytes.Buffer{}
-	cmd.Stdout = io.MultiWriter(m.Out, output)
-	cmd.Stderr = io.MultiWriter(m.Err, output)
 
-	prettyCmd := fmt.Sprintf("%s %s", cmd.Path, strings.Join(cmd.Args, " "))
-	fmt.Fprintln(m.Out, prettyCmd)
+	if step.KeepHistory {
+		cmd.Args = append(cmd.Args, "--keep-history")
+	}
 
-	err := cmd.Start()
-	if err != nil {
-		return fmt.Errorf("could not execute command, %s: %s", prettyCmd, err)
+	if step.Cascade != "" {
+		cmd.Args = append(cmd.Args, "--cascade", step.Cascade)
+	}
+
+	if step.UninstallDescription != "" {
+		cmd.Args = append(cmd.Args, "--description", step.UninstallDescription)
 	}
-	err = cmd.Wait()
+	cmd.Stdout = processOutput(out, "helm3")
+	cmd.Stderr = processOutput(errOut, "helm3")
+	stepSummaryFrom(ctx).addCommand(cmd.Args)
+
+	prettyCmd := fmt.Sprintf("%s %s", cmd.Path, strings.Join(redactArgs(cmd.Args), " "))
+	fmt.Fprintln(out, prettyCmd)
+
+	retry, err := step.Retry.policy()
 	if err != nil {
-		// Gracefully handle the error being a release not loaded or found
-		outputBuffer := strings.ToLower(output.String())
-		if strings.Contains(outputBuffer, fmt.Sprintf(`uninstall: release not loaded: %q`, strings.ToLower(release))) ||
-			strings.Contains(outputBuffer, fmt.Sprintf(`the release named %q is already deleted`, strings.ToLower(release))) ||
-			strings.Contains(outputBuffer, fmt.Sprintf(`release: %q not found`, strings.ToLower(release))) ||
-			strings.Contains(outputBuffer, "release not loaded") ||
-			strings.Contains(outputBuffer, "already deleted") ||
-			strings.Contains(outputBuffer, "release: not found") ||
-			strings.Contains(outputBuffer, "not found") {
-			return nil
+		return err
+	}
+	err = m.runCommand(ctx, cmd, retry, errOut, func(cmd *exec.Cmd) error {
+		if err := commandNotStarted(ctx, "helm3 uninstall"); err != nil {
+			return err
 		}
+		span := startProcessSpan(ctx, "helm3 uninstall", releaseAttributes(release, "", "", step.Namespace)...)
+		err := cmd.Start()
+		if err != nil {
+			endProcessSpan(span, err)
+			return fmt.Errorf("could not execute command, %s: %s", prettyCmd, err)
+		}
+		err = m.waitProcess(ctx, cmd)
+		endProcessSpan(span, err)
 		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not uninstall release %s", release)
 	}
 
 	return nil
@@ -3,14 +3,24 @@ package helm3
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"get.porter.sh/porter/pkg/test"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 type UninstallTest struct {
@@ -34,6 +44,40 @@ func TestMixin_UnmarshalUninstallStep(t *testing.T) {
 	assert.Equal(t, true, step.NoHooks)
 }
 
+func TestMixin_UnmarshalUninstallIgnoreNotFound(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/uninstall-input-ignore-not-found.yaml")
+	require.NoError(t, err)
+
+	var action UninstallAction
+	err = yaml.Unmarshal(b, &action)
+	require.NoError(t, err)
+	require.Len(t, action.Steps, 1)
+	step := action.Steps[0]
+
+	assert.Equal(t, []string{"porter-ci-mysql"}, step.Releases)
+	require.NotNil(t, step.IgnoreNotFound)
+	assert.False(t, *step.IgnoreNotFound)
+}
+
+func TestMixin_UnmarshalUninstallSelector(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/uninstall-input-selector.yaml")
+	require.NoError(t, err)
+
+	var action UninstallAction
+	err = yaml.Unmarshal(b, &action)
+	require.NoError(t, err)
+	require.Len(t, action.Steps, 1)
+	step := action.Steps[0]
+
+	assert.Equal(t, "Uninstall failed releases", step.Description)
+	assert.Empty(t, step.Releases)
+	assert.Equal(t, "status=failed", step.Selector)
+	assert.True(t, step.KeepHistory)
+	assert.Equal(t, "foreground", step.Cascade)
+	assert.Equal(t, "Removed by porter", step.UninstallDescription)
+	assert.Equal(t, 4, step.Parallelism)
+}
+
 func TestMixin_Uninstall(t *testing.T) {
 	releases := []string{
 		"foo",
@@ -74,6 +118,19 @@ func TestMixin_Uninstall(t *testing.T) {
 				},
 			},
 		},
+		{
+			expectedCommand: "helm3 uninstall foo --namespace my-namespace --keep-history --cascade foreground --description cleanup",
+			uninstallStep: UninstallStep{
+				UninstallArguments: UninstallArguments{
+					Step:                 Step{Description: "Uninstall Foo"},
+					Releases:             releases,
+					Namespace:            namespace,
+					KeepHistory:          true,
+					Cascade:              "foreground",
+					UninstallDescription: "cleanup",
+				},
+			},
+		},
 		{
 			expectedCommand: "helm3 uninstall foo --namespace my-namespace --no-hooks --timeout 600 --debug",
 			uninstallStep: UninstallStep{
@@ -100,6 +157,11 @@ func TestMixin_Uninstall(t *testing.T) {
 
 			h := NewTestMixin(t)
 			h.In = bytes.NewReader(b)
+			namespace := uninstallTest.uninstallStep.Namespace
+			if namespace == "" {
+				namespace = "default"
+			}
+			addRelease(t, h.KubeClient, namespace, "foo", 1, "deployed")
 
 			err := h.Uninstall(ctx)
 
@@ -107,3 +169,418 @@ func TestMixin_Uninstall(t *testing.T) {
 		})
 	}
 }
+
+func TestMixin_UninstallNotFound(t *testing.T) {
+	ignoreNotFound := false
+
+	testcases := []struct {
+		name           string
+		release        *releaseRevision
+		ignoreNotFound *bool
+		storageError   error
+		helmError      string
+		wantOutput     string
+		wantError      string
+	}{
+		{
+			name:       "release not installed is skipped by default",
+			wantOutput: "Releases to uninstall: foo\nRelease foo is not installed, skipping\nUninstall results:\n  foo: skipped, not installed\n",
+		},
+		{
+			name:           "release not installed",
+			ignoreNotFound: &ignoreNotFound,
+			wantError:      "release foo is not installed",
+		},
+		{
+			name:       "release uninstalled with its history kept is skipped",
+			release:    &releaseRevision{Name: "foo", Namespace: "my-namespace", Version: 2, Status: "uninstalled"},
+			wantOutput: "Releases to uninstall: foo\nRelease foo is not installed, skipping\nUninstall results:\n  foo: skipped, not installed\n",
+		},
+		{
+			name:         "release storage not readable",
+			storageError: apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "", errors.New("access denied")),
+			wantError:    "could not check if release foo is installed: could not read the helm release storage in namespace my-namespace",
+		},
+		{
+			name:      "missing resource reported by helm",
+			release:   &releaseRevision{Name: "foo", Namespace: "my-namespace", Version: 1, Status: "deployed"},
+			helmError: `Error: uninstall: Failed to purge the release: namespaces "my-namespace" not found`,
+			wantError: "could not uninstall release foo",
+		},
+	}
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	defer os.Unsetenv(test.ExpectedCommandErrorEnv)
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			os.Setenv(test.ExpectedCommandEnv, "helm3 uninstall foo --namespace my-namespace")
+			os.Setenv(test.ExpectedCommandErrorEnv, tc.helmError)
+
+			action := UninstallAction{Steps: []UninstallStep{
+				{
+					UninstallArguments: UninstallArguments{
+						Step:           Step{Description: "Uninstall Foo"},
+						Namespace:      "my-namespace",
+						Releases:       []string{"foo"},
+						IgnoreNotFound: tc.ignoreNotFound,
+					},
+				},
+			}}
+			b, err := yaml.Marshal(action)
+			require.NoError(t, err)
+
+			h := NewTestMixin(t)
+			h.In = bytes.NewReader(b)
+			if tc.release != nil {
+				addRelease(t, h.KubeClient, tc.release.Namespace, tc.release.Name, tc.release.Version, tc.release.Status)
+			}
+			if tc.storageError != nil {
+				h.KubeClient.PrependReactor("list", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tc.storageError
+				})
+			}
+
+			err = h.Uninstall(ctx)
+			if tc.wantError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.wantError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantOutput, h.TestContext.GetOutput())
+		})
+	}
+}
+
+func TestMixin_UninstallReleaseNamespace(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	require.NoError(t, ioutil.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://example.com
+users:
+- name: test
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+    namespace: mydb
+current-context: test
+`), 0600))
+
+	testcases := []struct {
+		name      string
+		env       map[string]string
+		namespace string
+	}{
+		{name: "namespace of helm", env: map[string]string{"HELM_NAMESPACE": "mydb"}, namespace: "mydb"},
+		{name: "namespace of the kubeconfig context", env: map[string]string{"KUBECONFIG": kubeconfig}, namespace: "mydb"},
+		{name: "default namespace", env: map[string]string{"KUBECONFIG": filepath.Join(t.TempDir(), "missing")}, namespace: "default"},
+	}
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, "helm3 uninstall foo")
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			action := UninstallAction{Steps: []UninstallStep{
+				{
+					UninstallArguments: UninstallArguments{
+						Step:     Step{Description: "Uninstall Foo"},
+						Releases: []string{"foo"},
+					},
+				},
+			}}
+			b, err := yaml.Marshal(action)
+			require.NoError(t, err)
+
+			h := NewTestMixin(t)
+			h.In = bytes.NewReader(b)
+			for key, value := range tc.env {
+				h.Setenv(key, value)
+			}
+			addRelease(t, h.KubeClient, tc.namespace, "foo", 1, "deployed")
+
+			err = h.Uninstall(context.Background())
+			require.NoError(t, err)
+			output := h.TestContext.GetOutput()
+			assert.NotContains(t, output, "not installed", "the release is read in the namespace helm uninstalls it from")
+			assert.Contains(t, output, "  foo: uninstalled\n")
+		})
+	}
+}
+
+func TestMixin_UninstallUnsupportedStorageDriver(t *testing.T) {
+	ignoreNotFound := false
+
+	testcases := []struct {
+		name           string
+		history        string
+		ignoreNotFound *bool
+		wantCommands   []string
+		wantOutput     string
+		wantError      string
+	}{
+		{
+			name:         "release installed",
+			history:      `echo '[{"revision":1,"status":"superseded"},{"revision":2,"status":"deployed"}]'`,
+			wantCommands: []string{"history foo --output json --namespace my-namespace", "uninstall"},
+			wantOutput:   "  foo: uninstalled\n",
+		},
+		{
+			name:         "release not installed is skipped by default",
+			history:      `echo 'Error: release: not found' >&2; exit 1`,
+			wantCommands: []string{"history foo --output json --namespace my-namespace"},
+			wantOutput:   "Release foo is not installed, skipping\n",
+		},
+		{
+			name:           "release not installed",
+			history:        `echo 'Error: release: not found' >&2; exit 1`,
+			ignoreNotFound: &ignoreNotFound,
+			wantCommands:   []string{"history foo --output json --namespace my-namespace"},
+			wantError:      "release foo is not installed",
+		},
+		{
+			name:         "history failed",
+			history:      `echo 'Error: could not connect to the database' >&2; exit 1`,
+			wantCommands: []string{"history foo --output json --namespace my-namespace"},
+			wantError:    "could not check if release foo is installed: could not list the revisions of release foo: Error: could not connect to the database: exit status 1",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			action := UninstallAction{Steps: []UninstallStep{
+				{
+					UninstallArguments: UninstallArguments{
+						Step:           Step{Description: "Uninstall Foo"},
+						Namespace:      "my-namespace",
+						Releases:       []string{"foo"},
+						IgnoreNotFound: tc.ignoreNotFound,
+					},
+				},
+			}}
+			b, err := yaml.Marshal(action)
+			require.NoError(t, err)
+
+			h := NewTestMixin(t)
+			h.In = bytes.NewReader(b)
+			h.Setenv("HELM_DRIVER", "sql")
+			var commands []string
+			h.NewCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+				commands = append(commands, strings.Join(args, " "))
+				script := "exit 0"
+				if args[0] == "history" {
+					script = tc.history
+				}
+				return exec.CommandContext(ctx, "sh", append([]string{"-c", script, name}, args...)...)
+			}
+
+			err = h.Uninstall(context.Background())
+			assert.Equal(t, tc.wantCommands, commands)
+			if tc.wantError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.wantError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Contains(t, h.TestContext.GetOutput(), tc.wantOutput)
+		})
+	}
+}
+
+func TestMixin_UninstallSelectedReleases(t *testing.T) {
+	testcases := []struct {
+		name         string
+		step         UninstallArguments
+		wantCommands []string
+		wantOutput   string
+		wantError    string
+	}{
+		{
+			name:         "selector",
+			step:         UninstallArguments{Selector: "status=deployed"},
+			wantCommands: []string{"helm3 uninstall bar --namespace my-namespace", "helm3 uninstall foo --namespace my-namespace"},
+			wantOutput:   "Releases to uninstall: bar, foo\n",
+		},
+		{
+			name:         "selector and explicit releases",
+			step:         UninstallArguments{Releases: []string{"foo", "baz"}, Selector: "status=failed"},
+			wantCommands: []string{"helm3 uninstall foo --namespace my-namespace", "helm3 uninstall baz --namespace my-namespace"},
+			wantOutput:   "Releases to uninstall: foo, baz\n",
+		},
+		{
+			name:         "all in namespace",
+			step:         UninstallArguments{AllInNamespace: true},
+			wantCommands: []string{"helm3 uninstall bar --namespace my-namespace", "helm3 uninstall baz --namespace my-namespace", "helm3 uninstall foo --namespace my-namespace"},
+			wantOutput:   "Releases to uninstall: bar, baz, foo\n",
+		},
+		{
+			name:       "selector matching a previous revision",
+			step:       UninstallArguments{Selector: "status=superseded"},
+			wantOutput: "No release to uninstall\n",
+		},
+		{
+			name:       "no matching release",
+			step:       UninstallArguments{Selector: "name=other"},
+			wantOutput: "No release to uninstall\n",
+		},
+		{
+			name:      "selector and all in namespace",
+			step:      UninstallArguments{Selector: "name=foo", AllInNamespace: true},
+			wantError: "selector and allInNamespace cannot be used together",
+		},
+		{
+			name:      "invalid selector",
+			step:      UninstallArguments{Selector: "name in (foo"},
+			wantError: `invalid selector "name in (foo"`,
+		},
+		{
+			name:      "invalid cascade",
+			step:      UninstallArguments{Releases: []string{"foo"}, Cascade: "always"},
+			wantError: `invalid cascade "always", must be one of background, foreground, orphan`,
+		},
+	}
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			os.Setenv(test.ExpectedCommandEnv, strings.Join(tc.wantCommands, "\n"))
+
+			step := tc.step
+			step.Description = "Uninstall releases"
+			step.Namespace = "my-namespace"
+			action := UninstallAction{Steps: []UninstallStep{{UninstallArguments: step}}}
+			b, err := yaml.Marshal(action)
+			require.NoError(t, err)
+
+			h := NewTestMixin(t)
+			h.In = bytes.NewReader(b)
+			addRelease(t, h.KubeClient, "my-namespace", "foo", 1, "deployed")
+			addRelease(t, h.KubeClient, "my-namespace", "bar", 1, "superseded")
+			addRelease(t, h.KubeClient, "my-namespace", "bar", 2, "deployed")
+			addRelease(t, h.KubeClient, "my-namespace", "baz", 1, "failed")
+			addRelease(t, h.KubeClient, "my-namespace", "old", 1, "uninstalled")
+			addRelease(t, h.KubeClient, "other-namespace", "qux", 1, "deployed")
+
+			err = h.Uninstall(ctx)
+			if tc.wantError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.wantError)
+				return
+			}
+			require.NoError(t, err)
+
+			output := h.TestContext.GetOutput()
+			assert.True(t, strings.HasPrefix(output, tc.wantOutput), output)
+			for _, cmd := range tc.wantCommands {
+				assert.Contains(t, output, cmd)
+			}
+		})
+	}
+}
+
+func TestMixin_UninstallResults(t *testing.T) {
+	ctx := context.Background()
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, "helm3 uninstall foo --namespace my-namespace")
+
+	action := UninstallAction{Steps: []UninstallStep{
+		{
+			UninstallArguments: UninstallArguments{
+				Step:      Step{Description: "Uninstall releases"},
+				Namespace: "my-namespace",
+				Releases:  []string{"foo", "bar", "baz"},
+			},
+		},
+	}}
+	b, err := yaml.Marshal(action)
+	require.NoError(t, err)
+
+	h := NewTestMixin(t)
+	h.In = bytes.NewReader(b)
+	addRelease(t, h.KubeClient, "my-namespace", "foo", 1, "deployed")
+	addRelease(t, h.KubeClient, "my-namespace", "baz", 1, "deployed")
+
+	err = h.Uninstall(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "could not uninstall release baz")
+
+	assert.Contains(t, h.TestContext.GetOutput(), `Uninstall results:
+  foo: uninstalled
+  bar: skipped, not installed
+  baz: failed
+`)
+}
+
+func TestMixin_UninstallParallel(t *testing.T) {
+	ctx := context.Background()
+
+	releases := []string{"r1", "r2", "r3", "r4", "r5", "r6", "r7", "r8"}
+	var commands []string
+	for _, release := range releases {
+		// r3 and r6 fail, the mocked helm rejects any unexpected command
+		if release != "r3" && release != "r6" {
+			commands = append(commands, "helm3 uninstall "+release+" --namespace my-namespace")
+		}
+	}
+
+	defer os.Unsetenv(test.ExpectedCommandEnv)
+	os.Setenv(test.ExpectedCommandEnv, strings.Join(commands, "\n"))
+
+	for _, parallelism := range []int{1, 3, 20} {
+		t.Run(fmt.Sprintf("parallelism %d", parallelism), func(t *testing.T) {
+			action := UninstallAction{Steps: []UninstallStep{
+				{
+					UninstallArguments: UninstallArguments{
+						Step:        Step{Description: "Uninstall releases"},
+						Namespace:   "my-namespace",
+						Releases:    releases,
+						Parallelism: parallelism,
+					},
+				},
+			}}
+			b, err := yaml.Marshal(action)
+			require.NoError(t, err)
+
+			h := NewTestMixin(t)
+			h.In = bytes.NewReader(b)
+			for _, release := range releases {
+				addRelease(t, h.KubeClient, "my-namespace", release, 1, "deployed")
+			}
+
+			err = h.Uninstall(ctx)
+			require.Error(t, err)
+			merr, ok := errors.Cause(err).(*multierror.Error)
+			require.True(t, ok, "expected a multierror, got %T", errors.Cause(err))
+			require.Len(t, merr.Errors, 2, "the step error wraps the errors of the releases")
+			assert.Contains(t, err.Error(), "could not uninstall release r3")
+			assert.Contains(t, err.Error(), "could not uninstall release r6")
+			assert.Less(t, strings.Index(err.Error(), "release r3"), strings.Index(err.Error(), "release r6"), "errors are reported in release order")
+
+			output := h.TestContext.GetOutput()
+			last := -1
+			for _, release := range releases {
+				// The mocked helm prints the expected commands when it fails, skip them
+				i := strings.Index(output, " helm3 uninstall "+release+" --namespace my-namespace\n")
+				require.GreaterOrEqual(t, i, 0, "missing the output of %s", release)
+				assert.Greater(t, i, last, "the output of %s is out of order", release)
+				last = i
+			}
+			assert.Contains(t, output, `Uninstall results:
+  r1: uninstalled
+  r2: uninstalled
+  r3: failed
+  r4: uninstalled
+  r5: uninstalled
+  r6: failed
+  r7: uninstalled
+  r8: uninstalled
+`)
+		})
+	}
+}
@@ -2,12 +2,9 @@ package helm3
 
 import (
 	"context"
-	"fmt"
+	"io"
 	"os/exec"
-	"sort"
-	"strings"
 
-	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
 
@@ -22,7 +19,10 @@ type UpgradeStep struct {
 
 // UpgradeArguments represent the arguments available to the Upgrade step
 type UpgradeArguments struct {
-	Step `yaml:",inline"`
+	Step                `yaml:",inline"`
+	RepositoryArguments `yaml:",inline"`
+	KubeConnection      `yaml:",inline"`
+	Identity            `yaml:",inline"`
 
 	Namespace       string            `yaml:"namespace"`
 	Name            string            `yaml:"name"`
@@ -34,115 +34,107 @@ type UpgradeArguments struct {
 	Wait            bool              `yaml:"wait"`
 	ResetValues     bool              `yaml:"resetValues"`
 	ReuseValues     bool              `yaml:"reuseValues"`
-	Repo            string            `yaml:"repo"`
 	SkipCrds        bool              `yaml:"skipCrds"`
-	Password        string            `yaml:"password"`
-	Username        string            `yaml:"username"`
 	Timeout         string            `yaml:"timeout"`
 	Debug           bool              `yaml:"debug"`
 	Atomic          *bool             `yaml:"atomic,omitempty"`
 	CreateNamespace *bool             `yaml:"createNamespace,omitempty"`
+	DependsOn       []string          `yaml:"dependsOn,omitempty"`
+	PostRenderer    *PostRenderer     `yaml:"postRenderer,omitempty"`
+	Preflight       *Preflight        `yaml:"preflight,omitempty"`
+	KubeVersion     string            `yaml:"kubeVersion,omitempty"`
+	Diagnostics     *Diagnostics      `yaml:"diagnostics,omitempty"`
+	Retry           *Retry            `yaml:"retry,omitempty"`
+	RecoverPending  string            `yaml:"recoverPending,omitempty"`
+
+	CommonLabels      map[string]string `yaml:"commonLabels,omitempty"`
+	CommonAnnotations map[string]string `yaml:"commonAnnotations,omitempty"`
+
+	// Clusters deploys the release to each of these clusters, instead of the cluster of the step
+	Clusters []ClusterTarget `yaml:"clusters,omitempty"`
+	// Parallelism is the maximum number of clusters deployed at the same time, defaults to one at a time
+	Parallelism int `yaml:"parallelism,omitempty"`
 }
 
-// Upgrade issues a helm upgrade command for a release using the provided UpgradeArguments
-func (m *Mixin) Upgrade(ctx context.Context) error {
+// Upgrade issues a helm upgrade command for each step using the provided UpgradeArguments
+func (m *Mixin) Upgrade(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "helm3.Upgrade")
+	defer func() { endSpan(span, err) }()
+
 	payload, err := m.getPayloadData()
 	if err != nil {
 		return err
 	}
 
-	kubeClient, err := m.getKubernetesClient()
-	if err != nil {
-		return errors.Wrap(err, "couldn't get kubernetes client")
-	}
-
 	var action UpgradeAction
 	err = yaml.Unmarshal(payload, &action)
 	if err != nil {
 		return err
 	}
-	if len(action.Steps) != 1 {
-		return errors.Errorf("expected a single step, but got %d", len(action.Steps))
-	}
-	step := action.Steps[0]
-
-	cmd := m.NewCommand(ctx, "helm3", "upgrade", "--install", step.Name, step.Chart)
 
-	if step.Namespace != "" {
-		cmd.Args = append(cmd.Args, "--namespace", step.Namespace)
+	steps := make([]actionStep, len(action.Steps))
+	for i, step := range action.Steps {
+		steps[i] = actionStep{Step: step.Step, Releases: []string{step.Name}, DependsOn: step.DependsOn}
 	}
+	return m.runSteps(ctx, "upgrade", steps, false, func(ctx context.Context, i int, out io.Writer, errOut io.Writer) error {
+		return m.upgrade(ctx, action.Steps[i], out, errOut)
+	})
+}
 
-	if step.Version != "" {
-		cmd.Args = append(cmd.Args, "--version", step.Version)
-	}
+// upgrade runs a single upgrade step
+func (m *Mixin) upgrade(ctx context.Context, step UpgradeStep, out io.Writer, errOut io.Writer) error {
+	var flags []string
 
 	if step.ResetValues {
-		cmd.Args = append(cmd.Args, "--reset-values")
+		flags = append(flags, "--reset-values")
 	}
 
 	if step.ReuseValues {
-		cmd.Args = append(cmd.Args, "--reuse-values")
+		flags = append(flags, "--reuse-values")
 	}
 
 	if step.Wait {
-		cmd.Args = append(cmd.Args, "--wait")
+		flags = append(flags, "--wait")
 	}
 
 	for _, v := range step.Values {
-		cmd.Args = append(cmd.Args, "--values", v)
-	}
-
-	if step.Timeout != "" {
-		cmd.Args = append(cmd.Args, "--timeout", step.Timeout)
+		flags = append(flags, "--values", v)
 	}
 
-	if step.Debug {
-		cmd.Args = append(cmd.Args, "--debug")
-	}
+	flags = append(flags, step.repositoryArgs()...)
 
-	if step.Atomic == nil || *step.Atomic {
-		// This will upgrade process rolls back changes made in case of failed upgrade.
-		cmd.Args = append(cmd.Args, "--atomic")
-	}
-
-	if step.CreateNamespace == nil || *step.CreateNamespace {
-		// This will ensure the creation of the release namespace if not present.
-		cmd.Args = append(cmd.Args, "--create-namespace")
-	}
-
-	cmd.Args = HandleSettingChartValuesForUpgrade(step, cmd)
-
-	cmd.Stdout = m.Out
-	cmd.Stderr = m.Err
-
-	prettyCmd := fmt.Sprintf("%s %s", cmd.Path, strings.Join(cmd.Args, " "))
-	fmt.Fprintln(m.Out, prettyCmd)
+	return m.deploy(ctx, step.deployment(), flags, out, errOut)
+}
 
-	err = cmd.Start()
-	if err != nil {
-		return fmt.Errorf("could not execute command, %s: %s", prettyCmd, err)
+// deployment is the release deployed by the upgrade step
+func (step UpgradeStep) deployment() deployment {
+	return deployment{
+		Step:              step.Step,
+		KubeConnection:    step.KubeConnection,
+		Identity:          step.Identity,
+		Namespace:         step.Namespace,
+		Name:              step.Name,
+		Chart:             step.Chart,
+		Version:           step.Version,
+		Set:               step.Set,
+		Timeout:           step.Timeout,
+		Debug:             step.Debug,
+		Atomic:            step.Atomic,
+		CreateNamespace:   step.CreateNamespace,
+		PostRenderer:      step.PostRenderer,
+		Preflight:         step.Preflight,
+		KubeVersion:       step.KubeVersion,
+		Diagnostics:       step.Diagnostics,
+		Retry:             step.Retry,
+		RecoverPending:    step.RecoverPending,
+		CommonLabels:      step.CommonLabels,
+		CommonAnnotations: step.CommonAnnotations,
+		Clusters:          step.Clusters,
+		Parallelism:       step.Parallelism,
 	}
-	err = cmd.Wait()
-	if err != nil {
-		return err
-	}
-
-	err = m.handleOutputs(ctx, kubeClient, step.Namespace, step.Outputs)
-	return err
 }
 
 // Prepare set arguments
 func HandleSettingChartValuesForUpgrade(step UpgradeStep, cmd *exec.Cmd) []string {
-	// sort the set consistently
-	setKeys := make([]string, 0, len(step.Set))
-	for k := range step.Set {
-
-		setKeys = append(setKeys, k)
-	}
-	sort.Strings(setKeys)
-
-	for _, k := range setKeys {
-		cmd.Args = append(cmd.Args, "--set", fmt.Sprintf("%s=%s", k, step.Set[k]))
-	}
-	return cmd.Args
+	return append(cmd.Args, setArgs(step.Set)...)
 }
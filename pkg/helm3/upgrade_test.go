@@ -223,6 +223,46 @@ func TestMixin_Upgrade(t *testing.T) {
 				},
 			},
 		},
+		{
+			expectedCommand: fmt.Sprintf(`%s %s %s %s %s`, baseUpgrade, baseValues, `--repo https://charts.example.com`, baseAddFlags, baseSetArgs),
+			upgradeStep: UpgradeStep{
+				UpgradeArguments: UpgradeArguments{
+					Step:      Step{Description: "Upgrade Foo"},
+					Namespace: namespace,
+					Name:      name,
+					Chart:     chart,
+					Version:   version,
+					Set:       setArgs,
+					Values:    values,
+					RepositoryArguments: RepositoryArguments{
+						Repo: "https://charts.example.com",
+					},
+				},
+			},
+		},
+		{
+			expectedCommand: fmt.Sprintf(`%s %s %s %s %s`, baseUpgrade, baseValues,
+				`--repo https://charts.example.com --username myuser --password mypass --ca-file ca.crt --insecure-skip-tls-verify`,
+				baseAddFlags, baseSetArgs),
+			upgradeStep: UpgradeStep{
+				UpgradeArguments: UpgradeArguments{
+					Step:      Step{Description: "Upgrade Foo"},
+					Namespace: namespace,
+					Name:      name,
+					Chart:     chart,
+					Version:   version,
+					Set:       setArgs,
+					Values:    values,
+					RepositoryArguments: RepositoryArguments{
+						Repo:                  "https://charts.example.com",
+						Username:              "myuser",
+						Password:              "mypass",
+						CaFile:                "ca.crt",
+						InsecureSkipTLSVerify: true,
+					},
+				},
+			},
+		},
 	}
 
 	defer os.Unsetenv(test.ExpectedCommandEnv)
@@ -2,10 +2,14 @@ package kubernetes
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/pkg/errors"
+	"k8s.io/client-go/dynamic"
 	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 
 	// Needed for cluster that require authentication to negotiate a OAuth token
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
@@ -13,7 +17,88 @@ import (
 
 // ClientFactory is an interface that knows how to create Kubernetes Clients
 type ClientFactory interface {
-	GetClient() (k8s.Interface, error)
+	GetClient(conn Connection) (k8s.Interface, error)
+	GetDynamicClient(conn Connection) (dynamic.Interface, error)
+}
+
+// Connection selects the cluster and the credentials used to reach it.
+// The zero value uses the default loading rules of kubectl: the KUBECONFIG environment variable, then ~/.kube/config.
+type Connection struct {
+	// Kubeconfig is the path of the kubeconfig file
+	Kubeconfig string
+	// Context is the kubeconfig context, instead of the current context
+	Context string
+	// InCluster uses the service account of the pod, instead of a kubeconfig file
+	InCluster bool
+	// TokenFile is a file holding the bearer token used to authenticate, such as a projected service account token
+	TokenFile string
+	// ImpersonateUser is the user to act as, with the permissions granted to it
+	ImpersonateUser string
+	// ImpersonateGroups are the groups to act as, they require ImpersonateUser
+	ImpersonateGroups []string
+	// Timeout bounds each request to the API server, without any timeout when it is zero
+	Timeout time.Duration
+}
+
+// RESTConfig builds the configuration of the clients for the connection
+func (c Connection) RESTConfig() (*rest.Config, error) {
+	var config *rest.Config
+	var err error
+	if c.InCluster {
+		config, err = rest.InClusterConfig()
+	} else {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = c.Kubeconfig
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: c.Context}
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't build kubernetes config: %s", err)
+	}
+
+	if c.TokenFile != "" {
+		// The token replaces the credentials of the kubeconfig user, it is read again when it is rotated
+		config = rest.AnonymousClientConfig(config)
+		config.BearerTokenFile = c.TokenFile
+	}
+	if c.ImpersonateUser != "" {
+		config.Impersonate = rest.ImpersonationConfig{UserName: c.ImpersonateUser, Groups: c.ImpersonateGroups}
+	}
+	config.Timeout = c.Timeout
+	return config, nil
+}
+
+// GenerateKubeconfig writes the connection as a kubeconfig file with a single context,
+// for the tools that cannot select in-cluster or token file credentials, such as helm and kubectl.
+func (c Connection) GenerateKubeconfig() ([]byte, error) {
+	config, err := c.RESTConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	const name = "porter"
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.Clusters[name] = &clientcmdapi.Cluster{
+		Server:                   config.Host,
+		TLSServerName:            config.ServerName,
+		InsecureSkipTLSVerify:    config.Insecure,
+		CertificateAuthority:     config.CAFile,
+		CertificateAuthorityData: config.CAData,
+	}
+	kubeconfig.AuthInfos[name] = &clientcmdapi.AuthInfo{
+		TokenFile:         config.BearerTokenFile,
+		Token:             config.BearerToken,
+		Impersonate:       config.Impersonate.UserName,
+		ImpersonateGroups: config.Impersonate.Groups,
+	}
+	if config.BearerTokenFile != "" {
+		kubeconfig.AuthInfos[name].Token = ""
+	}
+	kubeconfig.Contexts[name] = &clientcmdapi.Context{Cluster: name, AuthInfo: name}
+	kubeconfig.CurrentContext = name
+
+	b, err := clientcmd.Write(*kubeconfig)
+	return b, errors.Wrap(err, "couldn't write kubeconfig")
 }
 
 // ClientFactory struct
@@ -21,10 +106,10 @@ type clientFactory struct {
 }
 
 // GetClient: Read the config and create Kubernetes Clients
-func (f *clientFactory) GetClient() (k8s.Interface, error) {
-	config, err := clientcmd.DefaultClientConfig.ClientConfig()
+func (f *clientFactory) GetClient(conn Connection) (k8s.Interface, error) {
+	config, err := conn.RESTConfig()
 	if err != nil {
-		return nil, fmt.Errorf("couldn't build kubernetes config: %s", err)
+		return nil, err
 	}
 	clientset, err := k8s.NewForConfig(config)
 	if err != nil {
@@ -33,6 +118,19 @@ func (f *clientFactory) GetClient() (k8s.Interface, error) {
 	return clientset, nil
 }
 
+// GetDynamicClient: Read the config and create a client for any kind of resource, such as custom resources
+func (f *clientFactory) GetDynamicClient(conn Connection) (dynamic.Interface, error) {
+	config, err := conn.RESTConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create kubernetes dynamic client")
+	}
+	return client, nil
+}
+
 // New returns an implementation of the ClientFactory interface
 func New() ClientFactory {
 	return &clientFactory{}